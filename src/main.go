@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"manager"
-	"net/http"
-	"utils"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/golang/glog"
 )
 
-var configPath = flag.String("c", "", "config file path")
+var (
+	configPath = flag.String("c", "", "config file path")
+	migrate    = flag.String("migrate", "", "run schema migrations and exit: up | down | status")
+	migrateTo  = flag.Int("migrate-to", -1, "target schema version of -migrate down, default one version back")
+	signEvent  = flag.String("sign-event", "", "print the /event callback path signed with event.secret and exit")
+	checkOnly  = flag.Bool("check-config", false, "validate the config and the files it refers to, then exit")
+)
 
 /*
 	ROOM:
@@ -24,35 +34,75 @@ var configPath = flag.String("c", "", "config file path")
 	2. 定时拉取每个srs server的系统信息
 */
 
-func GetConfig(path string) (*utils.Config, error) {
-	var err error
-	config := utils.NewConfig()
-	if err = config.LoadFromFile(path); err != nil {
-		return nil, err
-	}
-	return config, nil
-}
-
 func main() {
 	flag.Parse()
 
 	var (
-		config *utils.Config
+		config *manager.Config
 		err    error
-		port   int
 	)
-	if config, err = GetConfig(*configPath); err != nil {
-		fmt.Println("GetConfig", err)
+	if config, err = manager.LoadConfig(*configPath); err != nil {
+		fmt.Println("LoadConfig", err)
+		os.Exit(1)
+	}
+	if *checkOnly {
+		if err = manager.CheckConfig(config); err != nil {
+			fmt.Println("CheckConfig", err)
+			os.Exit(1)
+		}
+		fmt.Println("config ok")
 		return
-	} else if err := manager.InitRestHandler(config); err != nil {
-		fmt.Println("err", err)
+	}
+	if *signEvent != "" {
+		fmt.Printf("%s?sign=%s\n", *signEvent, manager.EventSign(config.Event.Secret, *signEvent))
 		return
 	}
-	if port = config.GetInt("port"); port < 0 {
-		fmt.Println("Invalid port param")
+	if *migrate != "" {
+		if err = manager.RunMigrate(config, *migrate, *migrateTo); err != nil {
+			fmt.Println("migrate", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err = manager.InitRestHandler(*configPath, config); err != nil {
+		fmt.Println("err", err)
 		return
 	}
 	fmt.Println("Init success")
-	http.HandleFunc("/", manager.RestHandler)
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	go reloadOnHup()
+
+	server := manager.NewHttpServer(config)
+	errc := make(chan error, 1)
+	go func() { errc <- server.ListenAndServe() }()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err = <-errc:
+		fmt.Println("ListenAndServe", err)
+		os.Exit(1)
+	case sig := <-stop:
+		glog.Infoln("received", sig, "shutting down")
+	}
+
+	// 请求超过 http.shutdownTimeout 后台任务超过 http.stopTimeout 时不再等待 直接退出
+	ctx, cancel := context.WithTimeout(context.Background(), config.HTTP.ShutdownTimeout.Duration)
+	defer cancel()
+	if err = manager.Shutdown(ctx, server, config.HTTP.StopTimeout.Duration); err != nil {
+		glog.Errorln("shutdown", err)
+	}
+	glog.Flush()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// kill -HUP 重新加载配置 失败时继续使用原来的配置
+func reloadOnHup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := manager.ReloadConfig(); err != nil {
+			glog.Errorln("reload config", err)
+		}
+	}
 }
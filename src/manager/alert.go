@@ -0,0 +1,511 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	ALERT_KIND_SERVER_METRIC  = "server_metric"  // 节点指标超过阈值
+	ALERT_KIND_SERVER_STALE   = "server_stale"   // 节点超过阈值秒数没有拉取到数据
+	ALERT_KIND_STREAM_NO_RECV = "stream_no_recv" // 推流中的room在源站上没有收到数据
+	ALERT_KIND_CLIENTS_DROP   = "clients_drop"   // 集群观众数在窗口内下降超过阈值百分比
+
+	ALERT_STATE_PENDING  = "pending"
+	ALERT_STATE_FIRING   = "firing"
+	ALERT_STATE_RESOLVED = "resolved"
+
+	ALERT_EVAL_INTERVAL      = 10 * time.Second
+	ALERT_RESOLVED_RETENTION = 3600
+	ALERT_CLUSTER_KEY        = "cluster"
+
+	URL_SUB_PATH_SILENCES = "silences"
+)
+
+type AlertRule struct {
+	Name       string  `json:"name"`
+	Kind       string  `json:"kind"`
+	ServerType string  `json:"server_type"` // up | down | origin 为空表示全部
+	Metric     string  `json:"metric"`      // server_metric 使用 同 /history 的 metric
+	Op         string  `json:"op"`          // > >= < <=
+	Threshold  float64 `json:"threshold"`
+	For        int64   `json:"for"`    // 条件持续多少秒才触发
+	Window     int64   `json:"window"` // clients_drop 的比较窗口 秒
+	Severity   string  `json:"severity"`
+}
+
+type AlertConfig struct {
+	Rules     []AlertRule      `json:"rules"`
+	Notifiers []NotifierConfig `json:"notifiers"`
+}
+
+func LoadAlertConfig(path string) (*AlertConfig, error) {
+	var c AlertConfig
+	if content, err := ioutil.ReadFile(path); err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("parse alert config %v err:%v", path, err)
+	}
+	names := make(map[string]bool)
+	for _, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate alert rule %v", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return &c, nil
+}
+
+func (r *AlertRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule without name")
+	}
+	if r.ServerType != "" && GetServerType(r.ServerType) < 0 {
+		return fmt.Errorf("alert rule %v invalid server_type %v", r.Name, r.ServerType)
+	}
+	switch r.Kind {
+	case ALERT_KIND_SERVER_METRIC:
+		if _, ok := serverHistoryMetrics[r.Metric]; !ok {
+			return fmt.Errorf("alert rule %v invalid metric %v", r.Name, r.Metric)
+		}
+		if _, err := compare(0, r.Op, 0); err != nil {
+			return fmt.Errorf("alert rule %v %v", r.Name, err)
+		}
+	case ALERT_KIND_CLIENTS_DROP:
+		if r.Window <= 0 {
+			return fmt.Errorf("alert rule %v requires window", r.Name)
+		}
+	case ALERT_KIND_SERVER_STALE, ALERT_KIND_STREAM_NO_RECV:
+	default:
+		return fmt.Errorf("alert rule %v invalid kind %v", r.Name, r.Kind)
+	}
+	return nil
+}
+
+func compare(v float64, op string, threshold float64) (bool, error) {
+	switch op {
+	case ">":
+		return v > threshold, nil
+	case ">=":
+		return v >= threshold, nil
+	case "<":
+		return v < threshold, nil
+	case "<=":
+		return v <= threshold, nil
+	}
+	return false, fmt.Errorf("invalid op %v", op)
+}
+
+type Alert struct {
+	Fingerprint string
+	Rule        string
+	Kind        string
+	Severity    string
+	Key         string // 告警对象 节点地址 流名称 或者 cluster
+	Value       float64
+	Message     string
+	State       string
+	Silenced    bool
+	StartsAt    int64
+	FiredAt     int64
+	ResolvedAt  int64
+	UpdateTime  int64
+}
+
+type Silence struct {
+	ID         string
+	Rule       string `json:"rule"`
+	Key        string `json:"key"` // 为空表示该规则的所有对象
+	Until      int64  `json:"until"`
+	Comment    string `json:"comment"`
+	CreateTime int64
+}
+
+func (s *Silence) Match(alert *Alert, now int64) bool {
+	return s.Until > now && s.Rule == alert.Rule && (s.Key == "" || s.Key == alert.Key)
+}
+
+type alertCondition struct {
+	value   float64
+	message string
+}
+
+type AlertManager struct {
+	db            Store
+	serverManager *ServerManager
+	startTime     int64
+	loop          Loop
+
+	lock          sync.RWMutex
+	rules         []AlertRule
+	notifiers     []Notifier
+	extra         []Notifier // AddNotifier 添加的 热加载时保留
+	alerts        map[string]*Alert
+	silences      map[string]*Silence
+	clientSamples map[string][]HistoryPoint
+}
+
+func NewAlertManager(config *Config, db Store, serverManager *ServerManager) (*AlertManager, error) {
+	a := &AlertManager{
+		db:            db,
+		serverManager: serverManager,
+		startTime:     time.Now().Unix(),
+		alerts:        make(map[string]*Alert),
+		silences:      make(map[string]*Silence),
+		clientSamples: make(map[string][]HistoryPoint),
+	}
+	rules, notifiers, err := LoadAlertRules(config.Alert.Rules)
+	if err != nil {
+		return nil, err
+	}
+	a.SetRules(rules, notifiers)
+	return a, nil
+}
+
+// path 为空时没有规则
+func LoadAlertRules(path string) ([]AlertRule, []Notifier, error) {
+	if path == "" {
+		return nil, nil, nil
+	}
+	c, err := LoadAlertConfig(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var notifiers []Notifier
+	for _, nc := range c.Notifiers {
+		n, err := NewNotifier(nc)
+		if err != nil {
+			return nil, nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	return c.Rules, notifiers, nil
+}
+
+// 替换规则和配置文件中的通知方式 已触发的告警保留
+func (a *AlertManager) SetRules(rules []AlertRule, notifiers []Notifier) {
+	a.lock.Lock()
+	a.rules = rules
+	a.notifiers = append(notifiers, a.extra...)
+	a.lock.Unlock()
+	glog.Infoln("AlertManager load rules", len(rules), "notifiers", len(notifiers))
+}
+
+func (a *AlertManager) AddNotifier(n Notifier) {
+	a.lock.Lock()
+	a.extra = append(a.extra, n)
+	a.notifiers = append(a.notifiers, n)
+	a.lock.Unlock()
+}
+
+func (a *AlertManager) Start(ctx context.Context) {
+	a.loop.Start(ctx, a.Run)
+}
+
+func (a *AlertManager) Stop(ctx context.Context) error {
+	return a.loop.Stop(ctx)
+}
+
+func (a *AlertManager) Run(ctx context.Context) {
+	for sleepContext(ctx, ALERT_EVAL_INTERVAL) {
+		a.evaluate(time.Now().Unix())
+	}
+}
+
+func (a *AlertManager) evaluate(now int64) {
+	var notify []Alert
+	a.lock.RLock()
+	rules := a.rules
+	a.lock.RUnlock()
+	for _, rule := range rules {
+		conds, err := a.evalRule(rule, now)
+		if err != nil {
+			glog.Warningln("AlertManager evalRule", rule.Name, err)
+			continue
+		}
+		notify = append(notify, a.update(rule, conds, now)...)
+	}
+	a.expire(now)
+
+	a.lock.RLock()
+	notifiers := a.notifiers
+	a.lock.RUnlock()
+	for _, alert := range notify {
+		glog.Infoln("Alert", alert.State, alert.Rule, alert.Key, alert.Message)
+		for _, n := range notifiers {
+			if err := n.Notify(alert); err != nil {
+				glog.Warningln("AlertManager notify", alert.Fingerprint, err)
+			}
+		}
+	}
+}
+
+func (a *AlertManager) ruleServers(rule AlertRule) []*SrsServer {
+	types := []string{STR_TYPE_EDGE_UP, STR_TYPE_EDGE_DOWN, STR_TYPE_ORIGIN}
+	if rule.ServerType != "" {
+		types = []string{rule.ServerType}
+	}
+	var servers []*SrsServer
+	for _, t := range types {
+		servers = append(servers, a.serverManager.getServerList(t)...)
+	}
+	return servers
+}
+
+// 返回当前满足条件的对象
+func (a *AlertManager) evalRule(rule AlertRule, now int64) (map[string]alertCondition, error) {
+	conds := make(map[string]alertCondition)
+	switch rule.Kind {
+	case ALERT_KIND_SERVER_METRIC:
+		for _, svr := range a.ruleServers(rule) {
+			summary := svr.GetSummary()
+			if summary.UpdateTime == 0 || svr.GetStatus() != SERVER_STATUS_ACTIVE {
+				continue
+			}
+			v := serverHistoryMetrics[rule.Metric](summary.Data.Sys)
+			if ok, _ := compare(v, rule.Op, rule.Threshold); ok {
+				conds[svr.Addr] = alertCondition{v, fmt.Sprintf("%v %v=%v %v %v",
+					svr.Addr, rule.Metric, v, rule.Op, rule.Threshold)}
+			}
+		}
+	case ALERT_KIND_SERVER_STALE:
+		for _, svr := range a.ruleServers(rule) {
+			if svr.GetStatus() == SERVER_STATUS_PENDING {
+				continue
+			}
+			last := svr.GetSummary().UpdateTime
+			if last == 0 {
+				last = a.startTime
+			}
+			if idle := now - last; float64(idle) > rule.Threshold {
+				conds[svr.Addr] = alertCondition{float64(idle),
+					fmt.Sprintf("%v not polled for %vs", svr.Addr, idle)}
+			}
+		}
+	case ALERT_KIND_STREAM_NO_RECV:
+		rooms, err := a.db.SelectRooms(context.Background(), map[string]interface{}{"status": ROOM_PUBLISH})
+		if err != nil {
+			return nil, err
+		}
+		recv := make(map[string]int)
+		for _, svr := range a.serverManager.getServerList(STR_TYPE_ORIGIN) {
+			for _, st := range svr.GetStreams().Streams {
+				recv[st.Name] += st.Kbps.Recv30s
+			}
+		}
+		for _, room := range rooms {
+			if recv[room.StreamName] == 0 {
+				conds[room.StreamName] = alertCondition{0,
+					fmt.Sprintf("room %v publishing but origin recv 0 kbps", room.StreamName)}
+			}
+		}
+	case ALERT_KIND_CLIENTS_DROP:
+		var total float64
+		for _, svr := range a.ruleServers(rule) {
+			for _, st := range svr.GetStreams().Streams {
+				total += float64(st.ClientNum)
+			}
+		}
+		a.lock.Lock()
+		samples := append(a.clientSamples[rule.Name], HistoryPoint{Time: now, Value: total})
+		for len(samples) > 0 && samples[0].Time < now-rule.Window {
+			samples = samples[1:]
+		}
+		a.clientSamples[rule.Name] = samples
+		a.lock.Unlock()
+
+		var peak float64
+		for _, p := range samples {
+			if p.Value > peak {
+				peak = p.Value
+			}
+		}
+		if peak > 0 {
+			if drop := (peak - total) / peak * 100; drop >= rule.Threshold {
+				conds[ALERT_CLUSTER_KEY] = alertCondition{drop,
+					fmt.Sprintf("clients dropped %.1f%% from %v to %v in %vs", drop, peak, total, rule.Window)}
+			}
+		}
+	}
+	return conds, nil
+}
+
+// 状态迁移 返回需要通知的告警
+func (a *AlertManager) update(rule AlertRule, conds map[string]alertCondition, now int64) []Alert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var notify []Alert
+	for key, cond := range conds {
+		fp := rule.Name + "|" + key
+		alert, ok := a.alerts[fp]
+		if !ok || alert.State == ALERT_STATE_RESOLVED {
+			alert = &Alert{
+				Fingerprint: fp,
+				Rule:        rule.Name,
+				Kind:        rule.Kind,
+				Severity:    rule.Severity,
+				Key:         key,
+				State:       ALERT_STATE_PENDING,
+				StartsAt:    now,
+			}
+			a.alerts[fp] = alert
+		}
+		alert.Value = cond.value
+		alert.Message = cond.message
+		alert.UpdateTime = now
+		alert.Silenced = a.isSilenced(alert, now)
+		if alert.State == ALERT_STATE_PENDING && now-alert.StartsAt >= rule.For {
+			alert.State = ALERT_STATE_FIRING
+			alert.FiredAt = now
+			if !alert.Silenced {
+				notify = append(notify, *alert)
+			}
+		}
+	}
+
+	for fp, alert := range a.alerts {
+		if alert.Rule != rule.Name || alert.State == ALERT_STATE_RESOLVED {
+			continue
+		}
+		if _, ok := conds[alert.Key]; ok {
+			continue
+		}
+		if alert.State == ALERT_STATE_PENDING {
+			delete(a.alerts, fp)
+			continue
+		}
+		alert.State = ALERT_STATE_RESOLVED
+		alert.ResolvedAt = now
+		alert.UpdateTime = now
+		alert.Silenced = a.isSilenced(alert, now)
+		if !alert.Silenced {
+			notify = append(notify, *alert)
+		}
+	}
+	return notify
+}
+
+func (a *AlertManager) isSilenced(alert *Alert, now int64) bool {
+	for _, s := range a.silences {
+		if s.Match(alert, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AlertManager) expire(now int64) {
+	a.lock.Lock()
+	for fp, alert := range a.alerts {
+		if alert.State == ALERT_STATE_RESOLVED && now-alert.ResolvedAt > ALERT_RESOLVED_RETENTION {
+			delete(a.alerts, fp)
+		}
+	}
+	for id, s := range a.silences {
+		if s.Until <= now {
+			delete(a.silences, id)
+		}
+	}
+	a.lock.Unlock()
+}
+
+func (a *AlertManager) List(state string) []Alert {
+	a.lock.RLock()
+	result := make([]Alert, 0, len(a.alerts))
+	for _, alert := range a.alerts {
+		if state == "" || alert.State == state {
+			result = append(result, *alert)
+		}
+	}
+	a.lock.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].StartsAt > result[j].StartsAt })
+	return result
+}
+
+func (a *AlertManager) AddSilence(s Silence) (*Silence, error) {
+	now := time.Now().Unix()
+	if s.Rule == "" || s.Until <= now {
+		return nil, fmt.Errorf("invalid silence rule:%v until:%v", s.Rule, s.Until)
+	}
+	s.ID = utils.GenerateUuid()
+	s.CreateTime = now
+	a.lock.Lock()
+	a.silences[s.ID] = &s
+	for _, alert := range a.alerts {
+		if s.Match(alert, now) {
+			alert.Silenced = true
+		}
+	}
+	a.lock.Unlock()
+	return &s, nil
+}
+
+func (a *AlertManager) RemoveSilence(id string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.silences[id]; !ok {
+		return false
+	}
+	delete(a.silences, id)
+	return true
+}
+
+func (a *AlertManager) ListSilences() []Silence {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	result := make([]Silence, 0, len(a.silences))
+	for _, s := range a.silences {
+		result = append(result, *s)
+	}
+	return result
+}
+
+// /alerts?state=firing                GET
+// /alerts/silences                    GET | POST
+// /alerts/silences/{id}               DELETE
+func (a *AlertManager) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	args := GetUrlParams(r.URL.Path, URL_PATH_ALERTS)
+	var result interface{}
+	var err error
+	switch {
+	case args[0] == "" && r.Method == HTTP_GET:
+		result = a.List(r.URL.Query().Get("state"))
+	case args[0] == URL_SUB_PATH_SILENCES && len(args) == 1 && r.Method == HTTP_GET:
+		result = a.ListSilences()
+	case args[0] == URL_SUB_PATH_SILENCES && len(args) == 1 && r.Method == HTTP_POST:
+		var req Silence
+		if err = utils.ReadAndUnmarshalObject(r.Body, &req); err == nil {
+			result, err = a.AddSilence(req)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			glog.Warningln("AddSilence", err)
+			return
+		}
+	case args[0] == URL_SUB_PATH_SILENCES && len(args) == 2 && r.Method == HTTP_DELETE:
+		if !a.RemoveSilence(args[1]) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = utils.WriteObjectResponse(w, result); err != nil {
+		glog.Warningln("AlertManager writeRespons err", err)
+	}
+}
@@ -0,0 +1,98 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	NOTIFIER_TYPE_WEBHOOK = "webhook"
+	NOTIFIER_TYPE_FILE    = "file"
+
+	WEBHOOK_TIMEOUT = 5 * time.Second
+)
+
+// 告警在 firing 和 resolved 时各通知一次
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+type NotifierConfig struct {
+	Type string `json:"type"` // webhook | file
+	Url  string `json:"url"`
+	Path string `json:"path"`
+}
+
+func NewNotifier(c NotifierConfig) (Notifier, error) {
+	switch c.Type {
+	case NOTIFIER_TYPE_WEBHOOK:
+		if c.Url == "" {
+			return nil, fmt.Errorf("webhook notifier without url")
+		}
+		return NewWebhookNotifier(c.Url), nil
+	case NOTIFIER_TYPE_FILE:
+		if c.Path == "" {
+			return nil, fmt.Errorf("file notifier without path")
+		}
+		return &FileNotifier{path: c.Path}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %v", c.Type)
+	}
+}
+
+// 以json POST到指定的url
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: &http.Client{Timeout: WEBHOOK_TIMEOUT}}
+}
+
+func (n *WebhookNotifier) Notify(alert Alert) error {
+	return n.Send(alert)
+}
+
+func (n *WebhookNotifier) Send(obj interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	rsp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook %v err:%v", n.url, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %v status:%v", n.url, rsp.StatusCode)
+	}
+	return nil
+}
+
+// 每条告警一行json 追加到文件
+type FileNotifier struct {
+	path string
+	lock sync.Mutex
+}
+
+func (n *FileNotifier) Notify(alert Alert) error {
+	line, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,40 @@
+package manager
+
+import "testing"
+
+func TestAlertStateTransitions(t *testing.T) {
+	a := &AlertManager{alerts: make(map[string]*Alert), silences: make(map[string]*Silence)}
+	rule := AlertRule{Name: "load", Kind: ALERT_KIND_SERVER_METRIC, For: 120}
+	conds := map[string]alertCondition{"1.1.1.1:1985": {value: 70}}
+
+	if n := a.update(rule, conds, 1000); len(n) != 0 {
+		t.Fatalf("pending alert notified %v", n)
+	}
+	if n := a.update(rule, conds, 1060); len(n) != 0 {
+		t.Fatalf("alert fired before for duration %v", n)
+	}
+	n := a.update(rule, conds, 1120)
+	if len(n) != 1 || n[0].State != ALERT_STATE_FIRING {
+		t.Fatalf("alert not fired %v", n)
+	}
+	if n = a.update(rule, conds, 1130); len(n) != 0 {
+		t.Fatalf("firing alert notified twice %v", n)
+	}
+	n = a.update(rule, map[string]alertCondition{}, 1140)
+	if len(n) != 1 || n[0].State != ALERT_STATE_RESOLVED {
+		t.Fatalf("alert not resolved %v", n)
+	}
+}
+
+func TestAlertSilence(t *testing.T) {
+	a := &AlertManager{alerts: make(map[string]*Alert), silences: make(map[string]*Silence)}
+	a.silences["s"] = &Silence{ID: "s", Rule: "stale", Until: 2000}
+	rule := AlertRule{Name: "stale", Kind: ALERT_KIND_SERVER_STALE}
+	n := a.update(rule, map[string]alertCondition{"1.1.1.1:1985": {value: 90}}, 1000)
+	if len(n) != 0 {
+		t.Fatalf("silenced alert notified %v", n)
+	}
+	if alerts := a.List(ALERT_STATE_FIRING); len(alerts) != 1 || !alerts[0].Silenced {
+		t.Fatalf("silenced alert not listed %v", alerts)
+	}
+}
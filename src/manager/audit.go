@@ -0,0 +1,285 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	AUDIT_ROOM_CREATE    = "room.create"
+	AUDIT_ROOM_KICK      = "room.kick"
+	AUDIT_ROOM_RENEW     = "room.renew"
+	AUDIT_VIEWER_KICK    = "viewer.kick"
+	AUDIT_BAN_ADD        = "ban.add"
+	AUDIT_BAN_REMOVE     = "ban.remove"
+	AUDIT_GEO_ADD        = "geo.add"
+	AUDIT_GEO_REMOVE     = "geo.remove"
+	AUDIT_REFERER_ADD    = "referer.add"
+	AUDIT_REFERER_REMOVE = "referer.remove"
+	AUDIT_CONFIG_RELOAD  = "config.reload"
+	AUDIT_SERVER_ADD     = "server.add"
+	AUDIT_SERVER_REMOVE  = "server.remove"
+	AUDIT_SERVER_APPROVE = "server.approve"
+	AUDIT_CALLBACK       = "callback." // 后面接 srs 回调的 action
+
+	AUDIT_OUTCOME_OK    = "ok"
+	AUDIT_OUTCOME_ERROR = "error"
+
+	AUDIT_ACTOR_ANONYMOUS = "anonymous"
+	AUDIT_ACTOR_SRS       = "srs"
+
+	DefaultAuditRetentionDays = 30
+	AUDIT_BUFFER_SIZE         = 4096
+	AUDIT_FLUSH_INTERVAL      = 2 * time.Second
+	AUDIT_EXPIRE_INTERVAL     = time.Hour
+	AUDIT_STOP_RETRIES        = 3 // 停止时写库失败的重试次数 之后丢弃
+	AUDIT_PAYLOAD_MAX         = 1024
+	AUDIT_QUERY_LIMIT         = 100
+	AUDIT_QUERY_LIMIT_MAX     = 1000
+)
+
+type AuditEntry struct {
+	Id      int64
+	Time    int64
+	Actor   string // 操作人 srs 回调为 srs
+	Ip      string // 请求来源
+	Action  string
+	Target  string // 房间名或者节点地址
+	Payload string // 请求内容摘要
+	Outcome string // ok | error | allow | deny
+	Reason  string // 失败或者拒绝的原因
+}
+
+// 条件为空时不过滤 时间为 [From, To)
+type AuditFilter struct {
+	From    int64
+	To      int64
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	Limit   int
+}
+
+func (f AuditFilter) Match(e *AuditEntry) bool {
+	return e.Time >= f.From && e.Time < f.To &&
+		(f.Actor == "" || f.Actor == e.Actor) &&
+		(f.Action == "" || f.Action == e.Action) &&
+		(f.Target == "" || f.Target == e.Target) &&
+		(f.Outcome == "" || f.Outcome == e.Outcome)
+}
+
+// 审计日志先写入缓冲 由 Run 批量写库
+// 缓冲满时丢弃 不能阻塞回调 写库失败的批次下次重试
+type AuditLog struct {
+	db        Store
+	entries   chan *AuditEntry
+	flushLock sync.Mutex
+	failed    []*AuditEntry // 写库失败 等待重试
+	retention int64
+	loop      Loop
+}
+
+func NewAuditLog(config *Config, db Store) *AuditLog {
+	a := &AuditLog{
+		db:      db,
+		entries: make(chan *AuditEntry, AUDIT_BUFFER_SIZE),
+	}
+	a.ApplyConfig(config)
+	return a
+}
+
+func (a *AuditLog) ApplyConfig(config *Config) {
+	atomic.StoreInt64(&a.retention, int64(config.Audit.RetentionDays)*24*3600)
+}
+
+// 从请求中取出操作人和来源地址
+// 开启认证时操作人为 api key 的名称 否则为 anonymous 请求头可以伪造 不采用
+func NewAuditEntry(req *http.Request, action, target string) *AuditEntry {
+	actor := AUDIT_ACTOR_ANONYMOUS
+	if key := ApiKeyFromContext(req.Context()); key != nil {
+		actor = key.Name
+	}
+	return &AuditEntry{Actor: actor, Ip: GetRemoteIp(req), Action: action, Target: target}
+}
+
+type clientIpContextKey struct{}
+
+func WithClientIp(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIpContextKey{}, ip)
+}
+
+// 取 HttpHandler 按可信代理解析的地址 没有时取连接地址 不直接采用 X-REAL-IP
+func GetRemoteIp(req *http.Request) string {
+	if ip, _ := req.Context().Value(clientIpContextKey{}).(string); ip != "" {
+		return ip
+	}
+	return clientIp(req, nil)
+}
+
+// err 为空时记为 ok
+func (a *AuditLog) Record(e *AuditEntry, err error) {
+	if e.Outcome == "" {
+		e.Outcome = AUDIT_OUTCOME_OK
+		if err != nil {
+			e.Outcome = AUDIT_OUTCOME_ERROR
+		}
+	}
+	if err != nil && e.Reason == "" {
+		e.Reason = err.Error()
+	}
+	e.Time = time.Now().Unix()
+	e.Payload = truncate(e.Payload, AUDIT_PAYLOAD_MAX)
+	e.Reason = truncate(e.Reason, AUDIT_PAYLOAD_MAX)
+	select {
+	case a.entries <- e:
+	default:
+		metrics.Inc(METRIC_AUDIT_DROPPED_TOTAL)
+		glog.Warningln("AuditLog buffer full, drop", e.Action, e.Target, e.Outcome)
+	}
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
+
+func (a *AuditLog) Start(ctx context.Context) {
+	a.loop.Start(ctx, a.Run)
+}
+
+func (a *AuditLog) Stop(ctx context.Context) error {
+	return a.loop.Stop(ctx)
+}
+
+// ctx 取消时把缓冲中的记录写完再返回
+func (a *AuditLog) Run(ctx context.Context) {
+	flush := time.NewTicker(AUDIT_FLUSH_INTERVAL)
+	defer flush.Stop()
+	expire := time.NewTicker(AUDIT_EXPIRE_INTERVAL)
+	defer expire.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			a.drain()
+			return
+		case <-flush.C:
+			a.Flush(context.Background())
+		case now := <-expire.C:
+			a.expire(now.Unix())
+		}
+	}
+}
+
+// 把上次失败的和缓冲中的记录写库 失败时留到下次
+// 重试的记录最多 AUDIT_BUFFER_SIZE 条 之后的记录留在缓冲中 缓冲满时由 Record 丢弃
+func (a *AuditLog) Flush(ctx context.Context) error {
+	a.flushLock.Lock()
+	defer a.flushLock.Unlock()
+	batch := a.failed
+	a.failed = nil
+loop:
+	for len(batch) < AUDIT_BUFFER_SIZE {
+		select {
+		case e := <-a.entries:
+			batch = append(batch, e)
+		default:
+			break loop
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := a.db.InsertAudits(ctx, batch); err != nil {
+		glog.Warningln("AuditLog InsertAudits", len(batch), err)
+		a.failed = batch
+		return err
+	}
+	return nil
+}
+
+func (a *AuditLog) pending() int {
+	a.flushLock.Lock()
+	defer a.flushLock.Unlock()
+	return len(a.failed) + len(a.entries)
+}
+
+// 停止时写完所有记录 连续失败 AUDIT_STOP_RETRIES 次后丢弃剩下的
+func (a *AuditLog) drain() {
+	for retries := 0; a.pending() > 0; {
+		if err := a.Flush(context.Background()); err == nil {
+			retries = 0
+			continue
+		}
+		if retries++; retries >= AUDIT_STOP_RETRIES {
+			break
+		}
+		time.Sleep(AUDIT_FLUSH_INTERVAL)
+	}
+	a.flushLock.Lock()
+	dropped := len(a.failed) + len(a.entries)
+	a.failed = nil
+	a.flushLock.Unlock()
+	if dropped > 0 {
+		metrics.Add(METRIC_AUDIT_DROPPED_TOTAL, float64(dropped))
+		glog.Warningln("AuditLog stop, drop", dropped)
+	}
+}
+
+func (a *AuditLog) expire(now int64) {
+	if err := a.db.DeleteAudits(context.Background(), now-atomic.LoadInt64(&a.retention)); err != nil {
+		glog.Warningln("AuditLog DeleteAudits", err)
+	}
+}
+
+// GET /audit?from=&to=&actor=&action=&target=&outcome=&limit=
+// 按时间倒序
+func (a *AuditLog) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != HTTP_GET {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	now := time.Now().Unix()
+	filter := AuditFilter{
+		From:    parseInt64(query.Get("from"), now-24*3600),
+		To:      parseInt64(query.Get("to"), now+1),
+		Actor:   query.Get("actor"),
+		Action:  query.Get("action"),
+		Target:  query.Get("target"),
+		Outcome: query.Get("outcome"),
+		Limit:   AUDIT_QUERY_LIMIT,
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+		filter.Limit = limit
+	}
+	if filter.Limit > AUDIT_QUERY_LIMIT_MAX {
+		filter.Limit = AUDIT_QUERY_LIMIT_MAX
+	}
+
+	entries, err := a.db.SelectAudits(r.Context(), filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		glog.Warningln("AuditLog SelectAudits", err)
+		return
+	}
+	if err = utils.WriteObjectResponse(w, entries); err != nil {
+		glog.Warningln("AuditLog writeRespons err", err)
+	}
+}
+
+// 回调的摘要 只记录判断用到的字段
+func (info *ConnectInfo) AuditPayload() string {
+	return fmt.Sprintf("client=%v ip=%v vhost=%v app=%v stream=%v user=%v tcUrl=%v pageUrl=%v",
+		info.ClientID, info.Ip, info.VHost, info.AppName, info.StreamName, info.GetUser(), info.TcUrl, info.PageUrl)
+}
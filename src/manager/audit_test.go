@@ -0,0 +1,98 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	audit := NewAuditLog(DefaultConfig(), db)
+	servers := newServerManager(db, audit)
+	event := &EventManager{db: db, servers: servers, guard: &EventGuard{servers: servers},
+		bans: NewBanList(db), referers: NewRefererRules(DefaultConfig(), db, audit), live: NewLiveHub(nil), audit: audit}
+
+	body := `{"action":"on_publish","client_id":10,"ip":"1.1.1.1","stream":"s1"}`
+	req := httptest.NewRequest(HTTP_POST, URL_PATH_EVENT+"/1.2.3.4/1935", strings.NewReader(body))
+	event.HttpHandler(httptest.NewRecorder(), req)
+
+	// 没有 api key 时不采用请求头里的操作人和来源地址
+	req = httptest.NewRequest(HTTP_DELETE, URL_PATH_SERVER+"/1.2.3.4:1985", nil)
+	req.Header.Set("X-ACTOR", "alice")
+	req.Header.Set(HTTP_HEADER_CDN_IP, "8.8.8.8")
+	audit.Record(NewAuditEntry(req, AUDIT_SERVER_REMOVE, "1.2.3.4:1985"), nil)
+	audit.Flush(ctx)
+
+	now := time.Now().Unix()
+	all := AuditFilter{From: now - 60, To: now + 60, Limit: 10}
+	entries, _ := db.SelectAudits(ctx, all)
+	if len(entries) != 2 {
+		t.Fatalf("audit entries got %v", len(entries))
+	}
+	if e := entries[0]; e.Actor != AUDIT_ACTOR_ANONYMOUS || e.Ip != "192.0.2.1" || e.Outcome != AUDIT_OUTCOME_OK {
+		t.Errorf("server remove entry %+v", e)
+	}
+	if e := entries[1]; e.Action != AUDIT_CALLBACK+SRS_CB_ACTION_ON_PUBLISH || e.Target != "s1" ||
+		e.Outcome != CALLBACK_RESULT_DENY || e.Reason == "" || e.Actor != AUDIT_ACTOR_SRS {
+		t.Errorf("callback entry %+v", e)
+	}
+
+	// 连接来自可信代理时取转发的地址
+	config := DefaultConfig()
+	config.RateLimit.TrustedProxies = "192.0.2.0/24"
+	limiter, _ := NewRateLimiter(config)
+	req = req.WithContext(WithClientIp(req.Context(), limiter.ClientIp(req)))
+	if e := NewAuditEntry(req, AUDIT_SERVER_REMOVE, ""); e.Ip != "8.8.8.8" {
+		t.Errorf("ip from trusted proxy got %v", e.Ip)
+	}
+
+	filter := all
+	filter.Outcome = CALLBACK_RESULT_DENY
+	if entries, _ = db.SelectAudits(ctx, filter); len(entries) != 1 {
+		t.Errorf("filter by outcome got %v", len(entries))
+	}
+
+	audit.expire(now + audit.retention + 1)
+	if entries, _ = db.SelectAudits(ctx, all); len(entries) != 0 {
+		t.Errorf("audit entries after expire got %v", len(entries))
+	}
+}
+
+type failAuditStore struct {
+	*MemStore
+	fail bool
+}
+
+func (s *failAuditStore) InsertAudits(ctx context.Context, entries []*AuditEntry) error {
+	if s.fail {
+		return fmt.Errorf("db down")
+	}
+	return s.MemStore.InsertAudits(ctx, entries)
+}
+
+// 写库失败的记录保留到下次 不丢弃
+func TestAuditFlushRetry(t *testing.T) {
+	ctx := context.Background()
+	db := &failAuditStore{MemStore: NewMemStore(), fail: true}
+	audit := NewAuditLog(DefaultConfig(), db)
+	req := httptest.NewRequest(HTTP_DELETE, URL_PATH_SERVER+"/1.2.3.4:1985", nil)
+	audit.Record(NewAuditEntry(req, AUDIT_SERVER_REMOVE, "1.2.3.4:1985"), nil)
+	if err := audit.Flush(ctx); err == nil || audit.pending() != 1 {
+		t.Fatalf("failed flush err:%v pending:%v", err, audit.pending())
+	}
+
+	audit.Record(NewAuditEntry(req, AUDIT_SERVER_ADD, "1.2.3.4:1985"), nil)
+	db.fail = false
+	if err := audit.Flush(ctx); err != nil || audit.pending() != 0 {
+		t.Fatalf("retry flush err:%v pending:%v", err, audit.pending())
+	}
+	now := time.Now().Unix()
+	if entries, _ := db.SelectAudits(ctx, AuditFilter{From: now - 60, To: now + 60, Limit: 10}); len(entries) != 2 {
+		t.Errorf("audit entries got %v", len(entries))
+	}
+}
@@ -0,0 +1,397 @@
+package manager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	ROLE_VIEWER   = "viewer"   // 只读
+	ROLE_OPERATOR = "operator" // 管理直播间 踢人 黑名单
+	ROLE_ADMIN    = "admin"    // 管理节点和 api key
+
+	HTTP_HEADER_API_KEY       = "X-API-KEY"
+	HTTP_HEADER_AUTHORIZATION = "Authorization"
+	AUTH_BEARER_PREFIX        = "Bearer "
+	URL_PARAM_ACCESS_TOKEN    = "access_token" // EventSource 不能设置请求头
+
+	AUTH_BOOTSTRAP_NAME = "bootstrap"
+	API_KEY_BYTES       = 24
+	KEY_RELOAD_INTERVAL = time.Minute
+
+	AUDIT_KEY_CREATE = "key.create"
+	AUDIT_KEY_DELETE = "key.delete"
+)
+
+var (
+	ErrNoApiKey      = errors.New("api key required")
+	ErrInvalidApiKey = errors.New("invalid api key")
+	ErrApiKeyExpired = errors.New("api key expired")
+	ErrForbidden     = errors.New("permission denied")
+)
+
+var authFailureReasons = map[error]string{
+	ErrNoApiKey:      "missing",
+	ErrInvalidApiKey: "invalid",
+	ErrApiKeyExpired: "expired",
+	ErrForbidden:     "forbidden",
+}
+
+var roleLevels = map[string]int{
+	ROLE_VIEWER:   1,
+	ROLE_OPERATOR: 2,
+	ROLE_ADMIN:    3,
+}
+
+type ApiKey struct {
+	Id         int64
+	Name       string
+	KeyHash    string `json:"-"`
+	Role       string
+	Scopes     []string // 允许访问的路径前缀 为空时不限制
+	Expiration int64    // 0 表示不过期
+	CreateTime int64
+	Key        string `json:",omitempty"` // 明文只在创建时返回一次
+}
+
+func (k *ApiKey) Expired(now int64) bool {
+	return k.Expiration > 0 && k.Expiration < now
+}
+
+// 角色足够 并且路径在 scopes 内
+func (k *ApiKey) Allow(method, path string) bool {
+	if roleLevels[k.Role] < roleLevels[RequiredRole(method, path)] {
+		return false
+	}
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range k.Scopes {
+		if strings.HasPrefix(path, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type routeRule struct {
+	prefix  string
+	methods []string // 为空时匹配所有方法
+	role    string
+}
+
+// 按顺序匹配 第一条命中的规则生效
+var routeRules = []routeRule{
+	{URL_PATH_ADMIN, nil, ROLE_ADMIN},
+	{URL_PATH_AUDIT, nil, ROLE_OPERATOR},
+	{URL_PATH_SERVER, []string{HTTP_POST, HTTP_PUT, HTTP_DELETE}, ROLE_ADMIN},
+	{URL_PATH_ROOM, []string{HTTP_POST, HTTP_PUT, HTTP_DELETE}, ROLE_OPERATOR},
+	{URL_PATH_REFERER, []string{HTTP_POST, HTTP_DELETE}, ROLE_OPERATOR},
+	{"", []string{HTTP_GET}, ROLE_VIEWER},
+	{"", nil, ROLE_ADMIN},
+}
+
+func RequiredRole(method, path string) string {
+	for _, rule := range routeRules {
+		if !strings.HasPrefix(path, rule.prefix) {
+			continue
+		}
+		if len(rule.methods) == 0 {
+			return rule.role
+		}
+		for _, m := range rule.methods {
+			if m == method {
+				return rule.role
+			}
+		}
+	}
+	return ROLE_ADMIN
+}
+
+// srs 回调和节点心跳由 srs 调用 不走 api key 由 EventGuard 校验
+// 控制台的静态文件不需要认证 接口数据需要
+func IsAuthExempt(path string) bool {
+	return strings.HasPrefix(path, URL_PATH_EVENT) ||
+		strings.HasPrefix(path, URL_PATH_SERVER_HEARTBEAT) ||
+		path == "/" || strings.HasPrefix(path, URL_PATH_UI)
+}
+
+type apiKeyContextKey struct{}
+
+func WithApiKey(ctx context.Context, key *ApiKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// 没有认证时返回 nil
+func ApiKeyFromContext(ctx context.Context) *ApiKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*ApiKey)
+	return key
+}
+
+// X-API-KEY | Authorization: Bearer xxx | ?access_token=xxx
+func GetRequestKey(r *http.Request) string {
+	if key := r.Header.Get(HTTP_HEADER_API_KEY); key != "" {
+		return key
+	}
+	if auth := r.Header.Get(HTTP_HEADER_AUTHORIZATION); strings.HasPrefix(auth, AUTH_BEARER_PREFIX) {
+		return strings.TrimSpace(auth[len(AUTH_BEARER_PREFIX):])
+	}
+	return r.URL.Query().Get(URL_PARAM_ACCESS_TOKEN)
+}
+
+// api key 缓存在内存中 由 Run 定时从库中刷新
+type Authenticator struct {
+	db      Store
+	audit   *AuditLog
+	enabled bool
+	loop    Loop
+
+	lock      sync.RWMutex
+	keys      map[string]*ApiKey // keyhash -> key
+	bootstrap *ApiKey            // 配置文件中的管理员 key 用来创建第一批 key
+}
+
+func NewAuthenticator(config *Config, db Store, audit *AuditLog) *Authenticator {
+	a := &Authenticator{
+		db:    db,
+		audit: audit,
+		keys:  make(map[string]*ApiKey),
+	}
+	a.ApplyConfig(config)
+	return a
+}
+
+// 开关和管理员 key 可以热加载 库中的 key 由 Load 刷新
+func (a *Authenticator) ApplyConfig(config *Config) {
+	var bootstrap *ApiKey
+	if key := config.Auth.AdminKey; key != "" {
+		bootstrap = &ApiKey{Name: AUTH_BOOTSTRAP_NAME, KeyHash: HashApiKey(key), Role: ROLE_ADMIN}
+	}
+	if config.Auth.Enabled && bootstrap == nil {
+		glog.Warningln("auth enabled without auth.adminKey, only keys in store can be used")
+	}
+	a.lock.Lock()
+	a.enabled = config.Auth.Enabled
+	a.bootstrap = bootstrap
+	a.lock.Unlock()
+}
+
+func (a *Authenticator) Load(ctx context.Context) error {
+	keys, err := a.db.LoadApiKeys(ctx)
+	if err != nil {
+		return err
+	}
+	byHash := make(map[string]*ApiKey, len(keys))
+	for _, key := range keys {
+		byHash[key.KeyHash] = key
+	}
+	a.lock.Lock()
+	a.keys = byHash
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *Authenticator) Start(ctx context.Context) {
+	a.loop.Start(ctx, a.Run)
+}
+
+func (a *Authenticator) Stop(ctx context.Context) error {
+	return a.loop.Stop(ctx)
+}
+
+func (a *Authenticator) Run(ctx context.Context) {
+	for sleepContext(ctx, KEY_RELOAD_INTERVAL) {
+		if err := a.Load(context.Background()); err != nil {
+			glog.Warningln("Authenticator Load", err)
+		}
+	}
+}
+
+func (a *Authenticator) Authenticate(r *http.Request) (*ApiKey, error) {
+	raw := GetRequestKey(r)
+	if raw == "" {
+		return nil, ErrNoApiKey
+	}
+	hash := HashApiKey(raw)
+	a.lock.RLock()
+	key, ok := a.keys[hash]
+	bootstrap := a.bootstrap
+	a.lock.RUnlock()
+	if !ok {
+		if bootstrap == nil || bootstrap.KeyHash != hash {
+			return nil, ErrInvalidApiKey
+		}
+		key = bootstrap
+	}
+	if key.Expired(time.Now().Unix()) {
+		return nil, ErrApiKeyExpired
+	}
+	return key, nil
+}
+
+// 认证失败时写入 401 或 403 并返回 false
+// 通过时返回带有 api key 的请求
+func (a *Authenticator) Check(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	a.lock.RLock()
+	enabled := a.enabled
+	a.lock.RUnlock()
+	if !enabled || IsAuthExempt(r.URL.Path) {
+		return r, true
+	}
+	key, err := a.Authenticate(r)
+	if err == nil && !key.Allow(r.Method, r.URL.Path) {
+		err = ErrForbidden
+	}
+	if err != nil {
+		name := ""
+		if key != nil {
+			name = key.Name
+		}
+		metrics.Inc(METRIC_AUTH_FAILURES_TOTAL, "reason", authFailureReasons[err])
+		glog.Warningln("auth failed", r.Method, r.URL.Path, GetRemoteIp(r), name, err)
+		if err == ErrForbidden {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="srs_manager"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		return r, false
+	}
+	return r.WithContext(WithApiKey(r.Context(), key)), true
+}
+
+type ReqCreateApiKey struct {
+	Name   string   `json:"name"`
+	Role   string   `json:"role"`
+	Scopes []string `json:"scopes"`
+	TTL    int64    `json:"ttl"` // 有效期 秒 0 表示不过期
+}
+
+func (a *Authenticator) CreateKey(ctx context.Context, req ReqCreateApiKey) (*ApiKey, error) {
+	if req.Name == "" {
+		return nil, errors.New("api key name required")
+	}
+	if _, ok := roleLevels[req.Role]; !ok {
+		return nil, fmt.Errorf("invalid role %v", req.Role)
+	}
+	buf := make([]byte, API_KEY_BYTES)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	key := &ApiKey{
+		Name:       req.Name,
+		Role:       req.Role,
+		Scopes:     req.Scopes,
+		CreateTime: now,
+		Key:        hex.EncodeToString(buf),
+	}
+	if req.TTL > 0 {
+		key.Expiration = now + req.TTL
+	}
+	key.KeyHash = HashApiKey(key.Key)
+	if err := a.db.InsertApiKey(ctx, key); err != nil {
+		return nil, err
+	}
+	if err := a.Load(ctx); err != nil {
+		glog.Warningln("Authenticator Load", err)
+	}
+	return key, nil
+}
+
+func (a *Authenticator) DeleteKey(ctx context.Context, id int64) error {
+	if err := a.db.DeleteApiKey(ctx, id); err != nil {
+		return err
+	}
+	return a.Load(ctx)
+}
+
+// 不返回 key 明文
+func (a *Authenticator) ListKeys() []*ApiKey {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	keys := make([]*ApiKey, 0, len(a.keys))
+	for _, key := range a.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Id < keys[j].Id })
+	return keys
+}
+
+// /admin/keys       GET | POST
+// /admin/keys/{id}  DELETE
+func (a *Authenticator) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	args := GetUrlParams(r.URL.Path, URL_PATH_ADMIN_KEYS)
+	var err error
+	switch r.Method {
+	case HTTP_GET:
+		err = utils.WriteObjectResponse(w, a.ListKeys())
+	case HTTP_POST:
+		var (
+			req ReqCreateApiKey
+			key *ApiKey
+		)
+		if err = utils.ReadAndUnmarshalObject(r.Body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		key, err = a.CreateKey(r.Context(), req)
+		entry := NewAuditEntry(r, AUDIT_KEY_CREATE, req.Name)
+		entry.Payload = fmt.Sprintf("role=%v scopes=%v ttl=%v", req.Role, req.Scopes, req.TTL)
+		a.audit.Record(entry, err)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		err = utils.WriteObjectResponse(w, key)
+	case HTTP_DELETE:
+		var id int64
+		if len(args) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			err = fmt.Errorf("invalid args %v", args)
+			break
+		}
+		if id, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		err = a.DeleteKey(r.Context(), id)
+		a.audit.Record(NewAuditEntry(r, AUDIT_KEY_DELETE, args[0]), err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	if err != nil {
+		glog.Warningln("Authenticator HttpHandler", r.Method, args, err)
+	}
+}
@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequiredRole(t *testing.T) {
+	cases := []struct {
+		method, path, role string
+	}{
+		{HTTP_GET, "/room/s1", ROLE_VIEWER},
+		{HTTP_DELETE, "/room/s1", ROLE_OPERATOR},
+		{HTTP_POST, "/room/s1/bans", ROLE_OPERATOR},
+		{HTTP_PUT, "/server", ROLE_ADMIN},
+		{HTTP_POST, "/server/approve", ROLE_ADMIN},
+		{HTTP_GET, "/audit", ROLE_OPERATOR},
+		{HTTP_GET, "/admin/keys", ROLE_ADMIN},
+		{HTTP_GET, "/metrics", ROLE_VIEWER},
+		{HTTP_POST, "/unknown", ROLE_ADMIN},
+	}
+	for _, c := range cases {
+		if role := RequiredRole(c.method, c.path); role != c.role {
+			t.Errorf("%v %v got %v want %v", c.method, c.path, role, c.role)
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	auth := NewAuthenticator(DefaultConfig(), db, NewAuditLog(DefaultConfig(), db))
+	auth.enabled = true
+	auth.bootstrap = &ApiKey{Name: AUTH_BOOTSTRAP_NAME, KeyHash: HashApiKey("boot"), Role: ROLE_ADMIN}
+
+	viewer, err := auth.CreateKey(ctx, ReqCreateApiKey{Name: "v", Role: ROLE_VIEWER})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator, _ := auth.CreateKey(ctx, ReqCreateApiKey{Name: "o", Role: ROLE_OPERATOR, Scopes: []string{URL_PATH_ROOM}})
+	expired, _ := auth.CreateKey(ctx, ReqCreateApiKey{Name: "e", Role: ROLE_ADMIN, TTL: 1})
+	db.keys[expired.Id].Expiration = time.Now().Unix() - 1
+	auth.Load(ctx)
+	if _, err = auth.CreateKey(ctx, ReqCreateApiKey{Name: "x", Role: "root"}); err == nil {
+		t.Errorf("invalid role should fail")
+	}
+
+	check := func(method, path, key string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if key != "" {
+			req.Header.Set(HTTP_HEADER_AUTHORIZATION, AUTH_BEARER_PREFIX+key)
+		}
+		w := httptest.NewRecorder()
+		if r, ok := auth.Check(w, req); !ok {
+			return w.Code
+		} else if k := ApiKeyFromContext(r.Context()); key != "" && k == nil {
+			t.Errorf("%v %v no api key in context", method, path)
+		}
+		return http.StatusOK
+	}
+	cases := []struct {
+		method, path, key string
+		code              int
+	}{
+		{HTTP_GET, "/room/s1", "", http.StatusUnauthorized},
+		{HTTP_GET, "/room/s1", "bad", http.StatusUnauthorized},
+		{HTTP_GET, "/room/s1", viewer.Key, http.StatusOK},
+		{HTTP_DELETE, "/room/s1", viewer.Key, http.StatusForbidden},
+		{HTTP_DELETE, "/room/s1", operator.Key, http.StatusOK},
+		{HTTP_GET, "/clients", operator.Key, http.StatusForbidden}, // 不在 scopes 内
+		{HTTP_GET, "/room/s1", expired.Key, http.StatusUnauthorized},
+		{HTTP_PUT, "/server", "boot", http.StatusOK},
+		{HTTP_POST, "/event", "", http.StatusOK},
+		{HTTP_GET, "/ui/app.js", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		if code := check(c.method, c.path, c.key); code != c.code {
+			t.Errorf("%v %v key %q got %v want %v", c.method, c.path, c.key, code, c.code)
+		}
+	}
+
+	if err = auth.DeleteKey(ctx, viewer.Id); err != nil {
+		t.Fatal(err)
+	}
+	if code := check(HTTP_GET, "/room/s1", viewer.Key); code != http.StatusUnauthorized {
+		t.Errorf("deleted key got %v", code)
+	}
+}
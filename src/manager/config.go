@@ -0,0 +1,424 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	CONFIG_ENV_PREFIX = "SRS_MANAGER"
+
+	DefaultPort             = 8085
+	DefaultRoomSalt         = "JD_STD_2016"
+	DefaultRoomTTL          = 24 * time.Hour
+	DefaultIpDatabase       = "src/utils/isp.txt"
+	DefaultInsideAddrPrefix = "172."
+	DefaultMaxLoad          = 64
+	DefaultMaxNetSendBytes  = 100 * 1024 * 1024
+	DefaultPollInterval     = 10 * time.Second
+
+	DefaultHTTPReadTimeout     = 10 * time.Second
+	DefaultHTTPIdleTimeout     = 60 * time.Second
+	DefaultHTTPShutdownTimeout = 15 * time.Second
+	DefaultHTTPStopTimeout     = 15 * time.Second
+)
+
+// 配置文件中的时长 例如 "10s" "5m" "24h"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %s", b)
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+type DBConfig struct {
+	Driver       string   `json:"driver"` // mysql | sqlite3 | memory
+	Source       string   `json:"source"`
+	MaxOpen      int      `json:"maxOpen"`
+	MaxIdle      int      `json:"maxIdle"`
+	ConnLifetime Duration `json:"connLifetime"`
+	QueryTimeout Duration `json:"queryTimeout"`
+}
+
+// 没有写超时 /live/events 是长连接
+type HTTPConfig struct {
+	ReadTimeout     Duration `json:"readTimeout"`
+	IdleTimeout     Duration `json:"idleTimeout"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"` // 收到 SIGTERM 后最多等待处理中请求的时间
+	StopTimeout     Duration `json:"stopTimeout"`     // 之后最多等待后台任务停止和写库的时间
+}
+
+type RoomConfig struct {
+	Salt string   `json:"salt"` // token = md5(stream_expiration_salt)
+	TTL  Duration `json:"ttl"`  // 创建和续期时的有效期
+}
+
+type DispatchConfig struct {
+	Count            int     `json:"count"`            // 每次返回的节点数
+	IpDatabase       string  `json:"ipDatabase"`       // isp.txt 路径
+	InsideAddrPrefix string  `json:"insideAddrPrefix"` // 内网地址前缀 按机房调度
+	MaxLoad          float64 `json:"maxLoad"`          // load 1m 或 5m 超过时不参与调度
+	MaxNetSendBytes  int64   `json:"maxNetSendBytes"`  // 出口流量超过时不参与调度
+}
+
+type ServerConfig struct {
+	PollInterval        Duration `json:"pollInterval"` // 拉取 srs http api 的间隔
+	HeartbeatTimeout    Duration `json:"heartbeatTimeout"`
+	HeartbeatAutoActive bool     `json:"heartbeatAutoActive"` // 自动注册的节点是否直接参与调度
+}
+
+type KickConfig struct {
+	MaxAttempts   int      `json:"maxAttempts"`
+	Backoff       Duration `json:"backoff"`
+	RetentionDays int      `json:"retentionDays"` // 已完成的任务保留天数
+}
+
+type StallConfig struct {
+	Kbps         int      `json:"kbps"`
+	DegradedKbps int      `json:"degradedKbps"`
+	For          Duration `json:"for"`
+	AutoKick     bool     `json:"autoKick"`
+	Webhook      string   `json:"webhook"`
+}
+
+type HistoryConfig struct {
+	MinuteRetentionDays int `json:"minuteRetentionDays"`
+	HourRetentionDays   int `json:"hourRetentionDays"`
+}
+
+type AuditConfig struct {
+	RetentionDays int `json:"retentionDays"`
+}
+
+type AuthConfig struct {
+	Enabled  bool   `json:"enabled"`
+	AdminKey string `json:"adminKey"`
+}
+
+type EventConfig struct {
+	CheckSource bool   `json:"checkSource"`
+	AllowCidrs  string `json:"allowCidrs"` // 逗号分隔
+	Secret      string `json:"secret"`
+}
+
+type RulesConfig struct {
+	Rules string `json:"rules"` // 规则文件路径 为空时不启用
+}
+
+type RateLimitOptions struct {
+	Rules          string `json:"rules"`          // 规则文件路径 为空时不启用
+	TrustedProxies string `json:"trustedProxies"` // 逗号分隔 只信任这些地址转发的 X-REAL-IP
+	MaxBuckets     int    `json:"maxBuckets"`     // 每条规则最多的令牌桶 超过后新的 key 共用一个桶
+}
+
+type RefererConfig struct {
+	AllowEmpty bool `json:"allowEmpty"`
+}
+
+type Config struct {
+	Port      int              `json:"port"`
+	HTTP      HTTPConfig       `json:"http"`
+	DB        DBConfig         `json:"db"`
+	Room      RoomConfig       `json:"room"`
+	Dispatch  DispatchConfig   `json:"dispatch"`
+	Server    ServerConfig     `json:"server"`
+	Kick      KickConfig       `json:"kick"`
+	Stall     StallConfig      `json:"stall"`
+	History   HistoryConfig    `json:"history"`
+	Alert     RulesConfig      `json:"alert"`
+	RateLimit RateLimitOptions `json:"rateLimit"`
+	Audit     AuditConfig      `json:"audit"`
+	Auth      AuthConfig       `json:"auth"`
+	Event     EventConfig      `json:"event"`
+	Referer   RefererConfig    `json:"referer"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Port: DefaultPort,
+		HTTP: HTTPConfig{
+			ReadTimeout:     Duration{DefaultHTTPReadTimeout},
+			IdleTimeout:     Duration{DefaultHTTPIdleTimeout},
+			ShutdownTimeout: Duration{DefaultHTTPShutdownTimeout},
+			StopTimeout:     Duration{DefaultHTTPStopTimeout},
+		},
+		DB: DBConfig{
+			Driver:       STORE_DRIVER_MYSQL,
+			MaxOpen:      DefaultDBMaxOpen,
+			MaxIdle:      DefaultDBMaxIdle,
+			ConnLifetime: Duration{DefaultDBConnLifetime},
+			QueryTimeout: Duration{DefaultDBQueryTimeout},
+		},
+		Room: RoomConfig{Salt: DefaultRoomSalt, TTL: Duration{DefaultRoomTTL}},
+		Dispatch: DispatchConfig{
+			Count:            DefaultDisPatchCount,
+			IpDatabase:       DefaultIpDatabase,
+			InsideAddrPrefix: DefaultInsideAddrPrefix,
+			MaxLoad:          DefaultMaxLoad,
+			MaxNetSendBytes:  DefaultMaxNetSendBytes,
+		},
+		Server: ServerConfig{
+			PollInterval:     Duration{DefaultPollInterval},
+			HeartbeatTimeout: Duration{DefaultHeartbeatTimeout},
+		},
+		Kick: KickConfig{MaxAttempts: DefaultKickMaxAttempts, Backoff: Duration{DefaultKickBackoff},
+			RetentionDays: DefaultKickRetentionDays},
+		Stall: StallConfig{
+			Kbps:         DefaultStallKbps,
+			DegradedKbps: DefaultDegradedKbps,
+			For:          Duration{DefaultStallFor},
+		},
+		History: HistoryConfig{
+			MinuteRetentionDays: DefaultHistoryMinuteDays,
+			HourRetentionDays:   DefaultHistoryHourDays,
+		},
+		Audit:     AuditConfig{RetentionDays: DefaultAuditRetentionDays},
+		RateLimit: RateLimitOptions{MaxBuckets: DefaultRateMaxBuckets},
+	}
+}
+
+// 默认值 -> 配置文件 -> 环境变量 最后校验
+// 配置文件中未知的字段报错 避免拼错的配置被忽略
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(c); err != nil {
+			return nil, fmt.Errorf("parse config %v err:%v", path, err)
+		}
+	}
+	if err := c.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 环境变量名为 SRS_MANAGER_ 加上 json 路径 例如 db.source -> SRS_MANAGER_DB_SOURCE
+// lookup 一般为 os.LookupEnv
+func (c *Config) ApplyEnv(lookup func(key string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), CONFIG_ENV_PREFIX, lookup)
+}
+
+var durationType = reflect.TypeOf(Duration{})
+
+func applyEnv(v reflect.Value, prefix string, lookup func(key string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + "_" + envName(v.Type().Field(i).Tag.Get("json"))
+		if field.Kind() == reflect.Struct && field.Type() != durationType {
+			if err := applyEnv(field, name, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("env %v=%v err:%v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// maxOpen -> MAX_OPEN
+func envName(tag string) string {
+	var b strings.Builder
+	for i, r := range tag {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err == nil {
+			field.Set(reflect.ValueOf(Duration{d}))
+		}
+		return err
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return nil
+}
+
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// 返回所有不合法的字段 而不是遇到第一个就返回
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Port > 0 && c.Port < 65536, "port %v out of range", c.Port)
+	check(c.HTTP.ReadTimeout.Duration > 0, "http.readTimeout must be positive")
+	check(c.HTTP.IdleTimeout.Duration > 0, "http.idleTimeout must be positive")
+	check(c.HTTP.ShutdownTimeout.Duration > 0, "http.shutdownTimeout must be positive")
+	check(c.HTTP.StopTimeout.Duration > 0, "http.stopTimeout must be positive")
+
+	switch c.DB.Driver {
+	case STORE_DRIVER_MYSQL, STORE_DRIVER_SQLITE:
+		check(c.DB.Source != "", "db.source required by driver %v", c.DB.Driver)
+	case STORE_DRIVER_MEMORY:
+	default:
+		check(false, "db.driver %q must be mysql, sqlite3 or memory", c.DB.Driver)
+	}
+	check(c.DB.MaxOpen > 0, "db.maxOpen must be positive")
+	check(c.DB.MaxIdle >= 0, "db.maxIdle must not be negative")
+	check(c.DB.ConnLifetime.Duration >= 0, "db.connLifetime must not be negative")
+	check(c.DB.QueryTimeout.Duration > 0, "db.queryTimeout must be positive")
+
+	check(c.Room.Salt != "", "room.salt required")
+	check(c.Room.TTL.Duration > 0, "room.ttl must be positive")
+
+	check(c.Dispatch.Count > 0, "dispatch.count must be positive")
+	check(c.Dispatch.IpDatabase != "", "dispatch.ipDatabase required")
+	check(c.Dispatch.InsideAddrPrefix != "", "dispatch.insideAddrPrefix required")
+	check(c.Dispatch.MaxLoad > 0, "dispatch.maxLoad must be positive")
+	check(c.Dispatch.MaxNetSendBytes > 0, "dispatch.maxNetSendBytes must be positive")
+
+	check(c.Server.PollInterval.Duration >= time.Second, "server.pollInterval must be at least 1s")
+	check(c.Server.HeartbeatTimeout.Duration >= time.Second, "server.heartbeatTimeout must be at least 1s")
+
+	check(c.Kick.MaxAttempts > 0, "kick.maxAttempts must be positive")
+	check(c.Kick.Backoff.Duration > 0, "kick.backoff must be positive")
+	check(c.Kick.RetentionDays > 0, "kick.retentionDays must be positive")
+
+	check(c.Stall.Kbps >= 0, "stall.kbps must not be negative")
+	check(c.Stall.DegradedKbps >= c.Stall.Kbps, "stall.degradedKbps must not be less than stall.kbps")
+	check(c.Stall.For.Duration >= 0, "stall.for must not be negative")
+
+	check(c.History.MinuteRetentionDays > 0, "history.minuteRetentionDays must be positive")
+	check(c.History.HourRetentionDays > 0, "history.hourRetentionDays must be positive")
+	check(c.Audit.RetentionDays > 0, "audit.retentionDays must be positive")
+
+	if _, err := ParseCidrs(c.Event.AllowCidrs); err != nil {
+		check(false, "event.allowCidrs: %v", err)
+	}
+	check(c.RateLimit.MaxBuckets > 0, "rateLimit.maxBuckets must be positive")
+	if _, err := ParseCidrs(c.RateLimit.TrustedProxies); err != nil {
+		check(false, "rateLimit.trustedProxies: %v", err)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// -check-config 时使用 除了字段校验 还加载配置引用的文件
+// 和 Validate 一样返回所有出错的文件
+func CheckConfig(c *Config) error {
+	var errs ConfigErrors
+	if _, err := NewIpDatabase(c.Dispatch); err != nil {
+		errs = append(errs, fmt.Sprintf("dispatch.ipDatabase: %v", err))
+	}
+	if c.RateLimit.Rules != "" {
+		if _, err := LoadRateLimitConfig(c.RateLimit.Rules); err != nil {
+			errs = append(errs, fmt.Sprintf("rateLimit.rules: %v", err))
+		}
+	}
+	if c.Alert.Rules != "" {
+		if _, err := LoadAlertConfig(c.Alert.Rules); err != nil {
+			errs = append(errs, fmt.Sprintf("alert.rules: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c DBConfig) PoolOptions() DBPoolOptions {
+	return DBPoolOptions{
+		MaxOpen:      c.MaxOpen,
+		MaxIdle:      c.MaxIdle,
+		ConnLifetime: c.ConnLifetime.Duration,
+		QueryTimeout: c.QueryTimeout.Duration,
+	}
+}
+
+const CONFIG_REDACTED = "******"
+
+// 用于 GET /admin/config 去掉密钥和数据库密码
+func (c Config) Redacted() Config {
+	if c.Auth.AdminKey != "" {
+		c.Auth.AdminKey = CONFIG_REDACTED
+	}
+	if c.Event.Secret != "" {
+		c.Event.Secret = CONFIG_REDACTED
+	}
+	c.DB.Source = redactSource(c.DB.Source)
+	return c
+}
+
+// user:password@tcp(host:port)/db 中的 password
+func redactSource(source string) string {
+	at := strings.LastIndex(source, "@")
+	if at < 0 {
+		return source
+	}
+	colon := strings.Index(source[:at], ":")
+	if colon < 0 {
+		return source
+	}
+	return source[:colon+1] + CONFIG_REDACTED + source[at:]
+}
@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultConfigValid(t *testing.T) {
+	c := DefaultConfig()
+	c.DB.Driver = STORE_DRIVER_MEMORY
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "manager.cfg")
+	content := `{
+		"port": 9000,
+		"db": {"driver": "sqlite3", "source": "/tmp/a.db", "queryTimeout": "500ms"},
+		"dispatch": {"count": 3, "maxLoad": 32},
+		"room": {"ttl": "2h"}
+	}`
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SRS_MANAGER_DB_MAX_OPEN", "7")
+	os.Setenv("SRS_MANAGER_SERVER_POLL_INTERVAL", "5s")
+	os.Setenv("SRS_MANAGER_AUTH_ENABLED", "true")
+	defer os.Unsetenv("SRS_MANAGER_DB_MAX_OPEN")
+	defer os.Unsetenv("SRS_MANAGER_SERVER_POLL_INTERVAL")
+	defer os.Unsetenv("SRS_MANAGER_AUTH_ENABLED")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 9000 || c.DB.QueryTimeout.Duration != 500*time.Millisecond || c.Room.TTL.Duration != 2*time.Hour {
+		t.Errorf("file values not loaded %+v", c)
+	}
+	if c.Dispatch.Count != 3 || c.Dispatch.MaxLoad != 32 || c.Dispatch.InsideAddrPrefix != DefaultInsideAddrPrefix {
+		t.Errorf("dispatch %+v", c.Dispatch)
+	}
+	if c.DB.MaxOpen != 7 || c.Server.PollInterval.Duration != 5*time.Second || !c.Auth.Enabled {
+		t.Errorf("env overrides not applied %+v %+v %+v", c.DB, c.Server, c.Auth)
+	}
+
+	os.Setenv("SRS_MANAGER_DB_MAX_OPEN", "x")
+	if _, err = LoadConfig(path); err == nil || !strings.Contains(err.Error(), "SRS_MANAGER_DB_MAX_OPEN") {
+		t.Errorf("invalid env should fail %v", err)
+	}
+	os.Unsetenv("SRS_MANAGER_DB_MAX_OPEN")
+
+	if err = ioutil.WriteFile(path, []byte(`{"dbDriver": "mysql"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadConfig(path); err == nil {
+		t.Errorf("unknown field should fail")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := DefaultConfig()
+	c.Port = 0
+	c.DB.Driver = "oracle"
+	c.Dispatch.Count = 0
+	c.Stall.DegradedKbps = 1
+	c.Event.AllowCidrs = "10.0.0.0/33"
+	err := c.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 5 {
+		t.Fatalf("expect 5 errors got %v", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	c := DefaultConfig()
+	c.Dispatch.IpDatabase = "../utils/isp.txt"
+	c.RateLimit.Rules = "not_exists_ratelimit.json"
+	c.Alert.Rules = "not_exists_alerts.json"
+	err := CheckConfig(c)
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expect 2 errors got %v", err)
+	}
+
+	c.RateLimit.Rules, c.Alert.Rules = "", ""
+	if err = CheckConfig(c); err != nil {
+		t.Errorf("CheckConfig %v", err)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := DefaultConfig()
+	c.DB.Source = "root:pass@tcp(127.0.0.1:3306)/srs"
+	c.Auth.AdminKey = "k"
+	r := c.Redacted()
+	if r.DB.Source != "root:******@tcp(127.0.0.1:3306)/srs" || r.Auth.AdminKey != CONFIG_REDACTED || r.Event.Secret != "" {
+		t.Errorf("redacted %+v %+v %+v", r.DB, r.Auth, r.Event)
+	}
+	if c.Auth.AdminKey != "k" {
+		t.Errorf("original config changed")
+	}
+}
@@ -0,0 +1,37 @@
+package manager
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// 运维控制台 单页应用 数据都来自已有的json接口
+//
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+type Dashboard struct {
+	files http.Handler
+}
+
+func NewDashboard() *Dashboard {
+	sub, err := fs.Sub(dashboardAssets, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return &Dashboard{files: http.StripPrefix(URL_PATH_UI, http.FileServer(http.FS(sub)))}
+}
+
+func (d *Dashboard) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != HTTP_GET {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, URL_PATH_UI+"/") {
+		http.Redirect(w, r, URL_PATH_UI+"/", http.StatusFound)
+		return
+	}
+	d.files.ServeHTTP(w, r)
+}
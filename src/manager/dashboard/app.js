@@ -0,0 +1,299 @@
+// SrsManager 运维控制台 只使用已有的 json 接口
+(function () {
+  "use strict";
+
+  var SERVER_STATUS = ["active", "pending", "offline", "removed"];
+  var ROOM_STATUS = ["created", "publishing", "closed", "closing"];
+  var KICK_STATUS = ["pending", "running", "done", "failed"];
+  var GROUP_KEYS = { province: "省份", isp: "运营商", type: "类型" };
+
+  var view = document.getElementById("view");
+  var state = { route: "", group: "province", refresh: null };
+
+  function esc(v) {
+    return String(v === undefined || v === null ? "" : v).replace(/[&<>"']/g, function (c) {
+      return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c];
+    });
+  }
+
+  // 开启认证时使用的 api key 保存在 localStorage
+  var KEY_STORAGE = "srs_manager_api_key";
+  var keyInput = document.getElementById("api-key");
+  keyInput.value = localStorage.getItem(KEY_STORAGE) || "";
+  keyInput.addEventListener("change", function () {
+    localStorage.setItem(KEY_STORAGE, keyInput.value);
+    location.reload();
+  });
+
+  function request(method, url) {
+    var headers = {};
+    if (keyInput.value) {
+      headers.Authorization = "Bearer " + keyInput.value;
+    }
+    return fetch(url, { method: method, headers: headers, credentials: "same-origin" }).then(function (rsp) {
+      if (rsp.status === 401 || rsp.status === 403) {
+        throw new Error(method + " " + url + " " + rsp.status + "，请检查 API key");
+      }
+      if (!rsp.ok) {
+        throw new Error(method + " " + url + " " + rsp.status);
+      }
+      return rsp.text().then(function (text) {
+        return text ? JSON.parse(text) : null;
+      });
+    });
+  }
+
+  function get(url) {
+    return request("GET", url);
+  }
+
+  function fmtTime(ts) {
+    if (!ts) {
+      return '<span class="muted">-</span>';
+    }
+    return esc(new Date(ts * 1000).toLocaleString());
+  }
+
+  function table(columns, rows) {
+    var html = "<table><tr>";
+    columns.forEach(function (c) {
+      html += '<th class="' + (c.num ? "num" : "") + '">' + esc(c.title) + "</th>";
+    });
+    html += "</tr>";
+    if (!rows.length) {
+      html += '<tr><td class="muted" colspan="' + columns.length + '">无数据</td></tr>';
+    }
+    rows.forEach(function (r) {
+      html += "<tr>";
+      columns.forEach(function (c) {
+        var v = c.render ? c.render(r) : esc(r[c.key]);
+        html += '<td class="' + (c.num ? "num" : "") + '">' + v + "</td>";
+      });
+      html += "</tr>";
+    });
+    return html + "</table>";
+  }
+
+  function showError(err) {
+    view.innerHTML = '<p class="error">' + esc(err.message) + "</p>";
+  }
+
+  // 节点 按省份 运营商 类型分组
+  function renderServers() {
+    return get("/server").then(function (servers) {
+      var groups = {};
+      servers.forEach(function (s) {
+        var key = { province: s.Province, isp: s.Isp, type: s.ServerType }[state.group] || "未知";
+        (groups[key] = groups[key] || []).push(s);
+      });
+
+      var html = '<div class="toolbar">分组: ';
+      Object.keys(GROUP_KEYS).forEach(function (k) {
+        html += '<label><input type="radio" name="group" value="' + k + '"' +
+          (state.group === k ? " checked" : "") + "> " + GROUP_KEYS[k] + "</label>";
+      });
+      html += "</div>";
+
+      var columns = [
+        { title: "地址", key: "Addr" },
+        { title: "类型", key: "ServerType" },
+        { title: "省份", key: "Province" },
+        { title: "运营商", key: "Isp" },
+        { title: "状态", render: function (s) {
+          return '<span class="status-' + s.Status + '">' + esc(SERVER_STATUS[s.Status]) + "</span>";
+        } },
+        { title: "load 1m", num: true, render: function (s) {
+          return '<span class="' + (s.Load1m > 8 ? "load-high" : "") + '">' + s.Load1m.toFixed(2) + "</span>";
+        } },
+        { title: "cpu %", num: true, render: function (s) { return s.CPUPercent.toFixed(1); } },
+        { title: "连接数", num: true, render: function (s) {
+          return s.ConnSrs + (s.Capacity ? " / " + s.Capacity : "");
+        } },
+        { title: "版本", key: "Version" },
+        { title: "最近更新", render: function (s) { return fmtTime(s.UpdateTime); } }
+      ];
+      Object.keys(groups).sort().forEach(function (key) {
+        html += "<h2>" + esc(key) + " (" + groups[key].length + ")</h2>";
+        html += table(columns, groups[key]);
+      });
+      view.innerHTML = html;
+
+      Array.prototype.forEach.call(view.querySelectorAll("input[name=group]"), function (input) {
+        input.onchange = function () {
+          state.group = input.value;
+          renderServers();
+        };
+      });
+    });
+  }
+
+  // 正在直播的 room
+  function renderRooms() {
+    return get("/streams/aggregate?sort=viewers").then(function (streams) {
+      view.innerHTML = "<h2>直播间 (" + streams.length + ")</h2>" + table([
+        { title: "流", render: function (s) {
+          return '<a href="#/room/' + encodeURIComponent(s.Name) + '">' + esc(s.AppName + "/" + s.Name) + "</a>";
+        } },
+        { title: "用户", key: "RoomUser" },
+        { title: "状态", render: function (s) { return s.RoomId ? esc(ROOM_STATUS[s.RoomStatus]) : '<span class="muted">-</span>'; } },
+        { title: "观众", num: true, key: "Viewers" },
+        { title: "出口 kbps", num: true, key: "EgressKbps" },
+        { title: "源站接收 kbps", num: true, key: "RecvKbps" },
+        { title: "推流边缘", key: "PublishEdge" },
+        { title: "播放边缘", render: function (s) { return esc((s.Edges || []).join(", ")); } }
+      ], streams);
+    });
+  }
+
+  // room 详情 观众 地域分布 黑名单 踢人
+  function renderRoom(stream) {
+    var enc = encodeURIComponent(stream);
+    return Promise.all([
+      get("/streams/aggregate"),
+      get("/clients?stream=" + enc),
+      get("/geo/" + enc),
+      get("/room/" + enc + "/bans")
+    ]).then(function (res) {
+      var agg = res[0].filter(function (s) { return s.Name === stream; })[0] || {};
+      var clients = res[1] || [];
+      var geo = res[2] || {};
+      var bans = res[3] || [];
+
+      var html = "<h2>" + esc(stream) + "</h2>";
+      html += '<div class="toolbar">用户: ' + esc(agg.RoomUser || "-") +
+        " &nbsp; 状态: " + esc(agg.RoomId ? ROOM_STATUS[agg.RoomStatus] : "-") +
+        " &nbsp; 观众: " + esc(agg.Viewers || 0) +
+        " &nbsp; 出口: " + esc(agg.EgressKbps || 0) + " kbps" +
+        " &nbsp; 推流边缘: " + esc(agg.PublishEdge || "-") +
+        ' &nbsp; <button class="danger" id="kick-room">关闭直播间</button>' +
+        ' <span id="kick-result"></span></div>';
+
+      html += '<div class="grid"><div><h2>省份</h2>' + table([
+        { title: "省份", key: "k" }, { title: "观众", num: true, key: "v" }
+      ], toRows(geo.Provinces)) + "</div>";
+      html += "<div><h2>运营商</h2>" + table([
+        { title: "运营商", key: "k" }, { title: "观众", num: true, key: "v" }
+      ], toRows(geo.Isps)) + "</div></div>";
+
+      html += "<h2>客户端 (" + clients.length + ")</h2>" + table([
+        { title: "ID", key: "ID" },
+        { title: "类型", key: "Type" },
+        { title: "IP", key: "Ip" },
+        { title: "节点", render: function (c) { return esc(c.Host + " (" + c.ServerType + ")"); } },
+        { title: "时长 s", num: true, render: function (c) { return Math.round(c.Duration); } },
+        { title: "", render: function (c) {
+          return c.Type === "play" && c.ServerType === "down" ?
+            '<button data-client="' + esc(c.ID) + '" data-host="' + esc(c.Host) + '">踢掉</button>' : "";
+        } }
+      ], clients);
+
+      html += "<h2>黑名单</h2>" + table([
+        { title: "类型", render: function (b) { return b.Type === 0 ? "ip" : "user"; } },
+        { title: "值", key: "Value" },
+        { title: "添加时间", render: function (b) { return fmtTime(b.CreateTime); } }
+      ], bans);
+      view.innerHTML = html;
+
+      document.getElementById("kick-room").onclick = function () {
+        if (!confirm("确定关闭直播间 " + stream + " ?")) {
+          return;
+        }
+        request("DELETE", "/room/" + enc).then(function (job) {
+          document.getElementById("kick-result").textContent = job ?
+            "踢人任务 " + job.ID + " " + KICK_STATUS[job.Status] : "已关闭";
+        }).catch(function (err) {
+          document.getElementById("kick-result").textContent = err.message;
+        });
+      };
+      Array.prototype.forEach.call(view.querySelectorAll("button[data-client]"), function (btn) {
+        btn.onclick = function () {
+          var url = "/room/" + enc + "/viewers/" + btn.dataset.client + "?host=" + encodeURIComponent(btn.dataset.host);
+          request("DELETE", url).then(function () {
+            btn.disabled = true;
+          }).catch(function (err) {
+            alert(err.message);
+          });
+        };
+      });
+    });
+  }
+
+  function toRows(m) {
+    return Object.keys(m || {}).map(function (k) {
+      return { k: k, v: m[k] };
+    }).sort(function (a, b) {
+      return b.v - a.v;
+    });
+  }
+
+  function route() {
+    var hash = location.hash.replace(/^#/, "") || "/servers";
+    state.route = hash;
+    Array.prototype.forEach.call(document.querySelectorAll("header nav a"), function (a) {
+      a.className = hash.indexOf(a.getAttribute("href").slice(1)) === 0 ? "active" : "";
+    });
+
+    var m = hash.match(/^\/room\/(.+)$/);
+    if (m) {
+      state.refresh = renderRoom.bind(null, decodeURIComponent(m[1]));
+    } else if (hash === "/rooms") {
+      state.refresh = renderRooms;
+    } else {
+      state.refresh = renderServers;
+    }
+    state.refresh().catch(showError);
+  }
+
+  // 收到推送后合并刷新 避免频繁请求
+  var pending = null;
+  function scheduleRefresh() {
+    if (pending) {
+      return;
+    }
+    pending = setTimeout(function () {
+      pending = null;
+      state.refresh().catch(showError);
+    }, 2000);
+  }
+
+  function showAlert(a) {
+    var box = document.getElementById("alerts");
+    var div = document.createElement("div");
+    div.className = "alert " + (a.State === "resolved" ? "resolved" : "");
+    div.textContent = "[" + a.State + "] " + a.Rule + " " + a.Key + " " + a.Message;
+    box.insertBefore(div, box.firstChild);
+    while (box.childNodes.length > 5) {
+      box.removeChild(box.lastChild);
+    }
+  }
+
+  function connectLive() {
+    if (!window.EventSource) {
+      return;
+    }
+    var indicator = document.getElementById("live-state");
+    var url = "/live/events";
+    if (keyInput.value) {
+      url += "?access_token=" + encodeURIComponent(keyInput.value);
+    }
+    var es = new EventSource(url);
+    es.onopen = function () {
+      indicator.className = "on";
+      indicator.textContent = "实时推送已连接";
+    };
+    es.onerror = function () {
+      indicator.className = "off";
+      indicator.textContent = "实时推送未连接";
+    };
+    ["summary", "room", "publish", "unpublish"].forEach(function (kind) {
+      es.addEventListener(kind, scheduleRefresh);
+    });
+    es.addEventListener("alert", function (e) {
+      showAlert(JSON.parse(e.data).Data);
+    });
+  }
+
+  window.addEventListener("hashchange", route);
+  route();
+  connectLive();
+})();
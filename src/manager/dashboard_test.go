@@ -0,0 +1,30 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	d := NewDashboard()
+
+	w := httptest.NewRecorder()
+	d.HttpHandler(w, httptest.NewRequest(HTTP_GET, "/", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != URL_PATH_UI+"/" {
+		t.Errorf("redirect got %v %v", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	d.HttpHandler(w, httptest.NewRequest(HTTP_GET, URL_PATH_UI+"/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "app.js") {
+		t.Errorf("index got %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	d.HttpHandler(w, httptest.NewRequest(HTTP_GET, URL_PATH_UI+"/app.js", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("app.js got %v", w.Code)
+	}
+}
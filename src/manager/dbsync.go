@@ -1,9 +1,9 @@
 package manager
 
 import (
+	"context"
 	"database/sql"
 	"strings"
-	"sync"
 	"time"
 
 	"fmt"
@@ -14,51 +14,130 @@ import (
 const (
 	//	TABLE_NAME_ROOM       = "room"
 	TABLE_NAME_SRS_SERVER = "srs_server"
+	TABLE_NAME_ROOM_BAN   = "room_ban"
+	TABLE_NAME_HISTORY    = "history"
+	TABLE_NAME_INCIDENT   = "stream_incident"
+	TABLE_NAME_VIEWER_GEO = "viewer_geo"
+	TABLE_NAME_USAGE      = "usage_hourly"
+	TABLE_NAME_AUDIT      = "audit_log"
+	TABLE_NAME_API_KEY    = "api_key"
+	TABLE_NAME_GEO_RULE   = "room_geo_rule"
+	TABLE_NAME_REFERER    = "referer_rule"
+	TABLE_NAME_KICK_JOB   = "kick_job"
 )
 
+const (
+	DefaultDBMaxOpen      = 20
+	DefaultDBMaxIdle      = 5
+	DefaultDBConnLifetime = 5 * time.Minute
+	DefaultDBQueryTimeout = 3 * time.Second
+)
+
+type DBPoolOptions struct {
+	MaxOpen      int
+	MaxIdle      int
+	ConnLifetime time.Duration
+	QueryTimeout time.Duration // 单次查询的超时时间
+}
+
+func DefaultDBPoolOptions() DBPoolOptions {
+	return DBPoolOptions{
+		MaxOpen:      DefaultDBMaxOpen,
+		MaxIdle:      DefaultDBMaxIdle,
+		ConnLifetime: DefaultDBConnLifetime,
+		QueryTimeout: DefaultDBQueryTimeout,
+	}
+}
+
+// Store 的 mysql 实现 sqlite 也复用这里的sql
+// 整个进程共用一个连接池
 type DBSync struct {
 	dbDriver     string
 	dbDataSource string
+	queryTimeout time.Duration
 
-	mutex sync.Mutex
+	db *sql.DB
 }
 
-func NewDBSync(dbDriver, dbDataSource string) *DBSync {
+func NewDBSync(dbDriver, dbDataSource string, opts DBPoolOptions) (*DBSync, error) {
+	db, err := sql.Open(dbDriver, dbDataSource)
+	if err != nil {
+		return nil, fmt.Errorf("donnot open sql:%v err:%v", dbDataSource, err)
+	}
+	db.SetMaxOpenConns(opts.MaxOpen)
+	db.SetMaxIdleConns(opts.MaxIdle)
+	db.SetConnMaxLifetime(opts.ConnLifetime)
 	return &DBSync{
 		dbDriver:     dbDriver,
 		dbDataSource: dbDataSource,
-	}
+		queryTimeout: opts.QueryTimeout,
+		db:           db,
+	}, nil
 }
 
-func (d *DBSync) open() (db *sql.DB, err error) {
-	if db, err = sql.Open(d.dbDriver, d.dbDataSource); err != nil {
-		return nil, fmt.Errorf("donnot open sql:%v", d.dbDataSource)
+func (d *DBSync) Close() error {
+	return d.db.Close()
+}
+
+func (d *DBSync) Stats() sql.DBStats {
+	return d.db.Stats()
+}
+
+// 每次查询加上超时
+func (d *DBSync) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, d.queryTimeout)
+}
 
-	return
+// 唯一键冲突时累加 increments 中的列
+func (d *DBSync) upsertIncrement(keys []string, increments []string) string {
+	sets := make([]string, 0, len(increments))
+	if d.dbDriver == STORE_DRIVER_SQLITE {
+		for _, c := range increments {
+			sets = append(sets, fmt.Sprintf("`%s` = `%s` + excluded.`%s`", c, c, c))
+		}
+		return " on conflict(`" + strings.Join(keys, "`, `") + "`) do update set " + strings.Join(sets, ", ")
+	}
+	for _, c := range increments {
+		sets = append(sets, fmt.Sprintf("`%s` = `%s` + values(`%s`)", c, c, c))
+	}
+	return " on duplicate key update " + strings.Join(sets, ", ")
 }
 
-func (d *DBSync) exec(sqlstr string, params ...interface{}) (sql.Result, error) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	var db *sql.DB
-	var err error
-	if db, err = d.open(); err != nil {
-		return nil, err
+// 唯一键冲突时用新值覆盖 columns 中的列
+func (d *DBSync) upsertReplace(keys []string, columns []string) string {
+	sets := make([]string, 0, len(columns))
+	if d.dbDriver == STORE_DRIVER_SQLITE {
+		for _, c := range columns {
+			sets = append(sets, fmt.Sprintf("`%s` = excluded.`%s`", c, c))
+		}
+		return " on conflict(`" + strings.Join(keys, "`, `") + "`) do update set " + strings.Join(sets, ", ")
+	}
+	for _, c := range columns {
+		sets = append(sets, fmt.Sprintf("`%s` = values(`%s`)", c, c))
 	}
-	defer db.Close()
-	return db.Exec(sqlstr, params...)
+	return " on duplicate key update " + strings.Join(sets, ", ")
 }
 
-func (d *DBSync) InsertRoom(room *Room) (err error) {
-	sql := "insert into room(`user`, `desc`, streamname, expiration, status, createtime, lastupdatetime) values(?, ?, ? , ?, ?, ?, ?)"
+func (d *DBSync) exec(ctx context.Context, sqlstr string, params ...interface{}) (sql.Result, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "exec")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	return d.db.ExecContext(ctx, sqlstr, params...)
+}
+
+func (d *DBSync) InsertRoom(ctx context.Context, room *Room) (err error) {
+	sql := "insert into room(`user`, `desc`, `bu`, streamname, expiration, status, createtime, lastupdatetime) values(?, ?, ?, ? , ?, ?, ?, ?)"
 
 	room.CreateTime = time.Now().Unix()
 	room.LastUpdateTime = room.CreateTime
 	var id int64
-	if id, err = d.insert(sql,
+	if id, err = d.insert(ctx, sql,
 		room.UserName,
 		room.Desc,
+		room.BusinessUnit,
 		room.StreamName,
 		room.Expiration,
 		room.Status,
@@ -71,8 +150,8 @@ func (d *DBSync) InsertRoom(room *Room) (err error) {
 	return
 }
 
-func (d *DBSync) insert(sql string, args ...interface{}) (lastInsertId int64, err error) {
-	res, err := d.exec(sql, args...)
+func (d *DBSync) insert(ctx context.Context, sql string, args ...interface{}) (lastInsertId int64, err error) {
+	res, err := d.exec(ctx, sql, args...)
 	if err != nil {
 		return -1, fmt.Errorf("sql:%v args:%v insert err:%v", sql, args, err)
 	}
@@ -83,10 +162,10 @@ func (d *DBSync) insert(sql string, args ...interface{}) (lastInsertId int64, er
 	return
 }
 
-func (d *DBSync) UpdateRoom(room *Room) error {
+func (d *DBSync) UpdateRoom(ctx context.Context, room *Room) error {
 	sql := "update room set `desc`= ?, `streamname`=? , `expiration` = ?, status = ?, `publishid` = ?,`publishhost` = ?, lastupdatetime=? where id = ?"
 	room.LastUpdateTime = time.Now().Unix()
-	if _, err := d.exec(sql,
+	if _, err := d.exec(ctx, sql,
 		room.Desc,
 		room.StreamName,
 		room.Expiration,
@@ -100,79 +179,718 @@ func (d *DBSync) UpdateRoom(room *Room) error {
 	return nil
 }
 
-func (d *DBSync) SelectRoom(params map[string]interface{}) (*Room, error) {
-	keys := []string{}
-	values := []interface{}{}
-	for k, v := range params {
-		keys = append(keys, " `"+k+"` = ? ")
-		values = append(values, v)
-	}
+const ROOM_COLUMNS = "`id`, `user`, `desc`, `bu`, `streamname`, `expiration`, `status`, `publishid`, `publishhost`, `createtime`, `lastupdatetime`"
 
-	sqlstr := "select `id`, `user`, `desc`, `streamname`, `expiration`, `status`, `publishid`, `publishhost`, `createtime`, `lastupdatetime` from room where " + strings.Join(keys, " and ")
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	db, err := d.open()
-	if err != nil {
-		return nil, fmt.Errorf("donnot open sql:%v", d.dbDataSource)
-	}
-	defer db.Close()
-	row := db.QueryRow(sqlstr, values...)
-	var room Room
-	if err = row.Scan(&room.Id,
+func scanRoom(row rowScanner, room *Room) error {
+	return row.Scan(&room.Id,
 		&room.UserName,
 		&room.Desc,
+		&room.BusinessUnit,
 		&room.StreamName,
 		&room.Expiration,
 		&room.Status,
 		&room.PublishClientId,
 		&room.PublishHost,
 		&room.CreateTime,
-		&room.LastUpdateTime); err != nil {
-		return nil, fmt.Errorf("cannot rows scan sql:%v rows:%v err:%v", sqlstr)
+		&room.LastUpdateTime)
+}
+
+func (d *DBSync) SelectRoom(ctx context.Context, params map[string]interface{}) (*Room, error) {
+	keys := []string{}
+	values := []interface{}{}
+	for k, v := range params {
+		keys = append(keys, " `"+k+"` = ? ")
+		values = append(values, v)
+	}
+
+	sqlstr := "select " + ROOM_COLUMNS + " from room where " + strings.Join(keys, " and ")
+
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "select_room")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	var err error
+	row := d.db.QueryRowContext(ctx, sqlstr, values...)
+	var room Room
+	if err = scanRoom(row, &room); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot rows scan sql:%v args:%v err:%v", sqlstr, values, err)
 	}
 
 	return &room, nil
 }
 
-func (d *DBSync) LoadSrsServers() ([]*SrsServer, error) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func (d *DBSync) SelectRooms(ctx context.Context, params map[string]interface{}) ([]*Room, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "select_rooms")
+	keys := []string{"1 = 1"}
+	values := []interface{}{}
+	for k, v := range params {
+		keys = append(keys, " `"+k+"` = ? ")
+		values = append(values, v)
+	}
+
+	sqlstr := "select " + ROOM_COLUMNS + " from room where " + strings.Join(keys, " and ")
+
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	var db *sql.DB
 	var err error
-	if db, err = d.open(); err != nil {
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr, values...); err != nil {
+		return nil, fmt.Errorf("sql:%v args:%v err:%v", sqlstr, values, err)
+	}
+	defer rows.Close()
+
+	var rooms []*Room
+	for rows.Next() {
+		var room Room
+		if err = scanRoom(rows, &room); err != nil {
+			return nil, fmt.Errorf("cannot rows scan sql:%v args:%v err:%v", sqlstr, values, err)
+		}
+		rooms = append(rooms, &room)
+	}
+	return rooms, nil
+}
+
+func (d *DBSync) InsertRoomGeoRule(ctx context.Context, rule *RoomGeoRule) (err error) {
+	sqlstr := "insert into " + TABLE_NAME_GEO_RULE + "(`streamname`, `action`, `type`, `value`, `createtime`) values(?, ?, ?, ?, ?)"
+	rule.Id, err = d.insert(ctx, sqlstr, rule.StreamName, rule.Action, rule.Type, rule.Value, rule.CreateTime)
+	return
+}
+
+func (d *DBSync) DeleteRoomGeoRule(ctx context.Context, id int64) error {
+	sqlstr := "delete from " + TABLE_NAME_GEO_RULE + " where id = ?"
+	if _, err := d.exec(ctx, sqlstr, id); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) LoadRoomGeoRules(ctx context.Context) ([]*RoomGeoRule, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "load_geo_rules")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `id`, `streamname`, `action`, `type`, `value`, `createtime` from " + TABLE_NAME_GEO_RULE
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr); err != nil {
 		return nil, err
 	}
-	defer db.Close()
+	defer rows.Close()
 
-	sqlstr := "select `id`, `addr`, `desc`, `type`, `status` from " + TABLE_NAME_SRS_SERVER
+	var rules []*RoomGeoRule
+	for rows.Next() {
+		var rule RoomGeoRule
+		if err = rows.Scan(
+			&rule.Id,
+			&rule.StreamName,
+			&rule.Action,
+			&rule.Type,
+			&rule.Value,
+			&rule.CreateTime); err != nil {
+			return nil, err
+		}
+		rules = append(rules, &rule)
+	}
+	return rules, nil
+}
+
+func (d *DBSync) InsertRefererRule(ctx context.Context, rule *RefererRule) (err error) {
+	sqlstr := "insert into " + TABLE_NAME_REFERER + "(`scope`, `name`, `domain`, `createtime`) values(?, ?, ?, ?)"
+	rule.Id, err = d.insert(ctx, sqlstr, rule.Scope, rule.Name, rule.Domain, rule.CreateTime)
+	return
+}
+
+func (d *DBSync) DeleteRefererRule(ctx context.Context, id int64) error {
+	sqlstr := "delete from " + TABLE_NAME_REFERER + " where id = ?"
+	if _, err := d.exec(ctx, sqlstr, id); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) LoadRefererRules(ctx context.Context) ([]*RefererRule, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "load_referer_rules")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `id`, `scope`, `name`, `domain`, `createtime` from " + TABLE_NAME_REFERER
 
 	var rows *sql.Rows
-	if rows, err = db.Query(sqlstr); err != nil {
+	if rows, err = d.db.QueryContext(ctx, sqlstr); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*RefererRule
+	for rows.Next() {
+		var rule RefererRule
+		if err = rows.Scan(
+			&rule.Id,
+			&rule.Scope,
+			&rule.Name,
+			&rule.Domain,
+			&rule.CreateTime); err != nil {
+			return nil, err
+		}
+		rules = append(rules, &rule)
+	}
+	return rules, nil
+}
+
+func (d *DBSync) LoadSrsServers(ctx context.Context) ([]*SrsServer, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "load_servers")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `id`, `addr`, `desc`, `type`, `status`, `idc`, `capacity`, `version`, `lastseen` from " + TABLE_NAME_SRS_SERVER
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr); err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	var servers []*SrsServer
 	for rows.Next() {
-		var srs SrsServer
+		srs := NewSrsServer("", "", 0)
 		if err = rows.Scan(
 			&srs.ID,
 			&srs.Addr,
 			&srs.Desc,
 			&srs.Type,
-			&srs.Status); err != nil {
+			&srs.Status,
+			&srs.Idc,
+			&srs.Capacity,
+			&srs.Version,
+			&srs.LastSeen); err != nil {
 			return nil, err
 		}
-		servers = append(servers, &srs)
+		servers = append(servers, srs)
 	}
 	return servers, nil
 }
 
-func (d *DBSync) InsertServer(svr *SrsServer) error {
-	sqlstr := "insert into " + TABLE_NAME_SRS_SERVER + "(`addr`, `desc`, `type`, `addr`, `status`) values(?, ?, ?, ?, ?)"
+func (d *DBSync) InsertServer(ctx context.Context, svr *SrsServer) error {
+	sqlstr := "insert into " + TABLE_NAME_SRS_SERVER + "(`addr`, `desc`, `type`, `status`, `idc`, `capacity`, `version`, `lastseen`) values(?, ?, ?, ?, ?, ?, ?, ?)"
 	var err error
-	svr.ID, err = d.insert(sqlstr, svr.Addr, svr.Desc, svr.Type, svr.Status)
+	svr.ID, err = d.insert(ctx, sqlstr, svr.Addr, svr.Desc, svr.Type, svr.Status,
+		svr.Idc, svr.Capacity, svr.Version, svr.LastSeen)
 	return err
 }
+
+func (d *DBSync) UpdateServerStatus(ctx context.Context, svr *SrsServer) error {
+	sqlstr := "update " + TABLE_NAME_SRS_SERVER + " set `status` = ?, `capacity` = ?, `version` = ?, `lastseen` = ? where id = ?"
+	svr.statusLock.RLock()
+	params := []interface{}{svr.Status, svr.Capacity, svr.Version, svr.LastSeen, svr.ID}
+	svr.statusLock.RUnlock()
+	if _, err := d.exec(ctx, sqlstr, params...); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) DeleteServer(ctx context.Context, id int64) error {
+	sqlstr := "delete from " + TABLE_NAME_SRS_SERVER + " where id = ?"
+	if _, err := d.exec(ctx, sqlstr, id); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) InsertRoomBan(ctx context.Context, ban *RoomBan) (err error) {
+	sqlstr := "insert into " + TABLE_NAME_ROOM_BAN + "(`streamname`, `type`, `value`, `createtime`) values(?, ?, ?, ?)"
+	ban.Id, err = d.insert(ctx, sqlstr, ban.StreamName, ban.Type, ban.Value, ban.CreateTime)
+	return
+}
+
+func (d *DBSync) DeleteRoomBan(ctx context.Context, id int64) error {
+	sqlstr := "delete from " + TABLE_NAME_ROOM_BAN + " where id = ?"
+	if _, err := d.exec(ctx, sqlstr, id); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) LoadRoomBans(ctx context.Context) ([]*RoomBan, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "load_bans")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `id`, `streamname`, `type`, `value`, `createtime` from " + TABLE_NAME_ROOM_BAN
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []*RoomBan
+	for rows.Next() {
+		var ban RoomBan
+		if err = rows.Scan(
+			&ban.Id,
+			&ban.StreamName,
+			&ban.Type,
+			&ban.Value,
+			&ban.CreateTime); err != nil {
+			return nil, err
+		}
+		bans = append(bans, &ban)
+	}
+	return bans, nil
+}
+
+func (d *DBSync) CountRoomsByStatus(ctx context.Context) (map[int]int, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "count_rooms")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `status`, count(*) from room group by `status`"
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var status, count int
+		if err = rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, nil
+}
+
+func (d *DBSync) InsertHistoryRollups(ctx context.Context, rollups []*HistoryRollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(rollups))
+	params := make([]interface{}, 0, len(rollups)*6)
+	for _, ru := range rollups {
+		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		params = append(params, ru.Series, ru.Resolution, ru.Time, ru.Avg, ru.Min, ru.Max)
+	}
+	sqlstr := "insert into " + TABLE_NAME_HISTORY + "(`series`, `resolution`, `time`, `avg`, `min`, `max`) values" +
+		strings.Join(values, ",") +
+		d.upsertReplace([]string{"series", "resolution", "time"}, []string{"avg", "min", "max"})
+	if _, err := d.exec(ctx, sqlstr, params...); err != nil {
+		return fmt.Errorf("insert history rollups count:%v err:%v", len(rollups), err)
+	}
+	return nil
+}
+
+func (d *DBSync) DeleteHistoryRollups(ctx context.Context, resolution int, before int64) error {
+	sqlstr := "delete from " + TABLE_NAME_HISTORY + " where `resolution` = ? and `time` < ?"
+	if _, err := d.exec(ctx, sqlstr, resolution, before); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) SelectHistoryRollups(ctx context.Context, series string, resolution int, from, to int64) ([]*HistoryRollup, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "select_history")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `series`, `resolution`, `time`, `avg`, `min`, `max` from " + TABLE_NAME_HISTORY +
+		" where `series` = ? and `resolution` = ? and `time` >= ? and `time` <= ? order by `time`"
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr, series, resolution, from, to); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rollups []*HistoryRollup
+	for rows.Next() {
+		var ru HistoryRollup
+		if err = rows.Scan(
+			&ru.Series,
+			&ru.Resolution,
+			&ru.Time,
+			&ru.Avg,
+			&ru.Min,
+			&ru.Max); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, &ru)
+	}
+	return rollups, nil
+}
+
+func (d *DBSync) InsertIncident(ctx context.Context, incident *StreamIncident) (err error) {
+	sqlstr := "insert into " + TABLE_NAME_INCIDENT + "(`streamname`, `user`, `state`, `detail`, `starttime`, `endtime`, `kicked`) values(?, ?, ?, ?, ?, ?, ?)"
+	incident.Id, err = d.insert(ctx, sqlstr, incident.StreamName, incident.UserName, incident.State,
+		incident.Detail, incident.StartTime, incident.EndTime, incident.Kicked)
+	return
+}
+
+func (d *DBSync) UpdateIncident(ctx context.Context, incident *StreamIncident) error {
+	sqlstr := "update " + TABLE_NAME_INCIDENT + " set `endtime` = ?, `kicked` = ? where id = ?"
+	if _, err := d.exec(ctx, sqlstr, incident.EndTime, incident.Kicked, incident.Id); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) SelectIncidents(ctx context.Context, streamName string, limit int) ([]*StreamIncident, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "select_incidents")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `id`, `streamname`, `user`, `state`, `detail`, `starttime`, `endtime`, `kicked` from " + TABLE_NAME_INCIDENT
+	params := []interface{}{}
+	if streamName != "" {
+		sqlstr += " where `streamname` = ?"
+		params = append(params, streamName)
+	}
+	sqlstr += " order by `id` desc limit ?"
+	params = append(params, limit)
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr, params...); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	incidents := make([]*StreamIncident, 0)
+	for rows.Next() {
+		var incident StreamIncident
+		if err = rows.Scan(
+			&incident.Id,
+			&incident.StreamName,
+			&incident.UserName,
+			&incident.State,
+			&incident.Detail,
+			&incident.StartTime,
+			&incident.EndTime,
+			&incident.Kicked); err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, &incident)
+	}
+	return incidents, nil
+}
+
+// 按 (streamname, hour, province, isp) 累加播放次数
+func (d *DBSync) AddGeoPlays(ctx context.Context, plays []*GeoPlays) error {
+	if len(plays) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(plays))
+	params := make([]interface{}, 0, len(plays)*5)
+	for _, p := range plays {
+		values = append(values, "(?, ?, ?, ?, ?)")
+		params = append(params, p.StreamName, p.Hour, p.Province, p.Isp, p.Plays)
+	}
+	sqlstr := "insert into " + TABLE_NAME_VIEWER_GEO + "(`streamname`, `hour`, `province`, `isp`, `plays`) values" +
+		strings.Join(values, ",") +
+		d.upsertIncrement([]string{"streamname", "hour", "province", "isp"}, []string{"plays"})
+	if _, err := d.exec(ctx, sqlstr, params...); err != nil {
+		return fmt.Errorf("add geo plays count:%v err:%v", len(plays), err)
+	}
+	return nil
+}
+
+func (d *DBSync) SelectGeoPlays(ctx context.Context, streamName string, from, to int64) ([]*GeoPlays, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "select_geo")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `streamname`, `hour`, `province`, `isp`, `plays` from " + TABLE_NAME_VIEWER_GEO +
+		" where `streamname` = ? and `hour` >= ? and `hour` <= ? order by `hour`"
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr, streamName, from/GEO_BUCKET*GEO_BUCKET, to); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plays := make([]*GeoPlays, 0)
+	for rows.Next() {
+		var p GeoPlays
+		if err = rows.Scan(
+			&p.StreamName,
+			&p.Hour,
+			&p.Province,
+			&p.Isp,
+			&p.Plays); err != nil {
+			return nil, err
+		}
+		plays = append(plays, &p)
+	}
+	return plays, nil
+}
+
+func (d *DBSync) AddUsage(ctx context.Context, buckets []*UsageBucket) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(buckets))
+	params := make([]interface{}, 0, len(buckets)*6)
+	for _, b := range buckets {
+		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		params = append(params, b.Hour, b.StreamName, b.UserName, b.BusinessUnit, b.SendBytes, b.RecvBytes)
+	}
+	sqlstr := "insert into " + TABLE_NAME_USAGE + "(`hour`, `streamname`, `user`, `bu`, `send_bytes`, `recv_bytes`) values" +
+		strings.Join(values, ",") +
+		d.upsertIncrement([]string{"hour", "streamname"}, []string{"send_bytes", "recv_bytes"})
+	if _, err := d.exec(ctx, sqlstr, params...); err != nil {
+		return fmt.Errorf("add usage count:%v err:%v", len(buckets), err)
+	}
+	return nil
+}
+
+// column 只能是 usageGroupColumns 中的列名
+func (d *DBSync) SumUsage(ctx context.Context, column string, from, to int64) ([]*UsageReportRow, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "sum_usage")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `" + column + "`, sum(`send_bytes`), sum(`recv_bytes`) from " + TABLE_NAME_USAGE +
+		" where `hour` >= ? and `hour` < ? group by `" + column + "` order by `" + column + "`"
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr, from, to); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*UsageReportRow, 0)
+	for rows.Next() {
+		var row UsageReportRow
+		if err = rows.Scan(&row.Key, &row.SendBytes, &row.RecvBytes); err != nil {
+			return nil, err
+		}
+		result = append(result, &row)
+	}
+	return result, nil
+}
+
+func (d *DBSync) SelectHourlyUsage(ctx context.Context, column string, from, to int64) ([]*UsageHourly, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "select_usage")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `" + column + "`, `hour`, sum(`send_bytes`), sum(`recv_bytes`) from " + TABLE_NAME_USAGE +
+		" where `hour` >= ? and `hour` < ? group by `" + column + "`, `hour`"
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr, from, to); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*UsageHourly, 0)
+	for rows.Next() {
+		var row UsageHourly
+		if err = rows.Scan(&row.Key, &row.Hour, &row.SendBytes, &row.RecvBytes); err != nil {
+			return nil, err
+		}
+		result = append(result, &row)
+	}
+	return result, nil
+}
+
+func (d *DBSync) InsertAudits(ctx context.Context, entries []*AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(entries))
+	params := make([]interface{}, 0, len(entries)*8)
+	for _, e := range entries {
+		values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?)")
+		params = append(params, e.Time, e.Actor, e.Ip, e.Action, e.Target, e.Payload, e.Outcome, e.Reason)
+	}
+	sqlstr := "insert into " + TABLE_NAME_AUDIT + "(`time`, `actor`, `ip`, `action`, `target`, `payload`, `outcome`, `reason`) values" +
+		strings.Join(values, ",")
+	if _, err := d.exec(ctx, sqlstr, params...); err != nil {
+		return fmt.Errorf("insert audits count:%v err:%v", len(entries), err)
+	}
+	return nil
+}
+
+func (d *DBSync) SelectAudits(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "select_audits")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `id`, `time`, `actor`, `ip`, `action`, `target`, `payload`, `outcome`, `reason` from " + TABLE_NAME_AUDIT +
+		" where `time` >= ? and `time` < ?"
+	params := []interface{}{filter.From, filter.To}
+	for _, cond := range []struct{ column, value string }{
+		{"actor", filter.Actor},
+		{"action", filter.Action},
+		{"target", filter.Target},
+		{"outcome", filter.Outcome},
+	} {
+		if cond.value != "" {
+			sqlstr += " and `" + cond.column + "` = ?"
+			params = append(params, cond.value)
+		}
+	}
+	sqlstr += " order by `id` desc limit ?"
+	params = append(params, filter.Limit)
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr, params...); err != nil {
+		return nil, fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	defer rows.Close()
+
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		var e AuditEntry
+		if err = rows.Scan(&e.Id, &e.Time, &e.Actor, &e.Ip, &e.Action, &e.Target,
+			&e.Payload, &e.Outcome, &e.Reason); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+func (d *DBSync) DeleteAudits(ctx context.Context, before int64) error {
+	sqlstr := "delete from " + TABLE_NAME_AUDIT + " where `time` < ?"
+	if _, err := d.exec(ctx, sqlstr, before); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) InsertApiKey(ctx context.Context, key *ApiKey) (err error) {
+	sqlstr := "insert into " + TABLE_NAME_API_KEY + "(`name`, `keyhash`, `role`, `scopes`, `expiration`, `createtime`) values(?, ?, ?, ?, ?, ?)"
+	key.Id, err = d.insert(ctx, sqlstr, key.Name, key.KeyHash, key.Role,
+		strings.Join(key.Scopes, ","), key.Expiration, key.CreateTime)
+	return
+}
+
+func (d *DBSync) DeleteApiKey(ctx context.Context, id int64) error {
+	sqlstr := "delete from " + TABLE_NAME_API_KEY + " where id = ?"
+	if _, err := d.exec(ctx, sqlstr, id); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) LoadApiKeys(ctx context.Context) ([]*ApiKey, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "load_api_keys")
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `id`, `name`, `keyhash`, `role`, `scopes`, `expiration`, `createtime` from " + TABLE_NAME_API_KEY
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr); err != nil {
+		return nil, fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	defer rows.Close()
+
+	var keys []*ApiKey
+	for rows.Next() {
+		var (
+			key    ApiKey
+			scopes string
+		)
+		if err = rows.Scan(&key.Id, &key.Name, &key.KeyHash, &key.Role, &scopes,
+			&key.Expiration, &key.CreateTime); err != nil {
+			return nil, err
+		}
+		key.Scopes = ParseScopes(scopes)
+		keys = append(keys, &key)
+	}
+	return keys, nil
+}
+
+func (d *DBSync) InsertKickJob(ctx context.Context, job *KickJob) error {
+	sqlstr := "insert into " + TABLE_NAME_KICK_JOB + "(`id`, `streamname`, `host`, `clientid`, `target`, `status`, `attempts`, `lasterror`, `createtime`, `updatetime`) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	if _, err := d.exec(ctx, sqlstr, job.ID, job.StreamName, job.Host, job.ClientID, job.Target,
+		job.Status, job.Attempts, job.LastError, job.CreateTime, job.UpdateTime); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) UpdateKickJob(ctx context.Context, job *KickJob) error {
+	sqlstr := "update " + TABLE_NAME_KICK_JOB + " set `status` = ?, `attempts` = ?, `lasterror` = ?, `updatetime` = ? where id = ?"
+	if _, err := d.exec(ctx, sqlstr, job.Status, job.Attempts, job.LastError, job.UpdateTime, job.ID); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) LoadKickJobs(ctx context.Context, limit int) ([]*KickJob, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "load_kick_jobs")
+	return d.selectKickJobs(ctx, "order by `createtime` desc limit ?", limit)
+}
+
+func (d *DBSync) LoadUnfinishedKickJobs(ctx context.Context) ([]*KickJob, error) {
+	defer metrics.ObserveSince(METRIC_DB_QUERY_DURATION, time.Now(), "op", "load_unfinished_kick_jobs")
+	return d.selectKickJobs(ctx, "where `status` not in (?, ?) order by `createtime` desc",
+		KICK_JOB_DONE, KICK_JOB_FAILED)
+}
+
+func (d *DBSync) DeleteKickJobs(ctx context.Context, before int64) error {
+	sqlstr := "delete from " + TABLE_NAME_KICK_JOB + " where `status` in (?, ?) and `updatetime` < ?"
+	if _, err := d.exec(ctx, sqlstr, KICK_JOB_DONE, KICK_JOB_FAILED, before); err != nil {
+		return fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return nil
+}
+
+func (d *DBSync) selectKickJobs(ctx context.Context, cond string, args ...interface{}) ([]*KickJob, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	sqlstr := "select `id`, `streamname`, `host`, `clientid`, `target`, `status`, `attempts`, `lasterror`, `createtime`, `updatetime` from " +
+		TABLE_NAME_KICK_JOB + " " + cond
+
+	var rows *sql.Rows
+	if rows, err = d.db.QueryContext(ctx, sqlstr, args...); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*KickJob
+	for rows.Next() {
+		var job KickJob
+		if err = rows.Scan(
+			&job.ID,
+			&job.StreamName,
+			&job.Host,
+			&job.ClientID,
+			&job.Target,
+			&job.Status,
+			&job.Attempts,
+			&job.LastError,
+			&job.CreateTime,
+			&job.UpdateTime); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
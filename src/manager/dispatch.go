@@ -2,6 +2,7 @@ package manager
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,12 +19,11 @@ import (
 )
 
 const (
-	CT               = 0
-	CNC              = 1
-	CMCC             = 2
-	IspCount         = 3
-	BeijingId        = 0
-	InsizeAddrPrefix = "172."
+	CT        = 0
+	CNC       = 1
+	CMCC      = 2
+	IspCount  = 3
+	BeijingId = 0
 )
 
 type IpDatabase struct {
@@ -31,10 +31,13 @@ type IpDatabase struct {
 	Provinces      [31]*Province
 	ProvinceEncode map[string]int
 	inside         *InsideLive
+	configLock     sync.RWMutex
+	config         DispatchConfig
+	loop           Loop
 }
 
-func NewIpDatabase() (i *IpDatabase, err error) {
-	i = &IpDatabase{SubNets: make(map[string]*SubNet), inside: NewInsideLive()}
+func NewIpDatabase(config DispatchConfig) (i *IpDatabase, err error) {
+	i = &IpDatabase{SubNets: make(map[string]*SubNet), inside: NewInsideLive(), config: config}
 	i.ProvinceEncode = map[string]int{
 		"beijing":      0,
 		"guangdong":    1,
@@ -68,8 +71,7 @@ func NewIpDatabase() (i *IpDatabase, err error) {
 		"shandong":     29,
 		"jiangxi":      30,
 	}
-	//if err = i.LoadIpDatabase("../utils/isp.txt"); err != nil {
-	if err = i.LoadIpDatabase("src/utils/isp.txt"); err != nil {
+	if err = i.LoadIpDatabase(config.IpDatabase); err != nil {
 		return
 	}
 	i.initProvince()
@@ -90,17 +92,34 @@ func (i *IpDatabase) Contains(addr string) {
 	}
 }
 
+func (i *IpDatabase) Config() DispatchConfig {
+	i.configLock.RLock()
+	defer i.configLock.RUnlock()
+	return i.config
+}
+
+// 调度数量和阈值可以热加载 ip 库已经加载 路径不变
+func (i *IpDatabase) SetConfig(config DispatchConfig) {
+	i.configLock.Lock()
+	config.IpDatabase = i.config.IpDatabase
+	i.config = config
+	i.configLock.Unlock()
+}
+
 /*
   dispatch algorithm
 */
 func (i *IpDatabase) DisPatch(addr string, disType, count int) (servers []*SrsServer) {
-	if strings.HasPrefix(addr, InsizeAddrPrefix) {
-		return i.inside.dispatch(count, disType)
+	config := i.Config()
+	if strings.HasPrefix(addr, config.InsideAddrPrefix) {
+		servers = i.inside.dispatch(config, count, disType)
+		recordDispatch(DISPATCH_PROVINCE_INSIDE, DISPATCH_PROVINCE_INSIDE, servers)
+		return
 	}
 
 	net, err := i.GetSubNet(addr)
 	if err != nil {
-		net = &SubNet{IspType: CT, Province: "beijing", Id: BeijingId}
+		net = &SubNet{IspType: CT, SupperIsp: "ct", Province: "beijing", Id: BeijingId}
 	}
 	var p *Province
 	if net.Id < 0 || net.Id > 31 {
@@ -113,7 +132,17 @@ func (i *IpDatabase) DisPatch(addr string, disType, count int) (servers []*SrsSe
 		needIspType = CT
 	}
 
-	return p.dispatch(i, count, net.IspType, disType)
+	servers = p.dispatch(i, config, count, net.IspType, disType)
+	recordDispatch(net.Province, net.SupperIsp, servers)
+	return
+}
+
+func recordDispatch(province, isp string, servers []*SrsServer) {
+	result := DISPATCH_RESULT_OK
+	if len(servers) == 0 {
+		result = DISPATCH_RESULT_EMPTY
+	}
+	metrics.Inc(METRIC_DISPATCH_TOTAL, "province", province, "isp", isp, "result", result)
 }
 
 func (i *IpDatabase) AddServer(s *SrsServer) (err error) {
@@ -123,7 +152,7 @@ func (i *IpDatabase) AddServer(s *SrsServer) (err error) {
 	if addr, err = s.GetPublicAddr(); err != nil {
 		return err
 	}
-	if strings.HasPrefix(addr, InsizeAddrPrefix) {
+	if strings.HasPrefix(addr, i.Config().InsideAddrPrefix) {
 		return i.inside.AddServer(s)
 	}
 
@@ -192,14 +221,14 @@ func (p *Province) sortByLoad() {
 	}
 }
 
-func (p *Province) dispatch(i *IpDatabase, count, ispType, disType int) (servers []*SrsServer) {
+func (p *Province) dispatch(i *IpDatabase, config DispatchConfig, count, ispType, disType int) (servers []*SrsServer) {
 	servers = make([]*SrsServer, 0)
 	for _, d := range p.Target {
 		dp := i.Provinces[d.TargetId]
 		dispServers, lock := dp.getDispServers(ispType, disType)
 		lock.RLock()
 		for _, e := range dispServers {
-			if !e.IsAvaliable() {
+			if !e.IsAvaliable(config) {
 				continue
 			}
 			servers = append(servers, e)
@@ -382,18 +411,31 @@ func (i *IpDatabase) initProvince() {
 			}
 		}
 	}
-	go i.sort()
 }
 
-func (i *IpDatabase) sort() {
+// 按负载排序各省份的节点 -check-config 时只加载不启动
+func (i *IpDatabase) Start(ctx context.Context) {
+	i.loop.Start(ctx, i.sort)
+}
+
+func (i *IpDatabase) Stop(ctx context.Context) error {
+	return i.loop.Stop(ctx)
+}
+
+func (i *IpDatabase) sort(ctx context.Context) {
 	for _, p := range i.Provinces {
+		if p == nil {
+			continue
+		}
 		p.sortByLoad()
-		time.Sleep(time.Minute)
+		if !sleepContext(ctx, time.Minute) {
+			return
+		}
 	}
 }
 
 func main() {
-	i, err := NewIpDatabase()
+	i, err := NewIpDatabase(DefaultConfig().Dispatch)
 	if err != nil {
 		fmt.Println(err)
 		return
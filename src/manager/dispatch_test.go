@@ -6,7 +6,9 @@ import (
 )
 
 func TestIp(t *testing.T) {
-	i, err := NewIpDatabase()
+	config := DefaultConfig().Dispatch
+	config.IpDatabase = "../utils/isp.txt"
+	i, err := NewIpDatabase(config)
 	if err != nil {
 		t.Log(err)
 		t.FailNow()
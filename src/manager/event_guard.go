@@ -0,0 +1,156 @@
+package manager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	URL_PARAM_SIGN = "sign"
+)
+
+var (
+	ErrEventBadSign       = errors.New("callback sign mismatch")
+	ErrEventUnknownCaller = errors.New("callback caller is not a registered server")
+	ErrCallerAmbiguous    = errors.New("callback caller matches more than one server")
+)
+
+// 限制 /event 和 /server/heartbeat 的调用方
+// event.checkSource 开启时 调用方必须是已注册并且 ACTIVE 的节点 或者在 event.allowCidrs 内
+// event.secret 不为空时 回调地址需要带上 sign=hmac_sha256(secret, path)
+type EventGuard struct {
+	servers *ServerManager
+
+	lock   sync.RWMutex
+	check  bool
+	cidrs  []*net.IPNet
+	secret string
+}
+
+func NewEventGuard(config *Config, servers *ServerManager) (*EventGuard, error) {
+	g := &EventGuard{
+		servers: servers,
+		check:   config.Event.CheckSource,
+		secret:  config.Event.Secret,
+	}
+	var err error
+	if g.cidrs, err = ParseCidrs(config.Event.AllowCidrs); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// 逗号分隔 单个ip按 /32 处理 ipv6 按 /128
+func ParseCidrs(s string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() == nil {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %v", item)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+func EventSign(secret, path string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 回调直接来自 srs 只信任连接的地址 不取 X-REAL-IP
+func GetCallerIp(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// 热加载时使用 next 的配置
+func (g *EventGuard) Replace(next *EventGuard) {
+	g.lock.Lock()
+	g.check, g.cidrs, g.secret = next.check, next.cidrs, next.secret
+	g.lock.Unlock()
+}
+
+func (g *EventGuard) Verify(req *http.Request) error {
+	check, cidrs, err := g.verifySign(req)
+	if err != nil || !check {
+		return err
+	}
+	ip := GetCallerIp(req)
+	if len(g.servers.GetActiveServersByIp(ip)) > 0 || containsIp(cidrs, ip) {
+		return nil
+	}
+	return ErrEventUnknownCaller
+}
+
+// checkSource 开启并且 ip 不在 allowCidrs 内时 回调方必须是已注册的节点
+func (g *EventGuard) RequireCaller(ip string) bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.check && !containsIp(g.cidrs, ip)
+}
+
+// 心跳使用和回调一样的签名
+// checkSource 开启时 调用方必须在 allowCidrs 内 或者就是 addr 对应的已注册节点
+// 新节点只能从 allowCidrs 内自动注册
+func (g *EventGuard) VerifyHeartbeat(req *http.Request, addr string) error {
+	check, cidrs, err := g.verifySign(req)
+	if err != nil || !check {
+		return err
+	}
+	ip := GetCallerIp(req)
+	if containsIp(cidrs, ip) {
+		return nil
+	}
+	if svr := g.servers.GetServer(addr); svr != nil {
+		if host, err := svr.GetPublicAddr(); err == nil && host == ip {
+			return nil
+		}
+	}
+	return ErrEventUnknownCaller
+}
+
+// 返回是否需要检查调用方
+func (g *EventGuard) verifySign(req *http.Request) (bool, []*net.IPNet, error) {
+	g.lock.RLock()
+	check, cidrs, secret := g.check, g.cidrs, g.secret
+	g.lock.RUnlock()
+	if secret != "" {
+		sign := req.URL.Query().Get(URL_PARAM_SIGN)
+		if !hmac.Equal([]byte(sign), []byte(EventSign(secret, req.URL.Path))) {
+			return check, cidrs, ErrEventBadSign
+		}
+	}
+	return check, cidrs, nil
+}
+
+func containsIp(cidrs []*net.IPNet, ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, cidr := range cidrs {
+			if cidr.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventGuard(t *testing.T) {
+	db := NewMemStore()
+	servers := newServerManager(db, nil)
+	servers.servers[SERVER_TYPE_EDGE_UP]["1.2.3.4:1985"] = NewSrsServer("1.2.3.4:1985", "", SERVER_TYPE_EDGE_UP)
+	cidrs, err := ParseCidrs("10.0.0.0/8, 5.5.5.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := &EventGuard{servers: servers, check: true, cidrs: cidrs, secret: "s3cret"}
+	audit := NewAuditLog(DefaultConfig(), db)
+	event := &EventManager{db: db, servers: servers, guard: guard, bans: NewBanList(db),
+		referers: NewRefererRules(DefaultConfig(), db, audit), live: NewLiveHub(nil), audit: audit}
+
+	path := URL_PATH_EVENT + "/1.2.3.4/1985"
+	sign := EventSign("s3cret", path)
+	cases := []struct {
+		remote, query string
+		code          int
+	}{
+		{"1.2.3.4:5000", "?sign=" + sign, http.StatusOK},
+		{"10.1.2.3:5000", "?sign=" + sign, http.StatusOK},
+		{"5.5.5.5:5000", "?sign=" + sign, http.StatusOK},
+		{"6.6.6.6:5000", "?sign=" + sign, http.StatusForbidden},
+		{"1.2.3.4:5000", "?sign=bad", http.StatusForbidden},
+		{"1.2.3.4:5000", "", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		body := `{"action":"on_connect","client_id":1,"ip":"7.7.7.7"}`
+		req := httptest.NewRequest(HTTP_POST, path+c.query, strings.NewReader(body))
+		req.RemoteAddr = c.remote
+		req.Header.Set(HTTP_HEADER_CDN_IP, "1.2.3.4") // 回调不信任转发头
+		w := httptest.NewRecorder()
+		event.HttpHandler(w, req)
+		if w.Code != c.code {
+			t.Errorf("remote %v query %v got %v want %v", c.remote, c.query, w.Code, c.code)
+		}
+	}
+
+	if _, err = ParseCidrs("10.0.0.0/33"); err == nil {
+		t.Errorf("invalid cidr should fail")
+	}
+	// 单个 ipv6 地址只放行它自己
+	if cidrs, err = ParseCidrs("::1, 5.5.5.5"); err != nil {
+		t.Fatal(err)
+	}
+	if !containsIp(cidrs, "::1") || containsIp(cidrs, "::2") || containsIp(cidrs, "0:0:ffff::1") || containsIp(cidrs, "5.5.5.6") {
+		t.Errorf("single ip cidrs %v", cidrs)
+	}
+}
+
+// 心跳自动注册的节点在审核通过前不能发回调
+// ip 库按 classful 网段查找 这里用库中存在的 /24
+func TestEventGuardPendingServer(t *testing.T) {
+	db := NewMemStore()
+	servers := newServerManager(db, nil)
+	config := DefaultConfig().Dispatch
+	config.IpDatabase = "../utils/isp.txt"
+	var err error
+	if servers.ipDatabase, err = NewIpDatabase(config); err != nil {
+		t.Fatal(err)
+	}
+	svr, _, err := servers.Heartbeat(context.Background(), ReqHeartbeat{Addr: "202.97.25.10:1985", Role: STR_TYPE_EDGE_UP})
+	if err != nil || svr.GetStatus() != SERVER_STATUS_PENDING {
+		t.Fatalf("heartbeat register %v err:%v", svr, err)
+	}
+	guard := &EventGuard{servers: servers, check: true}
+	audit := NewAuditLog(DefaultConfig(), db)
+	event := &EventManager{db: db, servers: servers, guard: guard, bans: NewBanList(db),
+		referers: NewRefererRules(DefaultConfig(), db, audit), live: NewLiveHub(nil), audit: audit}
+
+	publish := func() int {
+		body := `{"action":"on_publish","client_id":1,"ip":"7.7.7.7","stream":"s1"}`
+		req := httptest.NewRequest(HTTP_POST, URL_PATH_EVENT+"/202.97.25.10/1985", strings.NewReader(body))
+		req.RemoteAddr = "202.97.25.10:5000"
+		w := httptest.NewRecorder()
+		event.HttpHandler(w, req)
+		return w.Code
+	}
+	if code := publish(); code != http.StatusForbidden {
+		t.Errorf("pending server callback got %v", code)
+	}
+	if _, err = servers.FindCaller("202.97.25.10", []string{"202.97.25.10", "1985"}); err != ErrEventUnknownCaller {
+		t.Errorf("pending server should not be a caller %v", err)
+	}
+	svr.SetStatus(SERVER_STATUS_ACTIVE)
+	if _, err = servers.FindCaller("202.97.25.10", []string{"202.97.25.10", "1985"}); err != nil {
+		t.Errorf("active server caller %v", err)
+	}
+}
+
+func TestHeartbeatGuard(t *testing.T) {
+	db := NewMemStore()
+	servers := newServerManager(db, NewAuditLog(DefaultConfig(), db))
+	config := DefaultConfig().Dispatch
+	config.IpDatabase = "../utils/isp.txt"
+	var err error
+	if servers.ipDatabase, err = NewIpDatabase(config); err != nil {
+		t.Fatal(err)
+	}
+	cidrs, _ := ParseCidrs("10.0.0.0/8")
+	servers.guard = &EventGuard{servers: servers, check: true, cidrs: cidrs, secret: "s3cret"}
+
+	sign := "?sign=" + EventSign("s3cret", URL_PATH_SERVER_HEARTBEAT)
+	cases := []struct {
+		remote, addr, query string
+		code                int
+	}{
+		{"6.6.6.6:5000", "202.97.25.10:1985", sign, http.StatusForbidden}, // 不在 allowCidrs 内不能注册
+		{"10.1.1.1:5000", "202.97.25.10:1985", "", http.StatusForbidden},  // 没有签名
+		{"10.1.1.1:5000", "202.97.25.10:1985", sign, http.StatusOK},
+		{"202.97.25.10:5000", "202.97.25.10:1985", sign, http.StatusOK},   // 节点自己
+		{"6.6.6.6:5000", "202.97.25.10:1985", sign, http.StatusForbidden}, // 不能替别的节点上报
+	}
+	for _, c := range cases {
+		body := `{"addr":"` + c.addr + `","role":"up","capacity":1}`
+		req := httptest.NewRequest(HTTP_POST, URL_PATH_SERVER_HEARTBEAT+c.query, strings.NewReader(body))
+		req.RemoteAddr = c.remote
+		w := httptest.NewRecorder()
+		servers.HttpHandler(w, req)
+		if w.Code != c.code {
+			t.Errorf("remote %v addr %v query %v got %v want %v", c.remote, c.addr, c.query, w.Code, c.code)
+		}
+	}
+}
+
+// 没有开启 checkSource 或者回调方在 allowCidrs 内但没有注册时 按参数中的节点推流
+func TestPublishCallerFallback(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	servers := newServerManager(db, nil)
+	svr := NewSrsServer("1.2.3.4:1985", "", SERVER_TYPE_EDGE_UP)
+	servers.servers[SERVER_TYPE_EDGE_UP][svr.Addr] = svr
+	cidrs, _ := ParseCidrs("10.0.0.0/8")
+	guard := &EventGuard{servers: servers, cidrs: cidrs}
+	event := &EventManager{db: db, servers: servers, guard: guard, bans: NewBanList(db), live: NewLiveHub(nil)}
+	db.InsertRoom(ctx, &Room{StreamName: "s1", Status: ROOM_CREATE, Expiration: time.Now().Unix() + 60})
+
+	publish := func(caller string, args ...string) error {
+		return event.OnPublish(ctx, ConnectInfo{StreamName: "s1", ClientID: 1, Args: args, Caller: caller})
+	}
+	cases := []struct {
+		check  bool
+		caller string
+		args   []string
+		ok     bool
+	}{
+		{false, "9.9.9.9", []string{"1.2.3.4", "1985"}, true},  // 回调地址和注册地址不同
+		{false, "9.9.9.9", []string{"6.6.6.6", "1985"}, false}, // 参数中的节点没有注册
+		{true, "10.1.1.1", []string{"1.2.3.4", "1985"}, true},  // allowCidrs 内
+		{true, "9.9.9.9", []string{"1.2.3.4", "1985"}, false},
+		{true, "1.2.3.4", []string{"6.6.6.6", "1985"}, true}, // 已注册的回调方
+	}
+	for _, c := range cases {
+		guard.check = c.check
+		if err := publish(c.caller, c.args...); (err == nil) != c.ok {
+			t.Errorf("check:%v caller:%v args:%v got %v", c.check, c.caller, c.args, err)
+		}
+	}
+}
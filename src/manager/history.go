@@ -0,0 +1,393 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	HISTORY_RESOLUTION    = 10 // 秒 内存中的采样间隔
+	HISTORY_RING_SIZE     = 360
+	HISTORY_RING_WINDOW   = HISTORY_RING_SIZE * HISTORY_RESOLUTION
+	HISTORY_ROLLUP_MINUTE = 60
+	HISTORY_ROLLUP_HOUR   = 3600
+
+	DefaultHistoryMinuteDays = 7
+	DefaultHistoryHourDays   = 90
+
+	HISTORY_SERIES_SERVER    = "server"
+	HISTORY_SERIES_STREAM    = "stream"
+	HISTORY_SERIES_SEPARATOR = "|"
+
+	HISTORY_DEFAULT_DURATION  = 3600
+	HISTORY_MAX_QUERY_RESULTS = 10000
+)
+
+var (
+	serverHistoryMetrics = map[string]func(sys utils.SystemInfo) float64{
+		"cpu":      func(sys utils.SystemInfo) float64 { return sys.CPUPercent },
+		"load_1m":  func(sys utils.SystemInfo) float64 { return sys.Load1m },
+		"net_send": func(sys utils.SystemInfo) float64 { return float64(sys.NetSend) },
+		"net_recv": func(sys utils.SystemInfo) float64 { return float64(sys.NetRecv) },
+		"conn_srs": func(sys utils.SystemInfo) float64 { return float64(sys.ConnSrs) },
+	}
+	streamHistoryMetrics = map[string]func(st utils.Stream) float64{
+		"clients":   func(st utils.Stream) float64 { return float64(st.ClientNum) },
+		"kbps_recv": func(st utils.Stream) float64 { return float64(st.Kbps.Recv30s) },
+		"kbps_send": func(st utils.Stream) float64 { return float64(st.Kbps.Send30s) },
+	}
+)
+
+type HistoryPoint struct {
+	Time  int64
+	Value float64
+}
+
+// 持久化的降采样数据
+type HistoryRollup struct {
+	Series     string
+	Resolution int
+	Time       int64
+	Avg        float64
+	Min        float64
+	Max        float64
+}
+
+// 固定长度的环形缓冲 保存最近一小时的10s采样
+type historyRing struct {
+	points [HISTORY_RING_SIZE]HistoryPoint
+	next   int
+	count  int
+}
+
+func (r *historyRing) add(p HistoryPoint) {
+	r.points[r.next] = p
+	r.next = (r.next + 1) % HISTORY_RING_SIZE
+	if r.count < HISTORY_RING_SIZE {
+		r.count++
+	}
+}
+
+// 最近一个点的时间
+func (r *historyRing) last() int64 {
+	if r.count == 0 {
+		return 0
+	}
+	return r.points[(r.next-1+HISTORY_RING_SIZE)%HISTORY_RING_SIZE].Time
+}
+
+// 按时间顺序返回 [from, to] 内的点
+func (r *historyRing) rangeOf(from, to int64) []HistoryPoint {
+	result := make([]HistoryPoint, 0)
+	start := (r.next - r.count + HISTORY_RING_SIZE) % HISTORY_RING_SIZE
+	for i := 0; i < r.count; i++ {
+		p := r.points[(start+i)%HISTORY_RING_SIZE]
+		if p.Time >= from && p.Time <= to {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+type HistoryStore struct {
+	db            Store
+	serverManager *ServerManager
+	loop          Loop
+
+	lock   sync.RWMutex
+	series map[string]*historyRing
+	// 每种降采样最近写入的桶 只在 Run 中访问
+	rolled map[int]int64
+
+	minuteRetention int64
+	hourRetention   int64
+}
+
+func NewHistoryStore(config *Config, db Store, serverManager *ServerManager) *HistoryStore {
+	h := &HistoryStore{
+		db:            db,
+		serverManager: serverManager,
+		series:        make(map[string]*historyRing),
+		rolled:        make(map[int]int64),
+	}
+	h.ApplyConfig(config)
+	return h
+}
+
+func (h *HistoryStore) ApplyConfig(config *Config) {
+	h.lock.Lock()
+	h.minuteRetention = int64(config.History.MinuteRetentionDays) * 24 * 3600
+	h.hourRetention = int64(config.History.HourRetentionDays) * 24 * 3600
+	h.lock.Unlock()
+}
+
+func ServerSeriesKey(addr, metric string) string {
+	return strings.Join([]string{HISTORY_SERIES_SERVER, addr, metric}, HISTORY_SERIES_SEPARATOR)
+}
+
+func StreamSeriesKey(typeName, app, name, metric string) string {
+	return strings.Join([]string{HISTORY_SERIES_STREAM, typeName, app + "/" + name, metric},
+		HISTORY_SERIES_SEPARATOR)
+}
+
+func (h *HistoryStore) Add(key string, p HistoryPoint) {
+	h.lock.Lock()
+	r, ok := h.series[key]
+	if !ok {
+		r = &historyRing{}
+		h.series[key] = r
+	}
+	r.add(p)
+	h.lock.Unlock()
+}
+
+func (h *HistoryStore) Range(key string, from, to int64) []HistoryPoint {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if r, ok := h.series[key]; ok {
+		return r.rangeOf(from, to)
+	}
+	return []HistoryPoint{}
+}
+
+func (h *HistoryStore) Start(ctx context.Context) {
+	h.loop.Start(ctx, h.Run)
+}
+
+func (h *HistoryStore) Stop(ctx context.Context) error {
+	return h.loop.Stop(ctx)
+}
+
+func (h *HistoryStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(HISTORY_RESOLUTION * time.Second)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		h.tick(now.Unix() / HISTORY_RESOLUTION * HISTORY_RESOLUTION)
+	}
+}
+
+func (h *HistoryStore) tick(ts int64) {
+	h.sample(ts)
+	h.rollupDue(ts, HISTORY_ROLLUP_MINUTE)
+	if h.rollupDue(ts, HISTORY_ROLLUP_HOUR) {
+		h.expire(ts)
+	}
+	h.prune(ts)
+}
+
+// 从上次写入的桶开始补齐到 ts 所在的桶 ticker 延迟时不会跳过或者重复
+// 启动后的第一个桶数据不完整 从下一个桶开始
+func (h *HistoryStore) rollupDue(ts int64, resolution int) bool {
+	res := int64(resolution)
+	bucket := ts / res * res
+	last, ok := h.rolled[resolution]
+	if !ok {
+		h.rolled[resolution] = bucket
+		return false
+	}
+	// 内存中只有最近一小时的点
+	if oldest := bucket - HISTORY_RING_WINDOW; last < oldest {
+		last = oldest
+	}
+	rolled := last+res <= bucket
+	for last+res <= bucket {
+		last += res
+		h.rollup(last, resolution)
+	}
+	h.rolled[resolution] = last
+	return rolled
+}
+
+// 超过一个环形缓冲窗口没有新数据的 series 已经降采样完 不再保留
+func (h *HistoryStore) prune(ts int64) {
+	h.lock.Lock()
+	for key, r := range h.series {
+		if ts-r.last() >= HISTORY_RING_WINDOW {
+			delete(h.series, key)
+		}
+	}
+	h.lock.Unlock()
+}
+
+// 从当前拉取到的srs数据中采样 同一个流在同类节点上的数据求和
+func (h *HistoryStore) sample(ts int64) {
+	for _, typeName := range []string{STR_TYPE_EDGE_UP, STR_TYPE_EDGE_DOWN, STR_TYPE_ORIGIN} {
+		streams := make(map[string]float64)
+		for _, svr := range h.serverManager.getServerList(typeName) {
+			sys := svr.GetSummary().Data.Sys
+			for metric, fn := range serverHistoryMetrics {
+				h.Add(ServerSeriesKey(svr.Addr, metric), HistoryPoint{Time: ts, Value: fn(sys)})
+			}
+			for _, st := range svr.GetStreams().Streams {
+				for metric, fn := range streamHistoryMetrics {
+					streams[StreamSeriesKey(typeName, st.AppName, st.Name, metric)] += fn(st)
+				}
+			}
+		}
+		for key, v := range streams {
+			h.Add(key, HistoryPoint{Time: ts, Value: v})
+		}
+	}
+}
+
+// 把 (ts-resolution, ts] 内的点降采样后写db
+func (h *HistoryStore) rollup(ts int64, resolution int) {
+	h.lock.RLock()
+	rollups := make([]*HistoryRollup, 0, len(h.series))
+	for key, r := range h.series {
+		points := r.rangeOf(ts-int64(resolution)+1, ts)
+		if len(points) == 0 {
+			continue
+		}
+		ru := &HistoryRollup{Series: key, Resolution: resolution, Time: ts - int64(resolution),
+			Min: points[0].Value, Max: points[0].Value}
+		for _, p := range points {
+			ru.Avg += p.Value
+			if p.Value < ru.Min {
+				ru.Min = p.Value
+			}
+			if p.Value > ru.Max {
+				ru.Max = p.Value
+			}
+		}
+		ru.Avg /= float64(len(points))
+		rollups = append(rollups, ru)
+	}
+	h.lock.RUnlock()
+
+	if err := h.db.InsertHistoryRollups(context.Background(), rollups); err != nil {
+		glog.Warningln("HistoryStore rollup", resolution, err)
+	}
+}
+
+func (h *HistoryStore) expire(ts int64) {
+	h.lock.RLock()
+	minuteRetention, hourRetention := h.minuteRetention, h.hourRetention
+	h.lock.RUnlock()
+	if err := h.db.DeleteHistoryRollups(context.Background(), HISTORY_ROLLUP_MINUTE, ts-minuteRetention); err != nil {
+		glog.Warningln("HistoryStore expire minute", err)
+	}
+	if err := h.db.DeleteHistoryRollups(context.Background(), HISTORY_ROLLUP_HOUR, ts-hourRetention); err != nil {
+		glog.Warningln("HistoryStore expire hour", err)
+	}
+}
+
+// 一小时内并且step小于1分钟的查询走内存 其余按step选择分钟或者小时的降采样数据
+func (h *HistoryStore) Query(ctx context.Context, key string, from, to int64, step int) ([]HistoryPoint, error) {
+	if step < HISTORY_RESOLUTION {
+		step = HISTORY_RESOLUTION
+	}
+	if (to-from)/int64(step) > HISTORY_MAX_QUERY_RESULTS {
+		return nil, fmt.Errorf("too many points from:%v to:%v step:%v", from, to, step)
+	}
+
+	var points []HistoryPoint
+	if step < HISTORY_ROLLUP_MINUTE && from >= time.Now().Unix()-HISTORY_RING_WINDOW {
+		points = h.Range(key, from, to)
+	} else {
+		resolution := HISTORY_ROLLUP_MINUTE
+		if step >= HISTORY_ROLLUP_HOUR {
+			resolution = HISTORY_ROLLUP_HOUR
+		}
+		rollups, err := h.db.SelectHistoryRollups(ctx, key, resolution, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, ru := range rollups {
+			points = append(points, HistoryPoint{Time: ru.Time, Value: ru.Avg})
+		}
+	}
+	return downsample(points, step), nil
+}
+
+// 按step分桶求平均
+func downsample(points []HistoryPoint, step int) []HistoryPoint {
+	buckets := make(map[int64][]float64)
+	for _, p := range points {
+		t := p.Time / int64(step) * int64(step)
+		buckets[t] = append(buckets[t], p.Value)
+	}
+	result := make([]HistoryPoint, 0, len(buckets))
+	for t, values := range buckets {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		result = append(result, HistoryPoint{Time: t, Value: sum / float64(len(values))})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time < result[j].Time })
+	return result
+}
+
+// /history/server/{addr}?metric=net_send&from=&to=&step=
+// /history/stream/{app}/{name}?type=origin&metric=clients&from=&to=&step=
+func (h *HistoryStore) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	args := GetUrlParams(r.URL.Path, URL_PATH_HISTORY)
+	query := r.URL.Query()
+	now := time.Now().Unix()
+	from := parseInt64(query.Get("from"), now-HISTORY_DEFAULT_DURATION)
+	to := parseInt64(query.Get("to"), now)
+	step := int(parseInt64(query.Get("step"), HISTORY_RESOLUTION))
+	metric := query.Get("metric")
+
+	var key string
+	switch {
+	case len(args) == 2 && args[0] == HISTORY_SERIES_SERVER:
+		if metric == "" {
+			metric = "net_send"
+		}
+		if _, ok := serverHistoryMetrics[metric]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key = ServerSeriesKey(args[1], metric)
+	case len(args) == 3 && args[0] == HISTORY_SERIES_STREAM:
+		if metric == "" {
+			metric = "clients"
+		}
+		typeName := query.Get("type")
+		if typeName == "" {
+			typeName = STR_TYPE_ORIGIN
+		}
+		if _, ok := streamHistoryMetrics[metric]; !ok || h.serverManager.getTypeByName(typeName) < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key = StreamSeriesKey(typeName, args[1], args[2], metric)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	points, err := h.Query(r.Context(), key, from, to, step)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		glog.Warningln("HistoryStore Query", key, err)
+		return
+	}
+	if err = utils.WriteObjectResponse(w, points); err != nil {
+		glog.Warningln("HistoryStore writeRespons err", err)
+	}
+}
+
+func parseInt64(s string, def int64) int64 {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHistoryRingWrap(t *testing.T) {
+	var r historyRing
+	for i := 0; i < HISTORY_RING_SIZE+5; i++ {
+		r.add(HistoryPoint{Time: int64(i * HISTORY_RESOLUTION), Value: float64(i)})
+	}
+	points := r.rangeOf(0, 1<<62)
+	if len(points) != HISTORY_RING_SIZE {
+		t.Fatalf("got %d points", len(points))
+	}
+	if points[0].Value != 5 || points[len(points)-1].Value != HISTORY_RING_SIZE+4 {
+		t.Errorf("unexpected order first:%v last:%v", points[0], points[len(points)-1])
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	points := []HistoryPoint{{0, 1}, {10, 3}, {60, 10}, {70, 20}}
+	result := downsample(points, 60)
+	if len(result) != 2 || result[0].Value != 2 || result[1].Time != 60 || result[1].Value != 15 {
+		t.Errorf("downsample got %v", result)
+	}
+}
+
+// ticker 延迟跳过的桶补写 同一个桶不重复写 空闲的 series 降采样后删除
+func TestHistoryRollupAndPrune(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	h := NewHistoryStore(DefaultConfig(), db, newServerManager(db, nil))
+	h.Add("a", HistoryPoint{Time: 1000, Value: 1})
+	h.tick(1000)
+	h.Add("a", HistoryPoint{Time: 1010, Value: 2})
+	h.Add("a", HistoryPoint{Time: 1030, Value: 4})
+	h.tick(1090)
+	h.tick(1090)
+	got, _ := db.SelectHistoryRollups(ctx, "a", HISTORY_ROLLUP_MINUTE, 0, 2000)
+	if len(got) != 2 || got[0].Time != 960 || got[0].Avg != 1.5 || got[1].Time != 1020 || got[1].Avg != 4 {
+		t.Fatalf("minute rollups got %v", got)
+	}
+
+	h.tick(5000)
+	if hours, _ := db.SelectHistoryRollups(ctx, "a", HISTORY_ROLLUP_HOUR, 0, 5000); len(hours) != 1 || hours[0].Max != 4 {
+		t.Errorf("hour rollups got %v", hours)
+	}
+	h.lock.RLock()
+	n := len(h.series)
+	h.lock.RUnlock()
+	if n != 0 {
+		t.Errorf("idle series not pruned %v", n)
+	}
+}
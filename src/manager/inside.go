@@ -53,7 +53,7 @@ func (p *InsideLive) sortByLoad() {
 	}
 }
 
-func (p *InsideLive) dispatch(count, disType int) (servers []*SrsServer) {
+func (p *InsideLive) dispatch(c DispatchConfig, count, disType int) (servers []*SrsServer) {
 	servers = make([]*SrsServer, 0)
 	for i := 0; i < 5; i++ {
 		needCount := count / IdcCount
@@ -67,7 +67,7 @@ func (p *InsideLive) dispatch(count, disType int) (servers []*SrsServer) {
 					notExsit = true
 				}
 			}
-			if !notExsit && s.IsAvaliable() {
+			if !notExsit && s.IsAvaliable(c) {
 				servers = append(servers, s)
 				start++
 			}
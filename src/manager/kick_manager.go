@@ -0,0 +1,422 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	KICK_JOB_PENDING = iota // 等待执行
+	KICK_JOB_RUNNING        // 正在重试
+	KICK_JOB_DONE           // 已经确认踢掉
+	KICK_JOB_FAILED         // 重试次数用完 放弃
+)
+
+const (
+	KICK_TARGET_PUBLISHER = iota // 推流端 通过streams接口确认
+	KICK_TARGET_VIEWER           // 播放端 通过clients接口确认
+)
+
+const (
+	DefaultKickMaxAttempts   = 5
+	DefaultKickBackoff       = time.Second
+	DefaultKickRetentionDays = 7
+	KICK_EXPIRE_INTERVAL     = time.Hour
+	KICK_VERIFY_DELAY        = time.Second
+	KICK_JOB_HISTORY         = 1000
+	KICK_ERROR_MAX           = 1024
+)
+
+type KickJob struct {
+	ID         string
+	StreamName string
+	Host       string
+	ClientID   int
+	Target     int
+	Status     int
+	Attempts   int
+	LastError  string
+	CreateTime int64
+	UpdateTime int64
+
+	onDone func(job KickJob)
+}
+
+func (j *KickJob) Finished() bool {
+	return j.Status == KICK_JOB_DONE || j.Status == KICK_JOB_FAILED
+}
+
+// 踢人任务 失败后退避重试 并确认客户端确实已经断开
+// 任务写库 重启后由 Load 加载 未完成的任务继续执行 已完成的任务按 retention 清理
+// Start 之前提交的任务先排队 Stop 取消后等待所有任务退出
+type KickManager struct {
+	db          Store
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	queued      []*KickJob
+	lock        sync.RWMutex
+	jobs        map[string]*KickJob
+	order       []string
+	maxAttempts int
+	backoff     time.Duration
+	retention   int64
+}
+
+func NewKickManager(config *Config, db Store) *KickManager {
+	k := &KickManager{
+		db:   db,
+		jobs: make(map[string]*KickJob),
+	}
+	k.ApplyConfig(config)
+	return k
+}
+
+// 只影响之后提交的任务
+func (k *KickManager) ApplyConfig(config *Config) {
+	k.lock.Lock()
+	k.maxAttempts = config.Kick.MaxAttempts
+	k.backoff = config.Kick.Backoff.Duration
+	k.retention = int64(config.Kick.RetentionDays) * 24 * 3600
+	k.lock.Unlock()
+}
+
+// 提交任务 onDone在任务确认成功或者放弃时调用
+func (k *KickManager) Submit(streamName, host string, clientID, target int,
+	onDone func(job KickJob)) KickJob {
+	now := time.Now().Unix()
+	job := &KickJob{
+		ID:         utils.GenerateUuid(),
+		StreamName: streamName,
+		Host:       host,
+		ClientID:   clientID,
+		Target:     target,
+		Status:     KICK_JOB_PENDING,
+		CreateTime: now,
+		UpdateTime: now,
+		onDone:     onDone,
+	}
+
+	if err := k.db.InsertKickJob(context.Background(), job); err != nil {
+		glog.Warningln("KickManager InsertKickJob", job.ID, err)
+	}
+	k.lock.Lock()
+	k.add(job)
+	snapshot := *job
+	k.lock.Unlock()
+
+	glog.Infoln("KickManager submit", job.ID, streamName, host, clientID)
+	k.start(job)
+	return snapshot
+}
+
+// 超过 KICK_JOB_HISTORY 时淘汰最早的已完成任务 未完成的任务一直保留
+func (k *KickManager) add(job *KickJob) {
+	k.jobs[job.ID] = job
+	k.order = append(k.order, job.ID)
+	if len(k.order) <= KICK_JOB_HISTORY {
+		return
+	}
+	for i, id := range k.order {
+		if k.jobs[id].Finished() {
+			delete(k.jobs, id)
+			k.order = append(k.order[:i], k.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// 启动时加载最近的任务和所有未完成的任务 返回未完成的任务 由调用方决定回调后 Resume
+func (k *KickManager) Load(ctx context.Context) ([]KickJob, error) {
+	jobs, err := k.db.LoadKickJobs(ctx, KICK_JOB_HISTORY)
+	if err != nil {
+		return nil, fmt.Errorf("Load kick jobs error:%v", err)
+	}
+	pending, err := k.db.LoadUnfinishedKickJobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Load unfinished kick jobs error:%v", err)
+	}
+	var unfinished []KickJob
+	k.lock.Lock()
+	for _, list := range [][]*KickJob{pending, jobs} {
+		for i := len(list) - 1; i >= 0; i-- {
+			if _, ok := k.jobs[list[i].ID]; ok {
+				continue
+			}
+			k.add(list[i])
+			if !list[i].Finished() {
+				unfinished = append(unfinished, *list[i])
+			}
+		}
+	}
+	k.lock.Unlock()
+	return unfinished, nil
+}
+
+// 继续执行 Load 返回的任务
+func (k *KickManager) Resume(id string, onDone func(job KickJob)) {
+	k.lock.Lock()
+	job, ok := k.jobs[id]
+	if ok {
+		job.onDone = onDone
+	}
+	k.lock.Unlock()
+	if ok {
+		glog.Infoln("KickManager resume", job.ID, job.StreamName, job.Host, job.ClientID)
+		k.start(job)
+	}
+}
+
+func (k *KickManager) Start(ctx context.Context) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.ctx != nil {
+		return
+	}
+	k.ctx, k.cancel = context.WithCancel(ctx)
+	for _, job := range k.queued {
+		k.goRun(job)
+	}
+	k.queued = nil
+
+	k.wg.Add(1)
+	go func(ctx context.Context) {
+		defer k.wg.Done()
+		k.expireLoop(ctx)
+	}(k.ctx)
+}
+
+// 启动时清理一次 之后每 KICK_EXPIRE_INTERVAL 清理一次
+func (k *KickManager) expireLoop(ctx context.Context) {
+	ticker := time.NewTicker(KICK_EXPIRE_INTERVAL)
+	defer ticker.Stop()
+	k.expire(time.Now().Unix())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			k.expire(now.Unix())
+		}
+	}
+}
+
+// 库里和内存里都只删除已完成的任务
+func (k *KickManager) expire(now int64) {
+	k.lock.Lock()
+	before := now - k.retention
+	kept := k.order[:0]
+	for _, id := range k.order {
+		if job := k.jobs[id]; job.Finished() && job.UpdateTime < before {
+			delete(k.jobs, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	k.order = kept
+	k.lock.Unlock()
+	if err := k.db.DeleteKickJobs(context.Background(), before); err != nil {
+		glog.Warningln("KickManager DeleteKickJobs", err)
+	}
+}
+
+// 取消后任务保持未完成状态 下次启动时继续
+func (k *KickManager) Stop(ctx context.Context) error {
+	k.lock.Lock()
+	cancel := k.cancel
+	k.lock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		k.wg.Wait()
+		close(done)
+	}()
+	return waitDone(ctx, done)
+}
+
+func (k *KickManager) start(job *KickJob) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.ctx == nil {
+		k.queued = append(k.queued, job)
+	} else if k.ctx.Err() == nil {
+		k.goRun(job)
+	}
+}
+
+// 持有 k.lock 调用 停止之后不再启动新的任务
+func (k *KickManager) goRun(job *KickJob) {
+	ctx := k.ctx
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		k.run(ctx, job)
+	}()
+}
+
+// 进行中的任务 同一个客户端不重复提交
+func (k *KickManager) Active(streamName string, target int) (KickJob, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	for _, job := range k.jobs {
+		if job.StreamName == streamName && job.Target == target && !job.Finished() {
+			return *job, true
+		}
+	}
+	return KickJob{}, false
+}
+
+func (k *KickManager) run(ctx context.Context, job *KickJob) {
+	k.lock.RLock()
+	backoff, maxAttempts, attempts := k.backoff, k.maxAttempts, job.Attempts
+	k.lock.RUnlock()
+	// 重启后继续执行的任务接着之前的次数
+	status := KICK_JOB_FAILED
+	for i := attempts; i < maxAttempts; i++ {
+		err := k.kickOnce(ctx, job)
+		if ctx.Err() != nil {
+			return
+		}
+		k.update(job, func(j *KickJob) {
+			j.Status = KICK_JOB_RUNNING
+			j.Attempts = i + 1
+			j.LastError = ""
+			if err != nil {
+				j.LastError = truncate(err.Error(), KICK_ERROR_MAX)
+			}
+		})
+		if err == nil {
+			status = KICK_JOB_DONE
+			break
+		}
+		glog.Warningln("KickManager attempt", job.ID, i+1, err)
+		if !sleepContext(ctx, backoff) {
+			return
+		}
+		backoff *= 2
+	}
+
+	var snapshot KickJob
+	k.update(job, func(j *KickJob) {
+		j.Status = status
+		snapshot = *j
+	})
+	if status == KICK_JOB_FAILED {
+		glog.Warningln("KickManager give up", job.ID, job.StreamName, job.Host, job.ClientID)
+	}
+	if job.onDone != nil {
+		job.onDone(snapshot)
+	}
+}
+
+// 踢一次 然后确认客户端已经不在srs上
+func (k *KickManager) kickOnce(ctx context.Context, job *KickJob) error {
+	rsp, err := utils.KickOffClient(ctx, job.Host, job.ClientID)
+	if err != nil {
+		glog.Warningln("KickOffClient", job.Host, job.ClientID, err)
+	} else if rsp.Code != 0 {
+		glog.Warningln("KickOffClient", job.Host, job.ClientID, "code", rsp.Code)
+	}
+
+	// 返回码不可信 客户端可能已经断开 以确认结果为准
+	if !sleepContext(ctx, KICK_VERIFY_DELAY) {
+		return ctx.Err()
+	}
+	var gone bool
+	if gone, err = k.verify(ctx, job); err != nil {
+		return fmt.Errorf("verify err:%v", err)
+	} else if !gone {
+		return fmt.Errorf("client %v still on %v", job.ClientID, job.Host)
+	}
+	return nil
+}
+
+func (k *KickManager) verify(ctx context.Context, job *KickJob) (bool, error) {
+	if job.Target == KICK_TARGET_VIEWER {
+		clients, err := utils.GetAllClients(ctx, job.Host)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range clients {
+			if c.ID == job.ClientID {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	streams, err := utils.GetAllStreams(ctx, job.Host)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range streams {
+		if s.Name == job.StreamName && s.Publish.Active && s.Publish.CID == job.ClientID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (k *KickManager) update(job *KickJob, fn func(j *KickJob)) {
+	k.lock.Lock()
+	fn(job)
+	job.UpdateTime = time.Now().Unix()
+	snapshot := *job
+	k.lock.Unlock()
+	if err := k.db.UpdateKickJob(context.Background(), &snapshot); err != nil {
+		glog.Warningln("KickManager UpdateKickJob", job.ID, err)
+	}
+}
+
+func (k *KickManager) Get(id string) (KickJob, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if job, ok := k.jobs[id]; ok {
+		return *job, true
+	}
+	return KickJob{}, false
+}
+
+func (k *KickManager) List(streamName string) []KickJob {
+	k.lock.RLock()
+	result := make([]KickJob, 0)
+	for _, job := range k.jobs {
+		if streamName == "" || job.StreamName == streamName {
+			result = append(result, *job)
+		}
+	}
+	k.lock.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreateTime > result[j].CreateTime
+	})
+	return result
+}
+
+// /kick?stream=xxx
+// /kick/{jobId}
+func (k *KickManager) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	args := GetUrlParams(r.URL.Path, URL_PATH_KICK)
+	var result interface{}
+	if args[0] == "" {
+		result = k.List(r.URL.Query().Get("stream"))
+	} else if job, ok := k.Get(args[0]); ok {
+		result = job
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := utils.WriteObjectResponse(w, result); err != nil {
+		glog.Warningln("KickManager writeRespons err", err)
+	}
+}
@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// 关闭中的 room 再次踢人返回进行中的任务 不能直接关闭
+// 重启后没有任务的 CLOSING room 重新提交
+func TestKickoffClosingRoom(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	config := DefaultConfig()
+	kicks := NewKickManager(config, db)
+	room := &RoomManager{db: db, kicks: kicks, live: NewLiveHub(nil)}
+	db.InsertRoom(ctx, &Room{StreamName: "s1", Status: ROOM_PUBLISH, PublishHost: "127.0.0.1:1", PublishClientId: 1})
+
+	first, err := room.KickoffRoom(ctx, "s1")
+	if err != nil || first == nil {
+		t.Fatalf("KickoffRoom got %v err:%v", first, err)
+	}
+	again, err := room.KickoffRoom(ctx, "s1")
+	if err != nil || again == nil || again.ID != first.ID {
+		t.Errorf("KickoffRoom closing room got %v err:%v", again, err)
+	}
+	got, _ := db.SelectRoom(ctx, map[string]interface{}{"streamname": "s1"})
+	if got.Status != ROOM_CLOSING {
+		t.Errorf("room status got %v", got.Status)
+	}
+	if jobs, _ := db.LoadKickJobs(ctx, 10); len(jobs) != 1 {
+		t.Errorf("persisted jobs got %v", len(jobs))
+	}
+
+	// 模拟重启 任务已经丢失
+	db.InsertRoom(ctx, &Room{StreamName: "s2", Status: ROOM_CLOSING, PublishHost: "127.0.0.1:1", PublishClientId: 2})
+	restarted := &RoomManager{db: db, kicks: NewKickManager(config, db), live: NewLiveHub(nil)}
+	unfinished, err := restarted.kicks.Load(ctx)
+	if err != nil || len(unfinished) != 1 {
+		t.Fatalf("Load got %v err:%v", unfinished, err)
+	}
+	if err = restarted.Recover(ctx, unfinished); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"s1", "s2"} {
+		if _, ok := restarted.kicks.Active(name, KICK_TARGET_PUBLISHER); !ok {
+			t.Errorf("%v has no active kick job after recover", name)
+		}
+	}
+}
+
+// 历史超过上限时只淘汰已完成的任务 重启时比最近历史更早的未完成任务也要加载
+func TestKickJobHistory(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	config := DefaultConfig()
+	db.InsertKickJob(ctx, &KickJob{ID: "old", StreamName: "s0", Status: KICK_JOB_RUNNING, Attempts: 2, CreateTime: 1})
+	for i := 0; i < KICK_JOB_HISTORY; i++ {
+		db.InsertKickJob(ctx, &KickJob{ID: fmt.Sprint(i), Status: KICK_JOB_DONE, CreateTime: int64(i + 2), UpdateTime: int64(i + 2)})
+	}
+
+	kicks := NewKickManager(config, db)
+	unfinished, err := kicks.Load(ctx)
+	if err != nil || len(unfinished) != 1 || unfinished[0].ID != "old" || unfinished[0].Attempts != 2 {
+		t.Fatalf("Load got %v err:%v", unfinished, err)
+	}
+	kicks.lock.Lock()
+	kicks.add(&KickJob{ID: "new", Status: KICK_JOB_RUNNING})
+	kicks.lock.Unlock()
+	if _, ok := kicks.Get("old"); !ok {
+		t.Errorf("unfinished job evicted")
+	}
+	if _, ok := kicks.Get("0"); ok {
+		t.Errorf("oldest finished job not evicted")
+	}
+
+	// 已完成的任务过期后删除 未完成的保留
+	kicks.expire(int64(KICK_JOB_HISTORY) + 2 + kicks.retention)
+	if jobs, _ := db.LoadKickJobs(ctx, 10); len(jobs) != 1 || jobs[0].ID != "old" {
+		t.Errorf("expire left %v", jobs)
+	}
+	if list := kicks.List(""); len(list) != 2 {
+		t.Errorf("expire left %v in memory", len(list))
+	}
+}
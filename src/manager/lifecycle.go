@@ -0,0 +1,163 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 后台循环 Start 启动 Stop 取消后等待 run 返回
+// run 在 ctx 取消后应当写完缓冲的数据再返回
+type Loop struct {
+	lock   sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// 已经启动时忽略
+func (l *Loop) Start(ctx context.Context, run func(ctx context.Context)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.cancel != nil {
+		return
+	}
+	ctx, l.cancel = context.WithCancel(ctx)
+	done := make(chan struct{})
+	l.done = done
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+}
+
+// 超过 ctx 的期限还没有退出时返回 ctx.Err()
+func (l *Loop) Stop(ctx context.Context) error {
+	l.lock.Lock()
+	cancel, done := l.cancel, l.done
+	l.cancel = nil
+	l.lock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	return waitDone(ctx, done)
+}
+
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 可以被取消的 time.Sleep 取消时返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func NewHttpServer(config *Config) *http.Server {
+	server := &http.Server{
+		Addr:        fmt.Sprintf(":%d", config.Port),
+		Handler:     http.HandlerFunc(RestHandler),
+		ReadTimeout: config.HTTP.ReadTimeout.Duration,
+		IdleTimeout: config.HTTP.IdleTimeout.Duration,
+	}
+	server.RegisterOnShutdown(func() {
+		if manager != nil {
+			manager.live.Close()
+		}
+	})
+	return server
+}
+
+// 收到 SIGTERM 时调用 停止接收请求 在 ctx 的期限内等待处理中的回调
+// 然后在单独的 stopTimeout 内停止后台任务 写完缓冲的审计 流量和播放记录
+// 请求没有处理完也不会占用写库的时间
+func Shutdown(ctx context.Context, server *http.Server, stopTimeout time.Duration) error {
+	err := server.Shutdown(ctx)
+	if err != nil {
+		glog.Warningln("Shutdown http server", err)
+		server.Close()
+	}
+	if manager != nil {
+		stopCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		defer cancel()
+		if e := manager.Stop(stopCtx); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 所有后台任务共用 ctx
+func (s *SrsManager) Start(ctx context.Context) {
+	s.loopLock.Lock()
+	defer s.loopLock.Unlock()
+	if s.cancel != nil {
+		return
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	// 审计日志单独停止 最后写库
+	s.audit.Start(context.Background())
+	s.auth.Start(ctx)
+	s.srsServerManager.Start(ctx)
+	s.viewerGeo.Start(ctx)
+	s.live.Start(ctx)
+	s.history.Start(ctx)
+	s.alertManager.Start(ctx)
+	s.stallDetector.Start(ctx)
+	s.kickManager.Start(ctx)
+	s.usage.Start(ctx)
+}
+
+// 先取消共用的 ctx 所有循环同时退出 再逐个等待 返回第一个错误
+func (s *SrsManager) Stop(ctx context.Context) error {
+	s.loopLock.Lock()
+	cancel := s.cancel
+	s.cancel = nil
+	s.loopLock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	var err error
+	stops := []func(context.Context) error{
+		s.auth.Stop,
+		s.srsServerManager.Stop,
+		s.viewerGeo.Stop,
+		s.live.Stop,
+		s.history.Stop,
+		s.alertManager.Stop,
+		s.stallDetector.Stop,
+		s.kickManager.Stop,
+		s.usage.Stop,
+		s.audit.Stop,
+	}
+	for _, stop := range stops {
+		if e := stop(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	if c, ok := s.db.(io.Closer); ok {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	glog.Infoln("SrsManager stopped", err)
+	return err
+}
@@ -0,0 +1,117 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoopStop(t *testing.T) {
+	var l Loop
+	exited := make(chan struct{})
+	l.Start(context.Background(), func(ctx context.Context) {
+		<-ctx.Done()
+		close(exited)
+	})
+	if err := l.Stop(context.Background()); err != nil {
+		t.Fatalf("stop %v", err)
+	}
+	select {
+	case <-exited:
+	default:
+		t.Errorf("stop returned before run exits")
+	}
+	if err := l.Stop(context.Background()); err != nil {
+		t.Errorf("second stop %v", err)
+	}
+
+	// run 不退出时按 ctx 的期限返回
+	block := make(chan struct{})
+	defer close(block)
+	l.Start(context.Background(), func(ctx context.Context) { <-block })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("stop blocked run got %v", err)
+	}
+}
+
+// 停止时写完缓冲中的审计 流量和播放记录
+func TestStopFlushes(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	audit := NewAuditLog(DefaultConfig(), db)
+	sm := newServerManager(db, audit)
+	sm.ApplyConfig(DefaultConfig())
+	usage := NewUsageAccounting(db, sm)
+	geo := NewViewerGeo(db, nil)
+
+	audit.Start(ctx)
+	usage.Start(ctx)
+	geo.Start(ctx)
+	sm.Start(ctx)
+
+	req := httptest.NewRequest(HTTP_DELETE, URL_PATH_SERVER+"/1.2.3.4:1985", nil)
+	audit.Record(NewAuditEntry(req, AUDIT_SERVER_REMOVE, "1.2.3.4:1985"), nil)
+	hour := time.Now().Unix() / USAGE_BUCKET * USAGE_BUCKET
+	usage.lock.Lock()
+	usage.pending[usageKey{hour: hour, streamName: "s1"}] = &UsageBucket{Hour: hour, StreamName: "s1", SendBytes: 100}
+	usage.lock.Unlock()
+	geo.lock.Lock()
+	geo.pending[GeoPlays{StreamName: "s1", Hour: hour, Province: "beijing", Isp: "ct"}] = 2
+	geo.lock.Unlock()
+
+	stopCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	for _, stop := range []func(context.Context) error{sm.Stop, geo.Stop, usage.Stop, audit.Stop} {
+		if err := stop(stopCtx); err != nil {
+			t.Fatalf("stop %v", err)
+		}
+	}
+
+	now := time.Now().Unix()
+	if entries, _ := db.SelectAudits(ctx, AuditFilter{From: now - 60, To: now + 60, Limit: 10}); len(entries) != 1 {
+		t.Errorf("audit entries got %v", len(entries))
+	}
+	if plays, _ := db.SelectGeoPlays(ctx, "s1", hour, now); len(plays) != 1 || plays[0].Plays != 2 {
+		t.Errorf("geo plays got %+v", plays)
+	}
+	if len(db.usage) != 1 {
+		t.Errorf("usage buckets got %v", len(db.usage))
+	}
+}
+
+// srs 节点卡住时 Stop 取消请求并等待踢人任务退出 任务保持未完成
+func TestKickManagerStop(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	srs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-block:
+		}
+	}))
+	defer srs.Close()
+
+	db := NewMemStore()
+	kicks := NewKickManager(DefaultConfig(), db)
+	job := kicks.Submit("s1", strings.TrimPrefix(srs.URL, "http://"), 1, KICK_TARGET_PUBLISHER, nil)
+	kicks.Start(context.Background())
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := kicks.Stop(ctx); err != nil {
+		t.Fatalf("stop %v", err)
+	}
+	if got, _ := kicks.Get(job.ID); got.Finished() {
+		t.Errorf("job after stop %+v", got)
+	}
+	later := kicks.Submit("s2", "127.0.0.1:1", 2, KICK_TARGET_PUBLISHER, nil)
+	if got, _ := kicks.Get(later.ID); got.Status != KICK_JOB_PENDING {
+		t.Errorf("submit after stop %+v", got)
+	}
+}
@@ -0,0 +1,202 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	LIVE_EVENT_SUMMARY   = "summary"
+	LIVE_EVENT_ROOM      = "room"
+	LIVE_EVENT_PUBLISH   = "publish"
+	LIVE_EVENT_UNPUBLISH = "unpublish"
+	LIVE_EVENT_ALERT     = "alert"
+
+	LIVE_SUBSCRIBER_BUFFER = 64
+	LIVE_KEEPALIVE         = 15 * time.Second
+)
+
+type LiveEvent struct {
+	Kind       string
+	Time       int64
+	ServerType string `json:",omitempty"`
+	Server     string `json:",omitempty"`
+	Room       string `json:",omitempty"`
+	Data       interface{}
+}
+
+// 订阅条件 为空表示不过滤
+type LiveFilter struct {
+	Kinds      map[string]bool
+	ServerType string
+	Room       string
+}
+
+func (f *LiveFilter) Match(e *LiveEvent) bool {
+	if len(f.Kinds) > 0 && !f.Kinds[e.Kind] {
+		return false
+	}
+	if f.ServerType != "" && e.ServerType != "" && e.ServerType != f.ServerType {
+		return false
+	}
+	if f.Room != "" && e.Room != f.Room {
+		return false
+	}
+	return true
+}
+
+type liveSubscriber struct {
+	filter LiveFilter
+	ch     chan *LiveEvent
+}
+
+// 把事件推送给 /live/events 的订阅者 慢的订阅者直接丢弃事件
+type LiveHub struct {
+	sm        *ServerManager
+	loop      Loop
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	lock        sync.RWMutex
+	subscribers map[*liveSubscriber]bool
+}
+
+func NewLiveHub(sm *ServerManager) *LiveHub {
+	return &LiveHub{sm: sm, closing: make(chan struct{}), subscribers: make(map[*liveSubscriber]bool)}
+}
+
+func (h *LiveHub) Publish(e *LiveEvent) {
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for sub := range h.subscribers {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			glog.Warningln("LiveHub subscriber too slow, drop", e.Kind)
+		}
+	}
+}
+
+func (h *LiveHub) PublishRoom(kind string, room *Room) {
+	h.Publish(&LiveEvent{Kind: kind, Room: room.StreamName, Data: room})
+}
+
+// 实现 Notifier 告警也推送给订阅者
+func (h *LiveHub) Notify(alert Alert) error {
+	h.Publish(&LiveEvent{Kind: LIVE_EVENT_ALERT, Data: alert})
+	return nil
+}
+
+func (h *LiveHub) subscribe(filter LiveFilter) *liveSubscriber {
+	sub := &liveSubscriber{filter: filter, ch: make(chan *LiveEvent, LIVE_SUBSCRIBER_BUFFER)}
+	h.lock.Lock()
+	h.subscribers[sub] = true
+	h.lock.Unlock()
+	return sub
+}
+
+func (h *LiveHub) unsubscribe(sub *liveSubscriber) {
+	h.lock.Lock()
+	delete(h.subscribers, sub)
+	h.lock.Unlock()
+}
+
+// 节点的summary有更新时推送 和拉取节点状态的间隔一致
+func (h *LiveHub) Start(ctx context.Context) {
+	h.loop.Start(ctx, h.Run)
+}
+
+func (h *LiveHub) Stop(ctx context.Context) error {
+	return h.loop.Stop(ctx)
+}
+
+// 关闭所有 /live/events 连接 http server 停止时调用 否则长连接会一直等到超时
+func (h *LiveHub) Close() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
+
+func (h *LiveHub) Run(ctx context.Context) {
+	last := make(map[string]int64)
+	for sleepContext(ctx, h.sm.PollInterval()) {
+		for _, typeName := range []string{STR_TYPE_EDGE_UP, STR_TYPE_EDGE_DOWN, STR_TYPE_ORIGIN} {
+			for _, svr := range h.sm.getServerList(typeName) {
+				summary := svr.GetSummary()
+				if summary.UpdateTime == 0 || last[svr.Addr] == summary.UpdateTime {
+					continue
+				}
+				last[svr.Addr] = summary.UpdateTime
+				h.Publish(&LiveEvent{Kind: LIVE_EVENT_SUMMARY, ServerType: typeName,
+					Server: svr.Addr, Data: summary})
+			}
+		}
+	}
+}
+
+// /live/events?kind=summary,room,publish,unpublish,alert&type=down&room=xxx
+// Server-Sent Events
+func (h *LiveHub) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	filter := LiveFilter{ServerType: query.Get("type"), Room: query.Get("room")}
+	if filter.ServerType != "" && GetServerType(filter.ServerType) < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if kinds := query.Get("kind"); kinds != "" {
+		filter.Kinds = make(map[string]bool)
+		for _, k := range strings.Split(kinds, ",") {
+			filter.Kinds[strings.TrimSpace(k)] = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := h.subscribe(filter)
+	defer h.unsubscribe(sub)
+	keepalive := time.NewTicker(LIVE_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.closing:
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e := <-sub.ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				glog.Warningln("LiveHub marshal", err)
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,37 @@
+package manager
+
+import "testing"
+
+func TestLiveFilter(t *testing.T) {
+	f := LiveFilter{Kinds: map[string]bool{LIVE_EVENT_SUMMARY: true}, ServerType: STR_TYPE_EDGE_DOWN}
+	if !f.Match(&LiveEvent{Kind: LIVE_EVENT_SUMMARY, ServerType: STR_TYPE_EDGE_DOWN}) {
+		t.Errorf("summary of down should match")
+	}
+	if f.Match(&LiveEvent{Kind: LIVE_EVENT_SUMMARY, ServerType: STR_TYPE_ORIGIN}) {
+		t.Errorf("summary of origin should not match")
+	}
+	if f.Match(&LiveEvent{Kind: LIVE_EVENT_ALERT}) {
+		t.Errorf("alert should not match")
+	}
+
+	f = LiveFilter{Room: "abc"}
+	if !f.Match(&LiveEvent{Kind: LIVE_EVENT_PUBLISH, Room: "abc"}) ||
+		f.Match(&LiveEvent{Kind: LIVE_EVENT_ALERT}) {
+		t.Errorf("room filter mismatch")
+	}
+}
+
+func TestLiveHubPublish(t *testing.T) {
+	h := NewLiveHub(nil)
+	sub := h.subscribe(LiveFilter{Room: "abc"})
+	h.Publish(&LiveEvent{Kind: LIVE_EVENT_UNPUBLISH, Room: "xyz"})
+	h.Publish(&LiveEvent{Kind: LIVE_EVENT_UNPUBLISH, Room: "abc"})
+	h.unsubscribe(sub)
+	h.Publish(&LiveEvent{Kind: LIVE_EVENT_UNPUBLISH, Room: "abc"})
+	if len(sub.ch) != 1 {
+		t.Fatalf("got %v events", len(sub.ch))
+	}
+	if e := <-sub.ch; e.Room != "abc" || e.Time == 0 {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
@@ -1,9 +1,10 @@
 package manager
 
 import (
+	"context"
 	"net/http"
 	"strings"
-	"utils"
+	"sync"
 
 	"fmt"
 
@@ -16,6 +17,30 @@ const (
 	URL_PATH_SUMMARIES = "/summary"
 	URL_PATH_STREAMS   = "/stream"
 	URL_PATH_SERVER    = "/server"
+	URL_PATH_CLIENTS   = "/clients"
+	URL_PATH_VHOSTS    = "/vhosts"
+	URL_PATH_KICK      = "/kick"
+	URL_PATH_METRICS   = "/metrics"
+	URL_PATH_HISTORY   = "/history"
+	URL_PATH_ALERTS    = "/alerts"
+	URL_PATH_STALL     = "/stall"
+	URL_PATH_GEO       = "/geo"
+	URL_PATH_USAGE     = "/usage"
+	URL_PATH_UI        = "/ui"
+	URL_PATH_AUDIT     = "/audit"
+	URL_PATH_ADMIN     = "/admin"
+	URL_PATH_REFERER   = "/referer"
+
+	URL_PATH_SERVER_HEARTBEAT = "/server/heartbeat"
+	URL_PATH_SERVER_APPROVE   = "/server/approve"
+
+	URL_PATH_STREAMS_AGGREGATE = "/streams/aggregate"
+
+	URL_PATH_LIVE_EVENTS = "/live/events"
+
+	URL_PATH_ADMIN_KEYS   = "/admin/keys"
+	URL_PATH_ADMIN_CONFIG = "/admin/config"
+	URL_PATH_ADMIN_RELOAD = "/admin/reload"
 )
 
 func RestHandler(w http.ResponseWriter, req *http.Request) {
@@ -24,59 +49,179 @@ func RestHandler(w http.ResponseWriter, req *http.Request) {
 
 var manager *SrsManager
 
-func InitRestHandler(config *utils.Config) error {
-	var err error
-	dbDriver := "mysql"
-	dbSource := config.GetString("dbSource")
-	glog.Infoln("dbSource", dbSource)
-	db := NewDBSync(dbDriver, dbSource)
+func InitRestHandler(configPath string, config *Config) error {
+	glog.Infoln("dbDriver", config.DB.Driver, "dbSource", config.DB.Source)
+	db, err := NewStore(config.DB.Driver, config.DB.Source, config.DB.PoolOptions())
+	if err != nil {
+		glog.Errorln("NewStore err", err)
+		return err
+	}
+	if err = VerifySchema(db); err != nil {
+		glog.Errorln("VerifySchema err", err)
+		return err
+	}
 	if manager, err = NewSrsManager(config, db); err != nil {
 		glog.Errorln("NewSrsManager err", err)
+		return err
 	}
+	manager.configPath = configPath
+	manager.Start(context.Background())
 
 	return err
 }
 
 type SrsManager struct {
-	config           *utils.Config
-	db               *DBSync
+	configPath       string
+	reloadLock       sync.Mutex
+	configLock       sync.RWMutex
+	loopLock         sync.Mutex
+	cancel           context.CancelFunc
+	config           *Config
+	db               Store
 	eventManager     *EventManager
 	roomManager      *RoomManager
 	srsServerManager *ServerManager
+	kickManager      *KickManager
+	history          *HistoryStore
+	alertManager     *AlertManager
+	stallDetector    *StallDetector
+	viewerGeo        *ViewerGeo
+	usage            *UsageAccounting
+	live             *LiveHub
+	audit            *AuditLog
+	auth             *Authenticator
+	limiter          *RateLimiter
+	referers         *RefererRules
+	dashboard        *Dashboard
 }
 
-func NewSrsManager(config *utils.Config, dbSync *DBSync) (*SrsManager, error) {
-	event := &EventManager{db: dbSync}
-	server, err := NewSrsServermanager(dbSync)
+func NewSrsManager(config *Config, dbSync Store) (*SrsManager, error) {
+	bans := NewBanList(dbSync)
+	if err := bans.Load(context.Background()); err != nil {
+		return nil, err
+	}
+	audit := NewAuditLog(config, dbSync)
+	auth := NewAuthenticator(config, dbSync, audit)
+	if err := auth.Load(context.Background()); err != nil {
+		return nil, fmt.Errorf("Load api keys failed:%v", err)
+	}
+	server, err := NewSrsServermanager(config, dbSync, audit)
 	if err != nil {
 		return nil, fmt.Errorf("Load ip.txt failed:%v", err)
 	}
+	rules := NewGeoRules(dbSync, server.ipDatabase.GetSubNet)
+	if err = rules.Load(context.Background()); err != nil {
+		return nil, err
+	}
+	referers := NewRefererRules(config, dbSync, audit)
+	if err = referers.Load(context.Background()); err != nil {
+		return nil, err
+	}
+	geo := NewViewerGeo(dbSync, server.ipDatabase)
+	live := NewLiveHub(server)
+	guard, err := NewEventGuard(config, server)
+	if err != nil {
+		return nil, err
+	}
+	server.guard = guard
+	limiter, err := NewRateLimiter(config)
+	if err != nil {
+		return nil, fmt.Errorf("Load rate limit rules failed:%v", err)
+	}
+	event := &EventManager{db: dbSync, servers: server, guard: guard, bans: bans, rules: rules, referers: referers, geo: geo, live: live, audit: audit}
 
 	if err = server.LoadServers(); err != nil {
 		return nil, err
 	}
 
-	room := &RoomManager{db: dbSync, serverManager: server}
+	history := NewHistoryStore(config, dbSync, server)
+
+	alerts, err := NewAlertManager(config, dbSync, server)
+	if err != nil {
+		return nil, fmt.Errorf("Load alert rules failed:%v", err)
+	}
+	alerts.AddNotifier(live)
+
+	kicks := NewKickManager(config, dbSync)
+	unfinished, err := kicks.Load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	room := &RoomManager{db: dbSync, serverManager: server, bans: bans, rules: rules, kicks: kicks, live: live, audit: audit}
+	room.ApplyConfig(config)
+	if err = room.Recover(context.Background(), unfinished); err != nil {
+		return nil, err
+	}
+
+	stall := NewStallDetector(config, dbSync, server, kicks)
+
+	usage := NewUsageAccounting(dbSync, server)
 	return &SrsManager{
 		config:           config,
 		db:               dbSync,
 		eventManager:     event,
 		roomManager:      room,
 		srsServerManager: server,
+		kickManager:      kicks,
+		history:          history,
+		alertManager:     alerts,
+		stallDetector:    stall,
+		viewerGeo:        geo,
+		usage:            usage,
+		live:             live,
+		audit:            audit,
+		auth:             auth,
+		limiter:          limiter,
+		referers:         referers,
+		dashboard:        NewDashboard(),
 	}, nil
 }
 
 func (s *SrsManager) HttpHandler(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Path
 	glog.Infoln("HttpHandler url", url)
+	r = r.WithContext(WithClientIp(r.Context(), s.limiter.ClientIp(r)))
+	r, ok := s.auth.Check(w, r)
+	if !ok || !s.limiter.Check(w, r) {
+		return
+	}
 	if strings.HasPrefix(url, URL_PATH_EVENT) {
 		s.eventManager.HttpHandler(w, r)
 	} else if strings.HasPrefix(url, URL_PATH_ROOM) {
 		s.roomManager.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_METRICS) {
+		s.metricsHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_HISTORY) {
+		s.history.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_ALERTS) {
+		s.alertManager.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_STALL) {
+		s.stallDetector.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_GEO) {
+		s.viewerGeo.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_USAGE) {
+		s.usage.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_LIVE_EVENTS) {
+		s.live.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_ADMIN_KEYS) {
+		s.auth.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_ADMIN_CONFIG) ||
+		strings.HasPrefix(url, URL_PATH_ADMIN_RELOAD) {
+		s.configHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_REFERER) {
+		s.referers.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_AUDIT) {
+		s.audit.HttpHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_KICK) {
+		s.kickManager.HttpHandler(w, r)
 	} else if strings.HasPrefix(url, URL_PATH_SUMMARIES) ||
 		strings.HasPrefix(url, URL_PATH_STREAMS) {
 		s.srsServerManager.HttpHandler(w, r)
-	} else if strings.HasPrefix(url, URL_PATH_SERVER) {
+	} else if strings.HasPrefix(url, URL_PATH_SERVER) ||
+		strings.HasPrefix(url, URL_PATH_CLIENTS) ||
+		strings.HasPrefix(url, URL_PATH_VHOSTS) {
 		s.srsServerManager.HttpHandler(w, r)
+	} else if url == "/" || strings.HasPrefix(url, URL_PATH_UI) {
+		s.dashboard.HttpHandler(w, r)
 	}
 }
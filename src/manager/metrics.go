@@ -0,0 +1,271 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	METRIC_CALLBACKS_TOTAL      = "srs_manager_callbacks_total"
+	METRIC_CALLBACK_DURATION    = "srs_manager_callback_duration_seconds"
+	METRIC_DISPATCH_TOTAL       = "srs_manager_dispatch_total"
+	METRIC_POLL_ERRORS_TOTAL    = "srs_manager_poll_errors_total"
+	METRIC_DB_QUERY_DURATION    = "srs_manager_db_query_duration_seconds"
+	METRIC_ROOMS                = "srs_manager_rooms"
+	METRIC_DB_CONNECTIONS       = "srs_manager_db_connections"
+	METRIC_DB_WAIT_COUNT        = "srs_manager_db_wait_count"
+	METRIC_DB_WAIT_DURATION     = "srs_manager_db_wait_duration_seconds"
+	METRIC_AUDIT_DROPPED_TOTAL  = "srs_manager_audit_dropped_total"
+	METRIC_AUTH_FAILURES_TOTAL  = "srs_manager_auth_failures_total"
+	METRIC_RATE_LIMITED_TOTAL   = "srs_manager_rate_limited_total"
+	METRIC_RATE_LIMIT_BUCKETS   = "srs_manager_rate_limit_buckets"
+	METRIC_GEO_DENIED_TOTAL     = "srs_manager_geo_denied_total"
+	METRIC_REFERER_DENIED_TOTAL = "srs_manager_referer_denied_total"
+	METRIC_CONFIG_RELOADS_TOTAL = "srs_manager_config_reloads_total"
+	METRIC_SERVER_CPU_PERCENT   = "srs_server_cpu_percent"
+	METRIC_SERVER_LOAD_1M       = "srs_server_load_1m"
+	METRIC_SERVER_NET_SEND      = "srs_server_net_send_bytes"
+	METRIC_SERVER_NET_RECV      = "srs_server_net_recv_bytes"
+	METRIC_SERVER_CONN_SRS      = "srs_server_conn_srs"
+	METRIC_SERVER_UP            = "srs_server_up"
+	METRIC_STREAM_CLIENTS       = "srs_stream_clients"
+	METRIC_STREAM_KBPS_RECV     = "srs_stream_kbps_recv"
+	METRIC_STREAM_KBPS_SEND     = "srs_stream_kbps_send"
+
+	METRIC_TYPE_COUNTER  = "counter"
+	METRIC_TYPE_GAUGE    = "gauge"
+	METRIC_TYPE_SUMMARY  = "summary"
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4"
+
+	DISPATCH_RESULT_OK       = "ok"
+	DISPATCH_RESULT_EMPTY    = "empty"
+	DISPATCH_PROVINCE_INSIDE = "inside"
+
+	CALLBACK_RESULT_ALLOW       = "allow"
+	CALLBACK_RESULT_DENY        = "deny"
+	CALLBACK_RESULT_BAD_REQUEST = "bad_request"
+	CALLBACK_RESULT_UNTRUSTED   = "untrusted"
+)
+
+var metricHelps = map[string]string{
+	METRIC_CALLBACKS_TOTAL:      "SRS http callbacks handled by action and result.",
+	METRIC_CALLBACK_DURATION:    "SRS http callback handling latency by action.",
+	METRIC_DISPATCH_TOTAL:       "Dispatch requests by province, isp and result.",
+	METRIC_POLL_ERRORS_TOTAL:    "Errors polling the SRS http api by server and api.",
+	METRIC_DB_QUERY_DURATION:    "Database query latency by operation.",
+	METRIC_ROOMS:                "Rooms by status.",
+	METRIC_DB_CONNECTIONS:       "Database pool connections by state.",
+	METRIC_DB_WAIT_COUNT:        "Total number of connections waited for.",
+	METRIC_DB_WAIT_DURATION:     "Total time blocked waiting for a new connection.",
+	METRIC_AUDIT_DROPPED_TOTAL:  "Audit entries dropped because the buffer is full or the final flush failed.",
+	METRIC_AUTH_FAILURES_TOTAL:  "Management api requests rejected by reason.",
+	METRIC_RATE_LIMITED_TOTAL:   "Requests rejected with 429 by rule and key type.",
+	METRIC_RATE_LIMIT_BUCKETS:   "Active token buckets by rule.",
+	METRIC_GEO_DENIED_TOTAL:     "Play and dispatch requests denied by room geo rules.",
+	METRIC_REFERER_DENIED_TOTAL: "Connect and play callbacks denied by referer allowlists.",
+	METRIC_CONFIG_RELOADS_TOTAL: "Config reloads by result.",
+	METRIC_SERVER_CPU_PERCENT:   "SRS server cpu percent.",
+	METRIC_SERVER_LOAD_1M:       "SRS server load 1m.",
+	METRIC_SERVER_NET_SEND:      "SRS server network send bytes.",
+	METRIC_SERVER_NET_RECV:      "SRS server network recv bytes.",
+	METRIC_SERVER_CONN_SRS:      "SRS server connections.",
+	METRIC_SERVER_UP:            "SRS server status, 1 when active.",
+	METRIC_STREAM_CLIENTS:       "Clients of a stream on a server.",
+	METRIC_STREAM_KBPS_RECV:     "Stream recv kbps over 30s on a server.",
+	METRIC_STREAM_KBPS_SEND:     "Stream send kbps over 30s on a server.",
+}
+
+var roomStatusNames = map[int]string{
+	ROOM_CREATE:  "create",
+	ROOM_PUBLISH: "publish",
+	ROOM_CLOSED:  "closed",
+	ROOM_CLOSING: "closing",
+}
+
+type summaryValue struct {
+	sum   float64
+	count int64
+}
+
+// 进程内的计数器 按prometheus文本格式输出
+type Metrics struct {
+	lock      sync.Mutex
+	counters  map[string]map[string]float64
+	summaries map[string]map[string]*summaryValue
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:  make(map[string]map[string]float64),
+		summaries: make(map[string]map[string]*summaryValue),
+	}
+}
+
+// labels 按 key, value 依次传入
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	key := formatLabels(labels...)
+	m.lock.Lock()
+	if _, ok := m.counters[name]; !ok {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][key] += value
+	m.lock.Unlock()
+}
+
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	key := formatLabels(labels...)
+	m.lock.Lock()
+	if _, ok := m.summaries[name]; !ok {
+		m.summaries[name] = make(map[string]*summaryValue)
+	}
+	v, ok := m.summaries[name][key]
+	if !ok {
+		v = &summaryValue{}
+		m.summaries[name][key] = v
+	}
+	v.sum += value
+	v.count++
+	m.lock.Unlock()
+}
+
+func (m *Metrics) ObserveSince(name string, start time.Time, labels ...string) {
+	m.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+func (m *Metrics) Write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, name := range sortedKeys(m.counters) {
+		writeMetricHeader(w, name, METRIC_TYPE_COUNTER)
+		values := m.counters[name]
+		for _, key := range sortedKeys(values) {
+			writeMetricLine(w, name, key, values[key])
+		}
+	}
+	for _, name := range sortedKeys(m.summaries) {
+		writeMetricHeader(w, name, METRIC_TYPE_SUMMARY)
+		values := m.summaries[name]
+		for _, key := range sortedKeys(values) {
+			writeMetricLine(w, name+"_sum", key, values[key].sum)
+			writeMetricLine(w, name+"_count", key, float64(values[key].count))
+		}
+	}
+}
+
+// 一组同名的gauge 采集时临时生成
+type GaugeVec struct {
+	Name   string
+	Values map[string]float64
+}
+
+func NewGaugeVec(name string) *GaugeVec {
+	return &GaugeVec{Name: name, Values: make(map[string]float64)}
+}
+
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	g.Values[formatLabels(labels...)] = value
+}
+
+func (g *GaugeVec) Write(w io.Writer) {
+	writeMetricHeader(w, g.Name, METRIC_TYPE_GAUGE)
+	for _, key := range sortedKeys(g.Values) {
+		writeMetricLine(w, g.Name, key, g.Values[key])
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, metricType string) {
+	if help, ok := metricHelps[name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func writeMetricLine(w io.Writer, name, labels string, value float64) {
+	if labels == "" {
+		fmt.Fprintf(w, "%s %v\n", name, value)
+	} else {
+		fmt.Fprintf(w, "%s{%s} %v\n", name, labels, value)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels ...string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case map[string]float64:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]float64:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*summaryValue:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]*summaryValue:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// /metrics
+func (s *SrsManager) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+
+	rooms := NewGaugeVec(METRIC_ROOMS)
+	if counts, err := s.db.CountRoomsByStatus(r.Context()); err != nil {
+		glog.Warningln("metricsHandler CountRoomsByStatus", err)
+	} else {
+		for status, name := range roomStatusNames {
+			rooms.Set(float64(counts[status]), "status", name)
+		}
+	}
+	rooms.Write(w)
+
+	if pool, ok := s.db.(PoolStatser); ok {
+		stats := pool.Stats()
+		conns := NewGaugeVec(METRIC_DB_CONNECTIONS)
+		conns.Set(float64(stats.OpenConnections), "state", "open")
+		conns.Set(float64(stats.InUse), "state", "in_use")
+		conns.Set(float64(stats.Idle), "state", "idle")
+		conns.Set(float64(stats.MaxOpenConnections), "state", "max_open")
+		conns.Write(w)
+		waits := NewGaugeVec(METRIC_DB_WAIT_COUNT)
+		waits.Set(float64(stats.WaitCount))
+		waits.Write(w)
+		waited := NewGaugeVec(METRIC_DB_WAIT_DURATION)
+		waited.Set(stats.WaitDuration.Seconds())
+		waited.Write(w)
+	}
+
+	s.srsServerManager.WriteMetrics(w)
+	s.limiter.WriteMetrics(w)
+	metrics.Write(w)
+}
@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := NewMetrics()
+	m.Inc(METRIC_CALLBACKS_TOTAL, "action", "on_play", "result", "allow")
+	m.Inc(METRIC_CALLBACKS_TOTAL, "action", "on_play", "result", "allow")
+	m.Observe(METRIC_CALLBACK_DURATION, 0.5, "action", "on_play")
+	m.Observe(METRIC_CALLBACK_DURATION, 1.5, "action", "on_play")
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE srs_manager_callbacks_total counter",
+		`srs_manager_callbacks_total{action="on_play",result="allow"} 2`,
+		"# TYPE srs_manager_callback_duration_seconds summary",
+		`srs_manager_callback_duration_seconds_sum{action="on_play"} 2`,
+		`srs_manager_callback_duration_seconds_count{action="on_play"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing line %q in\n%s", line, out)
+		}
+	}
+}
+
+func TestFormatLabelsEscape(t *testing.T) {
+	if got := formatLabels("stream", `a"b\c`); got != `stream="a\"b\\c"` {
+		t.Errorf("formatLabels got %v", got)
+	}
+}
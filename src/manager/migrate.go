@@ -0,0 +1,330 @@
+package manager
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	TABLE_NAME_SCHEMA_VERSION = "schema_version"
+
+	MIGRATE_UP     = "up"
+	MIGRATE_DOWN   = "down"
+	MIGRATE_STATUS = "status"
+)
+
+// 每种数据库一个目录 文件名为 {版本号}_{名称}.up.sql 和 {版本号}_{名称}.down.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var schemaVersionDDL = map[string]string{
+	STORE_DRIVER_MYSQL: "CREATE TABLE IF NOT EXISTS `" + TABLE_NAME_SCHEMA_VERSION + "` (" +
+		"`version` int(11) NOT NULL, `name` varchar(255) NOT NULL, `applied_at` int(11) NOT NULL, " +
+		"PRIMARY KEY (`version`)) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+	STORE_DRIVER_SQLITE: "CREATE TABLE IF NOT EXISTS `" + TABLE_NAME_SCHEMA_VERSION + "` (" +
+		"`version` INTEGER PRIMARY KEY, `name` TEXT NOT NULL, `applied_at` INTEGER NOT NULL)",
+}
+
+// 代码中用到的表和列 启动时检查
+var schemaColumns = map[string]string{
+	"room":                "`id`, `user`, `desc`, `bu`, `streamname`, `expiration`, `status`, `publishid`, `publishhost`, `createtime`, `lastupdatetime`",
+	TABLE_NAME_SRS_SERVER: "`id`, `addr`, `desc`, `type`, `status`, `idc`, `capacity`, `version`, `lastseen`",
+	TABLE_NAME_ROOM_BAN:   "`id`, `streamname`, `type`, `value`, `createtime`",
+	TABLE_NAME_HISTORY:    "`series`, `resolution`, `time`, `avg`, `min`, `max`",
+	TABLE_NAME_INCIDENT:   "`id`, `streamname`, `user`, `state`, `detail`, `starttime`, `endtime`, `kicked`",
+	TABLE_NAME_VIEWER_GEO: "`streamname`, `hour`, `province`, `isp`, `plays`",
+	TABLE_NAME_USAGE:      "`hour`, `streamname`, `user`, `bu`, `send_bytes`, `recv_bytes`",
+	TABLE_NAME_AUDIT:      "`id`, `time`, `actor`, `ip`, `action`, `target`, `payload`, `outcome`, `reason`",
+	TABLE_NAME_API_KEY:    "`id`, `name`, `keyhash`, `role`, `scopes`, `expiration`, `createtime`",
+	TABLE_NAME_GEO_RULE:   "`id`, `streamname`, `action`, `type`, `value`, `createtime`",
+	TABLE_NAME_REFERER:    "`id`, `scope`, `name`, `domain`, `createtime`",
+	TABLE_NAME_KICK_JOB:   "`id`, `streamname`, `host`, `clientid`, `target`, `status`, `attempts`, `lasterror`, `createtime`, `updatetime`",
+}
+
+// 只在条件满足时执行 up 的迁移 不满足时只记录版本
+var migrationConditions = map[int]func(ctx context.Context, tx *sql.Tx, driver string) (bool, error){
+	// 旧的 create_table.sql 建的是 host 列 而代码一直读写 addr 列
+	// 已经在用的库是 addr 列 只有 host 列时才需要改名
+	2: func(ctx context.Context, tx *sql.Tx, driver string) (bool, error) {
+		return hasColumn(ctx, tx, driver, TABLE_NAME_SRS_SERVER, "host")
+	},
+}
+
+var columnExistsSQL = map[string]string{
+	STORE_DRIVER_MYSQL: "select count(*) from information_schema.columns " +
+		"where table_schema = database() and table_name = ? and column_name = ?",
+	STORE_DRIVER_SQLITE: "select count(*) from pragma_table_info(?) where name = ?",
+}
+
+func hasColumn(ctx context.Context, tx *sql.Tx, driver, table, column string) (bool, error) {
+	var count int
+	if err := tx.QueryRowContext(ctx, columnExistsSQL[driver], table, column).Scan(&count); err != nil {
+		return false, fmt.Errorf("check column %v.%v err:%v", table, column, err)
+	}
+	return count > 0, nil
+}
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Migrator struct {
+	d          *DBSync
+	migrations []*Migration
+}
+
+func NewMigrator(d *DBSync) (*Migrator, error) {
+	migrations, err := loadMigrations(d.dbDriver)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{d: d, migrations: migrations}, nil
+}
+
+func loadMigrations(driver string) ([]*Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for driver %v", driver)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		var up bool
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			up = true
+		case strings.HasSuffix(name, ".down.sql"):
+		default:
+			continue
+		}
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %v", name)
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: strings.SplitN(parts[1], ".", 2)[0]}
+			byVersion[version] = m
+		}
+		if up {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration version %v missing", i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %v need both up and down", m.Version)
+		}
+	}
+	return migrations, nil
+}
+
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// 当前版本 没有执行过迁移时为0
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	if _, err := m.d.exec(ctx, schemaVersionDDL[m.d.dbDriver]); err != nil {
+		return 0, fmt.Errorf("create %v err:%v", TABLE_NAME_SCHEMA_VERSION, err)
+	}
+	var version int
+	sqlstr := "select coalesce(max(`version`), 0) from " + TABLE_NAME_SCHEMA_VERSION
+	if err := m.d.db.QueryRowContext(ctx, sqlstr).Scan(&version); err != nil {
+		return 0, fmt.Errorf("sql:%v err:%v", sqlstr, err)
+	}
+	return version, nil
+}
+
+func splitStatements(content string) []string {
+	var stmts []string
+	for _, s := range strings.Split(content, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+// sqlite 的 DDL 在事务中执行 mysql 的 DDL 会隐式提交 失败时需要手工处理
+func (m *Migrator) apply(ctx context.Context, migration *Migration, up bool) error {
+	content := migration.Down
+	if up {
+		content = migration.Up
+	}
+	tx, err := m.d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if check, ok := migrationConditions[migration.Version]; ok && up {
+		var need bool
+		if need, err = check(ctx, tx, m.d.dbDriver); err != nil {
+			return err
+		} else if !need {
+			glog.Infoln("migrate skip", migration.Version, migration.Name)
+			content = ""
+		}
+	}
+	for i, stmt := range splitStatements(content) {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %v_%v statement %v err:%v", migration.Version, migration.Name, i+1, err)
+		}
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, "insert into "+TABLE_NAME_SCHEMA_VERSION+"(`version`, `name`, `applied_at`) values(?, ?, ?)",
+			migration.Version, migration.Name, time.Now().Unix())
+	} else {
+		_, err = tx.ExecContext(ctx, "delete from "+TABLE_NAME_SCHEMA_VERSION+" where `version` = ?", migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 执行所有未执行的迁移
+func (m *Migrator) Up(ctx context.Context) error {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if current > m.Latest() {
+		return fmt.Errorf("schema version %v is newer than %v", current, m.Latest())
+	}
+	for _, migration := range m.migrations[current:] {
+		glog.Infoln("migrate up", migration.Version, migration.Name)
+		if err = m.apply(ctx, migration, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 回滚到 target 版本
+func (m *Migrator) Down(ctx context.Context, target int) error {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > current || current > m.Latest() {
+		return fmt.Errorf("cannot migrate down from %v to %v", current, target)
+	}
+	for v := current; v > target; v-- {
+		migration := m.migrations[v-1]
+		glog.Infoln("migrate down", migration.Version, migration.Name)
+		if err = m.apply(ctx, migration, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 版本号一致 并且代码用到的列都存在
+func (m *Migrator) Verify(ctx context.Context) error {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if current != m.Latest() {
+		return fmt.Errorf("schema version %v, want %v, run with -migrate up", current, m.Latest())
+	}
+	for table, columns := range schemaColumns {
+		sqlstr := "select " + columns + " from `" + table + "` where 1 = 0"
+		rows, err := m.d.db.QueryContext(ctx, sqlstr)
+		if err != nil {
+			return fmt.Errorf("schema mismatch table %v err:%v", table, err)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// 只有数据库存储需要检查表结构
+func VerifySchema(store Store) error {
+	d, ok := store.(*DBSync)
+	if !ok {
+		return nil
+	}
+	m, err := NewMigrator(d)
+	if err != nil {
+		return err
+	}
+	return m.Verify(context.Background())
+}
+
+// -migrate up | down | status
+// down 时回滚到 to 版本 to 小于0时回滚一个版本
+func RunMigrate(config *Config, action string, to int) error {
+	store, err := NewStore(config.DB.Driver, config.DB.Source, config.DB.PoolOptions())
+	if err != nil {
+		return err
+	}
+	d, ok := store.(*DBSync)
+	if !ok {
+		return fmt.Errorf("driver %v has no schema", config.DB.Driver)
+	}
+	defer d.Close()
+	m, err := NewMigrator(d)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch action {
+	case MIGRATE_UP:
+		err = m.Up(ctx)
+	case MIGRATE_DOWN:
+		if to < 0 {
+			var current int
+			if current, err = m.Version(ctx); err != nil {
+				return err
+			}
+			to = current - 1
+		}
+		err = m.Down(ctx, to)
+	case MIGRATE_STATUS:
+	default:
+		return fmt.Errorf("unknown migrate action %v", action)
+	}
+	if err != nil {
+		return err
+	}
+
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d, latest %d\n", current, m.Latest())
+	return nil
+}
@@ -0,0 +1,22 @@
+package manager
+
+import "testing"
+
+func TestLoadMigrations(t *testing.T) {
+	mysql, err := loadMigrations(STORE_DRIVER_MYSQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := loadMigrations(STORE_DRIVER_SQLITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mysql) != len(sqlite) {
+		t.Fatalf("mysql has %v migrations, sqlite has %v", len(mysql), len(sqlite))
+	}
+	for i := range mysql {
+		if mysql[i].Name != sqlite[i].Name {
+			t.Errorf("migration %v name mismatch %v %v", i+1, mysql[i].Name, sqlite[i].Name)
+		}
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `srs_server`;
+DROP TABLE IF EXISTS `room`;
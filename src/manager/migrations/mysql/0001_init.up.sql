@@ -1,6 +1,4 @@
-use srs_manager;
-
-CREATE TABLE `room` (
+CREATE TABLE IF NOT EXISTS `room` (
       `id` bigint(20) NOT NULL AUTO_INCREMENT,
       `user` varchar(255) NOT NULL,
       `desc` varchar(255) NOT NULL,
@@ -15,11 +13,11 @@ CREATE TABLE `room` (
       UNIQUE KEY `name` (`streamname`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
-CREATE TABLE `srs_server` (
+CREATE TABLE IF NOT EXISTS `srs_server` (
       `id` bigint(20) NOT NULL AUTO_INCREMENT,
       `host` varchar(255) NOT NULL,
       `desc` varchar(255) DEFAULT '',
       `type` int(11) NOT NULL,
       `status` int(11) NOT NULL,
       PRIMARY KEY (`id`)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1 @@
+ALTER TABLE `srs_server` CHANGE `addr` `host` varchar(255) NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE `srs_server` CHANGE `host` `addr` varchar(255) NOT NULL;
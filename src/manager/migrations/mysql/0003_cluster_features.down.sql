@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS `usage_hourly`;
+DROP TABLE IF EXISTS `viewer_geo`;
+DROP TABLE IF EXISTS `stream_incident`;
+DROP TABLE IF EXISTS `history`;
+DROP TABLE IF EXISTS `room_ban`;
+
+ALTER TABLE `room` DROP COLUMN `bu`;
+
+ALTER TABLE `srs_server`
+      DROP COLUMN `lastseen`,
+      DROP COLUMN `version`,
+      DROP COLUMN `capacity`,
+      DROP COLUMN `idc`;
@@ -0,0 +1,66 @@
+ALTER TABLE `srs_server`
+      ADD COLUMN `idc` int(11) NOT NULL DEFAULT '0',
+      ADD COLUMN `capacity` int(11) NOT NULL DEFAULT '0',
+      ADD COLUMN `version` varchar(64) NOT NULL DEFAULT '',
+      ADD COLUMN `lastseen` int(11) NOT NULL DEFAULT '0';
+
+ALTER TABLE `room` ADD COLUMN `bu` varchar(64) NOT NULL DEFAULT '' AFTER `desc`;
+
+CREATE TABLE `room_ban` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `streamname` varchar(255) NOT NULL,
+      `type` int(11) NOT NULL,
+      `value` varchar(255) NOT NULL,
+      `createtime` int(11) NOT NULL,
+      PRIMARY KEY (`id`),
+      KEY `streamname` (`streamname`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `history` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `series` varchar(255) NOT NULL,
+      `resolution` int(11) NOT NULL,
+      `time` int(11) NOT NULL,
+      `avg` double NOT NULL,
+      `min` double NOT NULL,
+      `max` double NOT NULL,
+      PRIMARY KEY (`id`),
+      KEY `series_time` (`series`, `resolution`, `time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `stream_incident` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `streamname` varchar(255) NOT NULL,
+      `user` varchar(255) NOT NULL,
+      `state` varchar(20) NOT NULL,
+      `detail` varchar(255) NOT NULL DEFAULT '',
+      `starttime` int(11) NOT NULL,
+      `endtime` int(11) NOT NULL DEFAULT '0',
+      `kicked` tinyint(1) NOT NULL DEFAULT '0',
+      PRIMARY KEY (`id`),
+      KEY `streamname` (`streamname`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `viewer_geo` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `streamname` varchar(255) NOT NULL,
+      `hour` int(11) NOT NULL,
+      `province` varchar(32) NOT NULL,
+      `isp` varchar(32) NOT NULL,
+      `plays` int(11) NOT NULL DEFAULT '0',
+      PRIMARY KEY (`id`),
+      UNIQUE KEY `stream_hour_geo` (`streamname`, `hour`, `province`, `isp`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `usage_hourly` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `hour` int(11) NOT NULL,
+      `streamname` varchar(255) NOT NULL,
+      `user` varchar(255) NOT NULL DEFAULT '',
+      `bu` varchar(64) NOT NULL DEFAULT '',
+      `send_bytes` bigint(20) NOT NULL DEFAULT '0',
+      `recv_bytes` bigint(20) NOT NULL DEFAULT '0',
+      PRIMARY KEY (`id`),
+      UNIQUE KEY `hour_stream` (`hour`, `streamname`),
+      KEY `user_hour` (`user`, `hour`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
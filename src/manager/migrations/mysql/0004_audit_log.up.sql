@@ -0,0 +1,14 @@
+CREATE TABLE `audit_log` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `time` int(11) NOT NULL,
+      `actor` varchar(255) NOT NULL,
+      `ip` varchar(64) NOT NULL,
+      `action` varchar(64) NOT NULL,
+      `target` varchar(255) NOT NULL,
+      `payload` varchar(1024) NOT NULL,
+      `outcome` varchar(32) NOT NULL,
+      `reason` varchar(1024) NOT NULL,
+      PRIMARY KEY (`id`),
+      KEY `time` (`time`),
+      KEY `target_time` (`target`, `time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,11 @@
+CREATE TABLE `api_key` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `name` varchar(255) NOT NULL,
+      `keyhash` char(64) NOT NULL,
+      `role` varchar(32) NOT NULL,
+      `scopes` varchar(1024) NOT NULL DEFAULT '',
+      `expiration` int(11) NOT NULL DEFAULT '0',
+      `createtime` int(11) NOT NULL,
+      PRIMARY KEY (`id`),
+      UNIQUE KEY `keyhash` (`keyhash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
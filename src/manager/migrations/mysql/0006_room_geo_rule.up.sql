@@ -0,0 +1,10 @@
+CREATE TABLE `room_geo_rule` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `streamname` varchar(255) NOT NULL,
+      `action` varchar(16) NOT NULL,
+      `type` varchar(16) NOT NULL,
+      `value` varchar(255) NOT NULL,
+      `createtime` int(11) NOT NULL,
+      PRIMARY KEY (`id`),
+      KEY `streamname` (`streamname`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,9 @@
+CREATE TABLE `referer_rule` (
+      `id` bigint(20) NOT NULL AUTO_INCREMENT,
+      `scope` varchar(16) NOT NULL,
+      `name` varchar(255) NOT NULL,
+      `domain` varchar(255) NOT NULL,
+      `createtime` int(11) NOT NULL,
+      PRIMARY KEY (`id`),
+      KEY `scope_name` (`scope`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
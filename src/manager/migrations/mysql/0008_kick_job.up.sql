@@ -0,0 +1,14 @@
+CREATE TABLE `kick_job` (
+      `id` varchar(64) NOT NULL,
+      `streamname` varchar(255) NOT NULL,
+      `host` varchar(64) NOT NULL,
+      `clientid` int(11) NOT NULL,
+      `target` int(11) NOT NULL,
+      `status` int(11) NOT NULL,
+      `attempts` int(11) NOT NULL DEFAULT 0,
+      `lasterror` varchar(1024) NOT NULL DEFAULT '',
+      `createtime` int(11) NOT NULL,
+      `updatetime` int(11) NOT NULL,
+      PRIMARY KEY (`id`),
+      KEY `createtime` (`createtime`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
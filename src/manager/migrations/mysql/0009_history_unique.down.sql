@@ -0,0 +1 @@
+ALTER TABLE `history` DROP INDEX `series_time`, ADD KEY `series_time` (`series`, `resolution`, `time`);
@@ -0,0 +1,4 @@
+DELETE h1 FROM `history` h1 JOIN `history` h2
+      ON h1.`series` = h2.`series` AND h1.`resolution` = h2.`resolution` AND h1.`time` = h2.`time` AND h1.`id` < h2.`id`;
+
+ALTER TABLE `history` DROP INDEX `series_time`, ADD UNIQUE KEY `series_time` (`series`, `resolution`, `time`);
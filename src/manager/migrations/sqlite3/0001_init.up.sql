@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS `room` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `user` TEXT NOT NULL,
+      `desc` TEXT NOT NULL,
+      `streamname` TEXT NOT NULL UNIQUE,
+      `expiration` INTEGER NOT NULL,
+      `status` INTEGER NOT NULL,
+      `publishid` INTEGER DEFAULT -1,
+      `publishhost` TEXT DEFAULT '',
+      `lastupdatetime` INTEGER NOT NULL,
+      `createtime` INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS `srs_server` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `host` TEXT NOT NULL,
+      `desc` TEXT DEFAULT '',
+      `type` INTEGER NOT NULL,
+      `status` INTEGER NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE `srs_server` RENAME COLUMN `host` TO `addr`;
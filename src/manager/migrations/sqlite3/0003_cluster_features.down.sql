@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS `usage_hourly`;
+DROP TABLE IF EXISTS `viewer_geo`;
+DROP TABLE IF EXISTS `stream_incident`;
+DROP TABLE IF EXISTS `history`;
+DROP TABLE IF EXISTS `room_ban`;
+
+ALTER TABLE `room` DROP COLUMN `bu`;
+
+ALTER TABLE `srs_server` DROP COLUMN `lastseen`;
+ALTER TABLE `srs_server` DROP COLUMN `version`;
+ALTER TABLE `srs_server` DROP COLUMN `capacity`;
+ALTER TABLE `srs_server` DROP COLUMN `idc`;
@@ -0,0 +1,60 @@
+ALTER TABLE `srs_server` ADD COLUMN `idc` INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE `srs_server` ADD COLUMN `capacity` INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE `srs_server` ADD COLUMN `version` TEXT NOT NULL DEFAULT '';
+ALTER TABLE `srs_server` ADD COLUMN `lastseen` INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE `room` ADD COLUMN `bu` TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE `room_ban` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `streamname` TEXT NOT NULL,
+      `type` INTEGER NOT NULL,
+      `value` TEXT NOT NULL,
+      `createtime` INTEGER NOT NULL
+);
+CREATE INDEX `room_ban_streamname` ON `room_ban` (`streamname`);
+
+CREATE TABLE `history` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `series` TEXT NOT NULL,
+      `resolution` INTEGER NOT NULL,
+      `time` INTEGER NOT NULL,
+      `avg` REAL NOT NULL,
+      `min` REAL NOT NULL,
+      `max` REAL NOT NULL
+);
+CREATE INDEX `history_series_time` ON `history` (`series`, `resolution`, `time`);
+
+CREATE TABLE `stream_incident` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `streamname` TEXT NOT NULL,
+      `user` TEXT NOT NULL,
+      `state` TEXT NOT NULL,
+      `detail` TEXT NOT NULL DEFAULT '',
+      `starttime` INTEGER NOT NULL,
+      `endtime` INTEGER NOT NULL DEFAULT 0,
+      `kicked` INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX `stream_incident_streamname` ON `stream_incident` (`streamname`);
+
+CREATE TABLE `viewer_geo` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `streamname` TEXT NOT NULL,
+      `hour` INTEGER NOT NULL,
+      `province` TEXT NOT NULL,
+      `isp` TEXT NOT NULL,
+      `plays` INTEGER NOT NULL DEFAULT 0,
+      UNIQUE (`streamname`, `hour`, `province`, `isp`)
+);
+
+CREATE TABLE `usage_hourly` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `hour` INTEGER NOT NULL,
+      `streamname` TEXT NOT NULL,
+      `user` TEXT NOT NULL DEFAULT '',
+      `bu` TEXT NOT NULL DEFAULT '',
+      `send_bytes` INTEGER NOT NULL DEFAULT 0,
+      `recv_bytes` INTEGER NOT NULL DEFAULT 0,
+      UNIQUE (`hour`, `streamname`)
+);
+CREATE INDEX `usage_hourly_user_hour` ON `usage_hourly` (`user`, `hour`);
@@ -0,0 +1,13 @@
+CREATE TABLE `audit_log` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `time` INTEGER NOT NULL,
+      `actor` TEXT NOT NULL,
+      `ip` TEXT NOT NULL,
+      `action` TEXT NOT NULL,
+      `target` TEXT NOT NULL,
+      `payload` TEXT NOT NULL,
+      `outcome` TEXT NOT NULL,
+      `reason` TEXT NOT NULL
+);
+CREATE INDEX `audit_log_time` ON `audit_log` (`time`);
+CREATE INDEX `audit_log_target_time` ON `audit_log` (`target`, `time`);
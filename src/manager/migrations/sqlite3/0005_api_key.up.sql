@@ -0,0 +1,10 @@
+CREATE TABLE `api_key` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `name` TEXT NOT NULL,
+      `keyhash` TEXT NOT NULL,
+      `role` TEXT NOT NULL,
+      `scopes` TEXT NOT NULL DEFAULT '',
+      `expiration` INTEGER NOT NULL DEFAULT 0,
+      `createtime` INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX `api_key_keyhash` ON `api_key` (`keyhash`);
@@ -0,0 +1,9 @@
+CREATE TABLE `room_geo_rule` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `streamname` TEXT NOT NULL,
+      `action` TEXT NOT NULL,
+      `type` TEXT NOT NULL,
+      `value` TEXT NOT NULL,
+      `createtime` INTEGER NOT NULL
+);
+CREATE INDEX `room_geo_rule_streamname` ON `room_geo_rule` (`streamname`);
@@ -0,0 +1,8 @@
+CREATE TABLE `referer_rule` (
+      `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+      `scope` TEXT NOT NULL,
+      `name` TEXT NOT NULL,
+      `domain` TEXT NOT NULL,
+      `createtime` INTEGER NOT NULL
+);
+CREATE INDEX `referer_rule_scope_name` ON `referer_rule` (`scope`, `name`);
@@ -0,0 +1,13 @@
+CREATE TABLE `kick_job` (
+      `id` TEXT PRIMARY KEY,
+      `streamname` TEXT NOT NULL,
+      `host` TEXT NOT NULL,
+      `clientid` INTEGER NOT NULL,
+      `target` INTEGER NOT NULL,
+      `status` INTEGER NOT NULL,
+      `attempts` INTEGER NOT NULL DEFAULT 0,
+      `lasterror` TEXT NOT NULL DEFAULT '',
+      `createtime` INTEGER NOT NULL,
+      `updatetime` INTEGER NOT NULL
+);
+CREATE INDEX `kick_job_createtime` ON `kick_job` (`createtime`);
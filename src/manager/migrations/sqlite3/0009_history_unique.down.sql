@@ -0,0 +1,2 @@
+DROP INDEX `history_series_time`;
+CREATE INDEX `history_series_time` ON `history` (`series`, `resolution`, `time`);
@@ -0,0 +1,4 @@
+DELETE FROM `history` WHERE `id` NOT IN (SELECT MAX(`id`) FROM `history` GROUP BY `series`, `resolution`, `time`);
+
+DROP INDEX `history_series_time`;
+CREATE UNIQUE INDEX `history_series_time` ON `history` (`series`, `resolution`, `time`);
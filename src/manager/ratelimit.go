@@ -0,0 +1,306 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	RATE_KEY_IP      = "ip"      // 可信代理转发时取 X-REAL-IP 否则取连接地址
+	RATE_KEY_API_KEY = "api_key" // api key 的名称
+	RATE_KEY_USER    = "user"    // url 参数 user 或者创建 room 时的 Name
+
+	RATE_BUCKET_IDLE   = 10 * time.Minute // 长时间没有请求的桶会被清理
+	RATE_CLEANUP_EVERY = 1024             // 每隔多少次请求清理一次
+	RATE_OVERFLOW_KEY  = "*"              // 桶数达到上限后新的 key 共用的桶
+	RATE_PEEK_BODY_MAX = 64 << 10         // 读取 room 用户名时最多读的 body
+
+	DefaultRateMaxBuckets = 100000
+
+	HTTP_HEADER_RETRY_AFTER = "Retry-After"
+)
+
+type RateLimitRule struct {
+	Name   string  `json:"name"`
+	Method string  `json:"method"` // 为空匹配所有方法
+	Path   string  `json:"path"`   // 路径前缀
+	Key    string  `json:"key"`    // ip | api_key | user
+	Rate   float64 `json:"rate"`   // 每秒补充的令牌数
+	Burst  int     `json:"burst"`  // 桶容量
+}
+
+type RateLimitConfig struct {
+	Rules []RateLimitRule `json:"rules"`
+}
+
+func LoadRateLimitConfig(path string) (*RateLimitConfig, error) {
+	var c RateLimitConfig
+	if content, err := ioutil.ReadFile(path); err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("parse rate limit config %v err:%v", path, err)
+	}
+	names := make(map[string]bool)
+	for _, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rate limit rule %v", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return &c, nil
+}
+
+func (r *RateLimitRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rate limit rule name required")
+	}
+	switch r.Key {
+	case RATE_KEY_IP, RATE_KEY_API_KEY, RATE_KEY_USER:
+	default:
+		return fmt.Errorf("rate limit rule %v invalid key %v", r.Name, r.Key)
+	}
+	if r.Rate <= 0 || r.Burst <= 0 {
+		return fmt.Errorf("rate limit rule %v rate and burst must be positive", r.Name)
+	}
+	return nil
+}
+
+func (r *RateLimitRule) Match(req *http.Request) bool {
+	return (r.Method == "" || r.Method == req.Method) && strings.HasPrefix(req.URL.Path, r.Path)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 一条规则一组令牌桶 按 key 区分
+type TokenBucketLimiter struct {
+	rule       RateLimitRule
+	lock       sync.Mutex
+	buckets    map[string]*tokenBucket
+	maxBuckets int
+	calls      int
+}
+
+func NewTokenBucketLimiter(rule RateLimitRule) *TokenBucketLimiter {
+	return &TokenBucketLimiter{rule: rule, buckets: make(map[string]*tokenBucket), maxBuckets: DefaultRateMaxBuckets}
+}
+
+func (l *TokenBucketLimiter) setMaxBuckets(max int) {
+	l.lock.Lock()
+	l.maxBuckets = max
+	l.lock.Unlock()
+}
+
+// 拿到令牌返回 true 否则返回需要等待的时间
+func (l *TokenBucketLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.calls++; l.calls%RATE_CLEANUP_EVERY == 0 {
+		l.cleanup(now)
+	}
+	burst := float64(l.rule.Burst)
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= l.maxBuckets {
+		// 先清理空闲的桶 还是满的话共用一个桶 防止伪造大量 key 耗尽内存
+		l.cleanup(now)
+		if len(l.buckets) >= l.maxBuckets {
+			key = RATE_OVERFLOW_KEY
+			b, ok = l.buckets[key]
+		}
+	}
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rule.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / l.rule.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+func (l *TokenBucketLimiter) cleanup(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > RATE_BUCKET_IDLE {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *TokenBucketLimiter) Size() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.buckets)
+}
+
+type RateLimiter struct {
+	lock     sync.RWMutex
+	limiters []*TokenBucketLimiter
+	proxies  []*net.IPNet
+}
+
+func NewRateLimiter(config *Config) (*RateLimiter, error) {
+	r := &RateLimiter{}
+	var err error
+	if r.proxies, err = ParseCidrs(config.RateLimit.TrustedProxies); err != nil {
+		return nil, err
+	}
+	path := config.RateLimit.Rules
+	if path == "" {
+		return r, nil
+	}
+	c, err := LoadRateLimitConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range c.Rules {
+		l := NewTokenBucketLimiter(rule)
+		l.maxBuckets = config.RateLimit.MaxBuckets
+		r.limiters = append(r.limiters, l)
+	}
+	return r, nil
+}
+
+// 热加载时换成 next 的规则 没有变化的规则保留已有的令牌桶
+func (r *RateLimiter) Replace(next *RateLimiter) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	old := make(map[RateLimitRule]*TokenBucketLimiter, len(r.limiters))
+	for _, l := range r.limiters {
+		old[l.rule] = l
+	}
+	limiters := make([]*TokenBucketLimiter, 0, len(next.limiters))
+	for _, l := range next.limiters {
+		if existing, ok := old[l.rule]; ok {
+			existing.setMaxBuckets(l.maxBuckets)
+			l = existing
+		}
+		limiters = append(limiters, l)
+	}
+	r.limiters = limiters
+	r.proxies = next.proxies
+}
+
+// 按可信代理解析请求的来源地址
+func (r *RateLimiter) ClientIp(req *http.Request) string {
+	_, proxies := r.getLimiters()
+	return clientIp(req, proxies)
+}
+
+func (r *RateLimiter) getLimiters() ([]*TokenBucketLimiter, []*net.IPNet) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.limiters, r.proxies
+}
+
+// 连接来自可信代理时才取 X-REAL-IP 否则客户端可以随意伪造
+func clientIp(req *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if ip := req.Header.Get(HTTP_HEADER_CDN_IP); ip != "" && containsIp(proxies, host) {
+		return ip
+	}
+	return host
+}
+
+// 取不到 key 时这条规则不生效
+func rateLimitKey(req *http.Request, keyType string, proxies []*net.IPNet) string {
+	switch keyType {
+	case RATE_KEY_IP:
+		return clientIp(req, proxies)
+	case RATE_KEY_API_KEY:
+		if key := ApiKeyFromContext(req.Context()); key != nil {
+			return key.Name
+		}
+	case RATE_KEY_USER:
+		if user := req.URL.Query().Get(URL_PARAM_USER); user != "" {
+			return user
+		}
+		return peekRoomUser(req)
+	}
+	return ""
+}
+
+// 创建 room 时用户名在 body 中 读出后放回去
+func peekRoomUser(req *http.Request) string {
+	if req.Method != HTTP_POST || req.Body == nil {
+		return ""
+	}
+	// 只读前面一部分 剩下的留给 handler
+	body := req.Body
+	content, err := ioutil.ReadAll(io.LimitReader(body, RATE_PEEK_BODY_MAX+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(content), body), body}
+	if err != nil {
+		return ""
+	} else if len(content) > RATE_PEEK_BODY_MAX {
+		// 不能靠超大的 body 绕过限流
+		return RATE_OVERFLOW_KEY
+	}
+	var room RoomCreateReq
+	if json.Unmarshal(content, &room) != nil {
+		return ""
+	}
+	return room.Name
+}
+
+// 命中的规则都要拿到令牌 被限制时写入 429
+func (r *RateLimiter) Check(w http.ResponseWriter, req *http.Request) bool {
+	now := time.Now()
+	limiters, proxies := r.getLimiters()
+	for _, l := range limiters {
+		if !l.rule.Match(req) {
+			continue
+		}
+		key := rateLimitKey(req, l.rule.Key, proxies)
+		if key == "" {
+			continue
+		}
+		if ok, wait := l.Allow(key, now); !ok {
+			retry := int(math.Ceil(wait.Seconds()))
+			metrics.Inc(METRIC_RATE_LIMITED_TOTAL, "rule", l.rule.Name, "key", l.rule.Key)
+			glog.Warningln("rate limited", l.rule.Name, key, req.Method, req.URL.Path, "retry after", retry)
+			w.Header().Set(HTTP_HEADER_RETRY_AFTER, strconv.Itoa(retry))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RateLimiter) WriteMetrics(w io.Writer) {
+	limiters, _ := r.getLimiters()
+	if len(limiters) == 0 {
+		return
+	}
+	buckets := NewGaugeVec(METRIC_RATE_LIMIT_BUCKETS)
+	for _, l := range limiters {
+		buckets.Set(float64(l.Size()), "rule", l.rule.Name)
+	}
+	buckets.Write(w)
+}
@@ -0,0 +1,119 @@
+package manager
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"utils"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	l := NewTokenBucketLimiter(RateLimitRule{Name: "t", Key: RATE_KEY_IP, Rate: 2, Burst: 2})
+	now := time.Unix(1000, 0)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a", now); !ok {
+			t.Fatalf("request %v within burst limited", i)
+		}
+	}
+	ok, wait := l.Allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("over burst got %v wait %v", ok, wait)
+	}
+	if ok, _ = l.Allow("b", now); !ok {
+		t.Errorf("other key should not be limited")
+	}
+	if ok, _ = l.Allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("token should refill after wait")
+	}
+}
+
+func TestRateLimiterCheck(t *testing.T) {
+	r := &RateLimiter{limiters: []*TokenBucketLimiter{
+		NewTokenBucketLimiter(RateLimitRule{Name: "create", Method: HTTP_POST, Path: URL_PATH_ROOM, Key: RATE_KEY_USER, Rate: 0.1, Burst: 1}),
+	}}
+	post := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(HTTP_POST, URL_PATH_ROOM, strings.NewReader(`{"Name":"`+user+`"}`))
+		w := httptest.NewRecorder()
+		if r.Check(w, req) {
+			// body 被读过后需要还能再读
+			var room RoomCreateReq
+			if err := utils.ReadAndUnmarshalObject(req.Body, &room); err != nil || room.Name != user {
+				t.Errorf("body after check %+v err:%v", room, err)
+			}
+		}
+		return w
+	}
+	if w := post("u1"); w.Code != http.StatusOK {
+		t.Errorf("first request got %v", w.Code)
+	}
+	w := post("u1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get(HTTP_HEADER_RETRY_AFTER) != "10" {
+		t.Errorf("second request got %v retry %v", w.Code, w.Header().Get(HTTP_HEADER_RETRY_AFTER))
+	}
+	if w = post("u2"); w.Code != http.StatusOK {
+		t.Errorf("other user got %v", w.Code)
+	}
+	req := httptest.NewRequest(HTTP_GET, URL_PATH_ROOM+"/s1", nil)
+	if !r.Check(httptest.NewRecorder(), req) {
+		t.Errorf("GET should not match POST rule")
+	}
+}
+
+func TestRateLimiterReplace(t *testing.T) {
+	keep := RateLimitRule{Name: "keep", Key: RATE_KEY_IP, Rate: 1, Burst: 1}
+	r := &RateLimiter{limiters: []*TokenBucketLimiter{NewTokenBucketLimiter(keep)}}
+	kept := r.limiters[0]
+	r.Replace(&RateLimiter{limiters: []*TokenBucketLimiter{
+		NewTokenBucketLimiter(keep),
+		NewTokenBucketLimiter(RateLimitRule{Name: "new", Key: RATE_KEY_IP, Rate: 2, Burst: 2}),
+	}})
+	if len(r.limiters) != 2 || r.limiters[0] != kept {
+		t.Errorf("unchanged rule should keep its buckets %+v", r.limiters)
+	}
+}
+
+// 只信任代理转发的 X-REAL-IP 桶数有上限 超大的 body 不会整个读出
+func TestRateLimiterUntrustedKeys(t *testing.T) {
+	config := DefaultConfig()
+	config.RateLimit.TrustedProxies = "10.0.0.0/8"
+	r, err := NewRateLimiter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewTokenBucketLimiter(RateLimitRule{Name: "ip", Key: RATE_KEY_IP, Rate: 1, Burst: 1})
+	l.maxBuckets = 2
+	r.limiters = []*TokenBucketLimiter{l}
+
+	get := func(remote, realIp string) int {
+		req := httptest.NewRequest(HTTP_GET, URL_PATH_ROOM, nil)
+		req.RemoteAddr = remote + ":5000"
+		req.Header.Set(HTTP_HEADER_CDN_IP, realIp)
+		w := httptest.NewRecorder()
+		r.Check(w, req)
+		return w.Code
+	}
+	if get("6.6.6.6", "1.1.1.1") != http.StatusOK || get("6.6.6.6", "2.2.2.2") != http.StatusTooManyRequests {
+		t.Errorf("X-REAL-IP from untrusted client should be ignored")
+	}
+	if get("10.0.0.1", "1.1.1.1") != http.StatusOK {
+		t.Errorf("X-REAL-IP from trusted proxy should be used")
+	}
+	if get("10.0.0.1", "3.3.3.3") != http.StatusOK || get("10.0.0.1", "4.4.4.4") != http.StatusTooManyRequests {
+		t.Errorf("keys over maxBuckets should share one bucket")
+	}
+	if n := l.Size(); n != 3 {
+		t.Errorf("buckets got %v", n)
+	}
+
+	big := strings.NewReader(`{"Name":"` + strings.Repeat("x", RATE_PEEK_BODY_MAX) + `"}`)
+	req := httptest.NewRequest(HTTP_POST, URL_PATH_ROOM, big)
+	if user := peekRoomUser(req); user != RATE_OVERFLOW_KEY {
+		t.Errorf("oversized body got user %.10v", user)
+	}
+	if content, _ := ioutil.ReadAll(req.Body); len(content) != RATE_PEEK_BODY_MAX+11 {
+		t.Errorf("body after peek got %v bytes", len(content))
+	}
+}
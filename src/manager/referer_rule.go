@@ -0,0 +1,249 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	REFERER_SCOPE_ROOM = "room"
+	REFERER_SCOPE_APP  = "app"
+
+	REFERER_WILDCARD = "*"
+)
+
+type RefererRule struct {
+	Id         int64
+	Scope      string // room | app
+	Name       string // 流名或者 app 名
+	Domain     string // example.com | *.example.com | *
+	CreateTime int64
+}
+
+type ReqRefererRule struct {
+	Domain string `json:"domain"`
+}
+
+// *.example.com 只匹配子域名 不匹配 example.com
+func (r *RefererRule) Match(host string) bool {
+	if r.Domain == REFERER_WILDCARD {
+		return host != ""
+	}
+	if strings.HasPrefix(r.Domain, "*.") {
+		return strings.HasSuffix(host, r.Domain[1:])
+	}
+	return host == r.Domain
+}
+
+// pageUrl 中的域名 没有 scheme 时按 http 处理
+func RefererHost(pageUrl string) string {
+	if pageUrl = strings.TrimSpace(pageUrl); pageUrl == "" {
+		return ""
+	}
+	if !strings.Contains(pageUrl, "://") {
+		pageUrl = "http://" + pageUrl
+	}
+	u, err := url.Parse(pageUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func refererKey(scope, name string) string {
+	return scope + "/" + name
+}
+
+// 来源域名白名单 room 有规则时只看 room 的规则 否则看 app 的规则
+// 都没有规则时不限制
+// pageUrl 为空 (例如直接用 ffmpeg 拉流) 时由 referer.allowEmpty 决定
+type RefererRules struct {
+	db         Store
+	audit      *AuditLog
+	allowEmpty bool
+	lock       sync.RWMutex
+	rules      map[string][]*RefererRule
+}
+
+func NewRefererRules(config *Config, db Store, audit *AuditLog) *RefererRules {
+	r := &RefererRules{
+		db:    db,
+		audit: audit,
+		rules: make(map[string][]*RefererRule),
+	}
+	r.ApplyConfig(config)
+	return r
+}
+
+func (r *RefererRules) ApplyConfig(config *Config) {
+	r.lock.Lock()
+	r.allowEmpty = config.Referer.AllowEmpty
+	r.lock.Unlock()
+}
+
+func (r *RefererRules) Load(ctx context.Context) error {
+	rules, err := r.db.LoadRefererRules(ctx)
+	if err != nil {
+		return fmt.Errorf("Load referer rules error:%v", err)
+	}
+	r.lock.Lock()
+	for _, rule := range rules {
+		key := refererKey(rule.Scope, rule.Name)
+		r.rules[key] = append(r.rules[key], rule)
+	}
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *RefererRules) Add(ctx context.Context, scope, name, domain string) (*RefererRule, error) {
+	if scope != REFERER_SCOPE_ROOM && scope != REFERER_SCOPE_APP {
+		return nil, fmt.Errorf("invalid referer scope %v", scope)
+	}
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	host := strings.TrimPrefix(domain, "*.")
+	if name == "" || domain == "" || (domain != REFERER_WILDCARD && (host == "" || strings.ContainsAny(host, "*/:"))) {
+		return nil, fmt.Errorf("invalid referer rule %v %v", name, domain)
+	}
+	rule := &RefererRule{Scope: scope, Name: name, Domain: domain, CreateTime: time.Now().Unix()}
+	if err := r.db.InsertRefererRule(ctx, rule); err != nil {
+		return nil, err
+	}
+	key := refererKey(scope, name)
+	r.lock.Lock()
+	r.rules[key] = append(r.rules[key], rule)
+	r.lock.Unlock()
+	return rule, nil
+}
+
+func (r *RefererRules) Remove(ctx context.Context, scope, name string, id int64) error {
+	key := refererKey(scope, name)
+	r.lock.RLock()
+	var found bool
+	for _, rule := range r.rules[key] {
+		if rule.Id == id {
+			found = true
+			break
+		}
+	}
+	r.lock.RUnlock()
+	if !found {
+		return fmt.Errorf("referer rule %v id:%v not exists", key, id)
+	}
+	if err := r.db.DeleteRefererRule(ctx, id); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rules := r.rules[key]
+	for i, rule := range rules {
+		if rule.Id == id {
+			r.rules[key] = append(rules[:i], rules[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *RefererRules) Get(scope, name string) []*RefererRule {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	rules := r.rules[refererKey(scope, name)]
+	result := make([]*RefererRule, len(rules))
+	copy(result, rules)
+	return result
+}
+
+// 不允许时返回拒绝原因 streamName 可以为空
+func (r *RefererRules) Check(appName, streamName, pageUrl, action string) error {
+	scope, name := REFERER_SCOPE_ROOM, streamName
+	rules := r.Get(scope, name)
+	if streamName == "" || len(rules) == 0 {
+		scope, name = REFERER_SCOPE_APP, appName
+		rules = r.Get(scope, name)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	r.lock.RLock()
+	allowEmpty := r.allowEmpty
+	r.lock.RUnlock()
+	host := RefererHost(pageUrl)
+	if host == "" && allowEmpty {
+		return nil
+	}
+	for _, rule := range rules {
+		if rule.Match(host) {
+			return nil
+		}
+	}
+	metrics.Inc(METRIC_REFERER_DENIED_TOTAL, "action", action, "scope", scope)
+	return fmt.Errorf("%v %v pageUrl:%v not in referer allowlist", scope, name, pageUrl)
+}
+
+// /referer/{scope}/{name}        GET | POST {"domain": ""}
+// /referer/{scope}/{name}/{id}   DELETE
+func (r *RefererRules) HttpHandler(w http.ResponseWriter, req *http.Request) {
+	var err error
+	args := GetUrlParams(req.URL.Path, URL_PATH_REFERER)
+	if len(args) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		glog.Warningln("RefererRules invalid args", args)
+		return
+	}
+	scope, name := args[0], args[1]
+	target := refererKey(scope, name)
+	switch req.Method {
+	case HTTP_GET:
+		err = utils.WriteObjectResponse(w, r.Get(scope, name))
+	case HTTP_POST:
+		var (
+			request ReqRefererRule
+			rule    *RefererRule
+		)
+		if err = utils.ReadAndUnmarshalObject(req.Body, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		rule, err = r.Add(req.Context(), scope, name, request.Domain)
+		entry := NewAuditEntry(req, AUDIT_REFERER_ADD, target)
+		entry.Payload = fmt.Sprintf("domain=%v", request.Domain)
+		r.audit.Record(entry, err)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		err = utils.WriteObjectResponse(w, rule)
+	case HTTP_DELETE:
+		var id int64
+		if len(args) == 3 {
+			id, err = strconv.ParseInt(args[2], 10, 64)
+		}
+		if len(args) != 3 || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			err = fmt.Errorf("invalid args %v", args)
+			break
+		}
+		err = r.Remove(req.Context(), scope, name, id)
+		entry := NewAuditEntry(req, AUDIT_REFERER_REMOVE, target)
+		entry.Payload = fmt.Sprintf("id=%v", id)
+		r.audit.Record(entry, err)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	if err != nil {
+		glog.Warningln("RefererRules", req.Method, args, err)
+	}
+}
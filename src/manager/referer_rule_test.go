@@ -0,0 +1,80 @@
+package manager
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRefererHost(t *testing.T) {
+	cases := map[string]string{
+		"http://WWW.Example.com:8080/live.html?a=1": "www.example.com",
+		"https://a.example.com/":                    "a.example.com",
+		"example.com/page":                          "example.com",
+		"":                                          "",
+	}
+	for pageUrl, host := range cases {
+		if got := RefererHost(pageUrl); got != host {
+			t.Errorf("RefererHost(%v) = %v, want %v", pageUrl, got, host)
+		}
+	}
+}
+
+func TestRefererRulesCheck(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	r := NewRefererRules(DefaultConfig(), db, nil)
+
+	if err := r.Check("live", "s1", "http://pirate.com/", SRS_CB_ACTION_ON_PLAY); err != nil {
+		t.Fatalf("no rules should allow %v", err)
+	}
+	for _, domain := range []string{"", "*.", "a.*.com", "http://a.com"} {
+		if _, err := r.Add(ctx, REFERER_SCOPE_APP, "live", domain); err == nil {
+			t.Errorf("invalid domain %q should fail", domain)
+		}
+	}
+	if _, err := r.Add(ctx, REFERER_SCOPE_APP, "live", "*.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	room, err := r.Add(ctx, REFERER_SCOPE_ROOM, "s1", "partner.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		stream  string
+		pageUrl string
+		allow   bool
+	}{
+		{"", "http://www.example.com/a.html", true}, // connect 时没有流名 只看 app
+		{"", "http://example.com/", false},          // 通配符不匹配主域名
+		{"s2", "https://cdn.example.com/", true},
+		{"s2", "http://pirate.com/", false},
+		{"s2", "", false},
+		{"s1", "http://partner.com/", true}, // room 有规则时不看 app 的规则
+		{"s1", "http://www.example.com/", false},
+	}
+	for _, c := range cases {
+		if err := r.Check("live", c.stream, c.pageUrl, SRS_CB_ACTION_ON_PLAY); (err == nil) != c.allow {
+			t.Errorf("stream %v pageUrl %v expect allow %v got %v", c.stream, c.pageUrl, c.allow, err)
+		}
+	}
+	if err := r.Check("other", "s2", "http://pirate.com/", SRS_CB_ACTION_ON_CONNECT); err != nil {
+		t.Errorf("rules of other app should not apply %v", err)
+	}
+
+	if err := r.Remove(ctx, REFERER_SCOPE_ROOM, "s1", room.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check("live", "s1", "http://www.example.com/", SRS_CB_ACTION_ON_PLAY); err != nil {
+		t.Errorf("room rule removed, app rules should apply %v", err)
+	}
+
+	reload := NewRefererRules(DefaultConfig(), db, nil)
+	reload.allowEmpty = true
+	if err := reload.Load(ctx); err != nil || len(reload.Get(REFERER_SCOPE_APP, "live")) != 1 {
+		t.Fatalf("reload rules %v %v", reload.Get(REFERER_SCOPE_APP, "live"), err)
+	}
+	if err := reload.Check("live", "s2", "", SRS_CB_ACTION_ON_PLAY); err != nil {
+		t.Errorf("empty pageUrl should be allowed %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+var ErrNoManager = errors.New("manager not initialized")
+
+// 收到 SIGHUP 时调用 重新读取启动时的配置文件
+func ReloadConfig() error {
+	if manager == nil {
+		return ErrNoManager
+	}
+	_, err := manager.ReloadFromFile()
+	return err
+}
+
+func (s *SrsManager) Config() *Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config
+}
+
+func (s *SrsManager) ReloadFromFile() (*Config, error) {
+	config, err := LoadConfig(s.configPath)
+	if err != nil {
+		metrics.Inc(METRIC_CONFIG_RELOADS_TOTAL, "result", "error")
+		glog.Warningln("Reload config", s.configPath, err)
+		return nil, err
+	}
+	return s.Reload(config)
+}
+
+// 先准备好所有可能失败的部分 全部成功后再应用到各个模块
+// port http db 和 ip 库需要重启 保留原来的值
+func (s *SrsManager) Reload(config *Config) (*Config, error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	result := "error"
+	defer func() { metrics.Inc(METRIC_CONFIG_RELOADS_TOTAL, "result", result) }()
+
+	c := *config
+	old := s.Config()
+	if c.Port != old.Port || c.HTTP != old.HTTP || c.DB != old.DB || c.Dispatch.IpDatabase != old.Dispatch.IpDatabase {
+		glog.Warningln("Reload config: port, http, db and dispatch.ipDatabase need restart, keep old values")
+	}
+	c.Port, c.HTTP, c.DB, c.Dispatch.IpDatabase = old.Port, old.HTTP, old.DB, old.Dispatch.IpDatabase
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	limiter, err := NewRateLimiter(&c)
+	if err != nil {
+		return nil, fmt.Errorf("rateLimit.rules: %v", err)
+	}
+	guard, err := NewEventGuard(&c, s.srsServerManager)
+	if err != nil {
+		return nil, fmt.Errorf("event: %v", err)
+	}
+	rules, notifiers, err := LoadAlertRules(c.Alert.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("alert.rules: %v", err)
+	}
+	if err = s.auth.Load(context.Background()); err != nil {
+		return nil, fmt.Errorf("Load api keys failed:%v", err)
+	}
+
+	s.limiter.Replace(limiter)
+	s.eventManager.guard.Replace(guard)
+	s.alertManager.SetRules(rules, notifiers)
+	s.auth.ApplyConfig(&c)
+	s.srsServerManager.ApplyConfig(&c)
+	s.roomManager.ApplyConfig(&c)
+	s.kickManager.ApplyConfig(&c)
+	s.stallDetector.ApplyConfig(&c)
+	s.history.ApplyConfig(&c)
+	s.audit.ApplyConfig(&c)
+	s.referers.ApplyConfig(&c)
+
+	s.configLock.Lock()
+	s.config = &c
+	s.configLock.Unlock()
+	result = "ok"
+	glog.Infoln("Reload config success")
+	return &c, nil
+}
+
+// /admin/config  GET  当前生效的配置 密钥已隐藏
+// /admin/reload  POST 重新读取配置文件
+func (s *SrsManager) configHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.URL.Path == URL_PATH_ADMIN_CONFIG && r.Method == HTTP_GET {
+		err = utils.WriteObjectResponse(w, s.Config().Redacted())
+	} else if r.URL.Path == URL_PATH_ADMIN_RELOAD && r.Method == HTTP_POST {
+		var config *Config
+		config, err = s.ReloadFromFile()
+		s.audit.Record(NewAuditEntry(r, AUDIT_CONFIG_RELOAD, s.configPath), err)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			utils.WriteObjectResponse(w, map[string]string{"error": err.Error()})
+		} else {
+			err = utils.WriteObjectResponse(w, config.Redacted())
+		}
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	if err != nil {
+		glog.Warningln("configHandler", r.Method, r.URL.Path, err)
+	}
+}
@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	BAN_TYPE_IP   = iota // 按客户端IP封禁
+	BAN_TYPE_USER        // 按用户ID封禁 用户ID取自播放地址的user参数
+
+	STR_BAN_TYPE_IP   = "ip"
+	STR_BAN_TYPE_USER = "user"
+
+	URL_PARAM_USER   = "user"
+	URL_PARAM_STREAM = "stream"
+)
+
+type RoomBan struct {
+	Id         int64
+	StreamName string
+	Type       int
+	Value      string
+	CreateTime int64
+}
+
+type ReqRoomBan struct {
+	Type  string `json:"type"` // ip | user
+	Value string `json:"value"`
+}
+
+func GetBanType(name string) int {
+	switch name {
+	case STR_BAN_TYPE_IP:
+		return BAN_TYPE_IP
+	case STR_BAN_TYPE_USER:
+		return BAN_TYPE_USER
+	default:
+		return -1
+	}
+}
+
+// 每个room的黑名单 启动时从db加载 修改时同步写db
+type BanList struct {
+	db   Store
+	lock sync.RWMutex
+	bans map[string][]*RoomBan
+}
+
+func NewBanList(db Store) *BanList {
+	return &BanList{db: db, bans: make(map[string][]*RoomBan)}
+}
+
+func (b *BanList) Load(ctx context.Context) error {
+	bans, err := b.db.LoadRoomBans(ctx)
+	if err != nil {
+		return fmt.Errorf("Load room bans error:%v", err)
+	}
+	b.lock.Lock()
+	for _, ban := range bans {
+		b.bans[ban.StreamName] = append(b.bans[ban.StreamName], ban)
+	}
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *BanList) Add(ctx context.Context, streamName string, req ReqRoomBan) (*RoomBan, error) {
+	banType := GetBanType(req.Type)
+	if banType < 0 || req.Value == "" {
+		return nil, fmt.Errorf("invalid ban type:%v value:%v", req.Type, req.Value)
+	}
+	if ban := b.find(streamName, banType, req.Value); ban != nil {
+		return ban, nil
+	}
+
+	ban := &RoomBan{
+		StreamName: streamName,
+		Type:       banType,
+		Value:      req.Value,
+		CreateTime: time.Now().Unix(),
+	}
+	if err := b.db.InsertRoomBan(ctx, ban); err != nil {
+		return nil, err
+	}
+	b.lock.Lock()
+	b.bans[streamName] = append(b.bans[streamName], ban)
+	b.lock.Unlock()
+	return ban, nil
+}
+
+func (b *BanList) Remove(ctx context.Context, streamName string, banType int, value string) error {
+	ban := b.find(streamName, banType, value)
+	if ban == nil {
+		return fmt.Errorf("ban stream:%v type:%v value:%v not exists", streamName, banType, value)
+	}
+	if err := b.db.DeleteRoomBan(ctx, ban.Id); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bans := b.bans[streamName]
+	for i, v := range bans {
+		if v == ban {
+			b.bans[streamName] = append(bans[:i], bans[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (b *BanList) Get(streamName string) []*RoomBan {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	result := make([]*RoomBan, len(b.bans[streamName]))
+	copy(result, b.bans[streamName])
+	return result
+}
+
+// 返回命中的封禁规则 没有命中返回nil
+func (b *BanList) Match(streamName, ip, user string) *RoomBan {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, ban := range b.bans[streamName] {
+		if ban.Type == BAN_TYPE_IP && ban.Value == ip {
+			return ban
+		}
+		if ban.Type == BAN_TYPE_USER && user != "" && ban.Value == user {
+			return ban
+		}
+	}
+	return nil
+}
+
+func (b *BanList) find(streamName string, banType int, value string) *RoomBan {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, ban := range b.bans[streamName] {
+		if ban.Type == banType && ban.Value == value {
+			return ban
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	GEO_ACTION_ALLOW = "allow"
+	GEO_ACTION_DENY  = "deny"
+
+	GEO_TYPE_PROVINCE = "province" // ip 库中的省份 例如 beijing
+	GEO_TYPE_ISP      = "isp"      // ct | cnc | cmcc 或者 guangdong_ct
+	GEO_TYPE_CIDR     = "cidr"
+
+	GEO_CHECK_PLAY     = "play"
+	GEO_CHECK_DISPATCH = "dispatch"
+
+	URL_SUB_PATH_GEO_RULES = "geo"
+)
+
+type RoomGeoRule struct {
+	Id         int64
+	StreamName string
+	Action     string // allow | deny
+	Type       string // province | isp | cidr
+	Value      string
+	CreateTime int64
+}
+
+type ReqRoomGeoRule struct {
+	Action string `json:"action"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+}
+
+func (r *RoomGeoRule) Validate() error {
+	if r.Action != GEO_ACTION_ALLOW && r.Action != GEO_ACTION_DENY {
+		return fmt.Errorf("invalid geo rule action %v", r.Action)
+	}
+	switch r.Type {
+	case GEO_TYPE_PROVINCE, GEO_TYPE_ISP:
+		if r.Value == "" {
+			return fmt.Errorf("geo rule %v value required", r.Type)
+		}
+	case GEO_TYPE_CIDR:
+		if _, _, err := net.ParseCIDR(r.Value); err != nil {
+			return fmt.Errorf("invalid geo rule cidr %v", r.Value)
+		}
+	default:
+		return fmt.Errorf("invalid geo rule type %v", r.Type)
+	}
+	return nil
+}
+
+// subnet 为空表示 ip 库中查不到 只能按 cidr 匹配
+func (r *RoomGeoRule) Match(ip net.IP, subnet *SubNet) bool {
+	switch r.Type {
+	case GEO_TYPE_PROVINCE:
+		return subnet != nil && subnet.Province == r.Value
+	case GEO_TYPE_ISP:
+		return subnet != nil && (subnet.SupperIsp == r.Value || subnet.Ispname == r.Value)
+	case GEO_TYPE_CIDR:
+		_, cidr, err := net.ParseCIDR(r.Value)
+		return err == nil && ip != nil && cidr.Contains(ip)
+	}
+	return false
+}
+
+func (r *RoomGeoRule) String() string {
+	return fmt.Sprintf("%v %v=%v(#%v)", r.Action, r.Type, r.Value, r.Id)
+}
+
+// 每个room的地域限制 启动时从db加载 修改时同步写db
+// 命中任意 deny 规则拒绝 有 allow 规则时必须命中其中一条
+type GeoRules struct {
+	db     Store
+	lookup func(ip string) (*SubNet, error) // IpDatabase.GetSubNet
+	lock   sync.RWMutex
+	rules  map[string][]*RoomGeoRule
+}
+
+func NewGeoRules(db Store, lookup func(ip string) (*SubNet, error)) *GeoRules {
+	return &GeoRules{db: db, lookup: lookup, rules: make(map[string][]*RoomGeoRule)}
+}
+
+func (g *GeoRules) Load(ctx context.Context) error {
+	rules, err := g.db.LoadRoomGeoRules(ctx)
+	if err != nil {
+		return fmt.Errorf("Load room geo rules error:%v", err)
+	}
+	g.lock.Lock()
+	for _, rule := range rules {
+		g.rules[rule.StreamName] = append(g.rules[rule.StreamName], rule)
+	}
+	g.lock.Unlock()
+	return nil
+}
+
+func (g *GeoRules) Add(ctx context.Context, streamName string, req ReqRoomGeoRule) (*RoomGeoRule, error) {
+	rule := &RoomGeoRule{
+		StreamName: streamName,
+		Action:     req.Action,
+		Type:       req.Type,
+		Value:      req.Value,
+		CreateTime: time.Now().Unix(),
+	}
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+	if err := g.db.InsertRoomGeoRule(ctx, rule); err != nil {
+		return nil, err
+	}
+	g.lock.Lock()
+	g.rules[streamName] = append(g.rules[streamName], rule)
+	g.lock.Unlock()
+	return rule, nil
+}
+
+func (g *GeoRules) Remove(ctx context.Context, streamName string, id int64) error {
+	g.lock.RLock()
+	var found bool
+	for _, rule := range g.rules[streamName] {
+		if rule.Id == id {
+			found = true
+			break
+		}
+	}
+	g.lock.RUnlock()
+	if !found {
+		return fmt.Errorf("geo rule stream:%v id:%v not exists", streamName, id)
+	}
+	if err := g.db.DeleteRoomGeoRule(ctx, id); err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	rules := g.rules[streamName]
+	for i, rule := range rules {
+		if rule.Id == id {
+			g.rules[streamName] = append(rules[:i], rules[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (g *GeoRules) Get(streamName string) []*RoomGeoRule {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	result := make([]*RoomGeoRule, len(g.rules[streamName]))
+	copy(result, g.rules[streamName])
+	return result
+}
+
+// 不允许时返回拒绝原因
+func (g *GeoRules) Check(streamName, addr, where string) error {
+	rules := g.Get(streamName)
+	if len(rules) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(addr)
+	subnet, _ := g.lookup(addr)
+	region := "unknown"
+	if subnet != nil {
+		region = subnet.Province + "/" + subnet.SupperIsp
+	}
+
+	var hasAllow, allowed bool
+	for _, rule := range rules {
+		if rule.Action == GEO_ACTION_ALLOW {
+			hasAllow = true
+			allowed = allowed || rule.Match(ip, subnet)
+		} else if rule.Match(ip, subnet) {
+			metrics.Inc(METRIC_GEO_DENIED_TOTAL, "where", where, "reason", GEO_ACTION_DENY)
+			return fmt.Errorf("stream:%v ip:%v region:%v denied by rule %v", streamName, addr, region, rule)
+		}
+	}
+	if hasAllow && !allowed {
+		metrics.Inc(METRIC_GEO_DENIED_TOTAL, "where", where, "reason", "not_allowed")
+		return fmt.Errorf("stream:%v ip:%v region:%v not in allow rules", streamName, addr, region)
+	}
+	return nil
+}
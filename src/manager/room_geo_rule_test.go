@@ -0,0 +1,65 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGeoRulesCheck(t *testing.T) {
+	lookup := func(ip string) (*SubNet, error) {
+		switch ip {
+		case "1.1.1.1":
+			return &SubNet{Province: "beijing", SupperIsp: "cnc", Ispname: "beijing_cnc"}, nil
+		case "2.2.2.2":
+			return &SubNet{Province: "guangdong", SupperIsp: "ct", Ispname: "guangdong_ct"}, nil
+		}
+		return nil, errors.New("not found")
+	}
+	ctx := context.Background()
+	db := NewMemStore()
+	g := NewGeoRules(db, lookup)
+
+	if err := g.Check("s1", "2.2.2.2", GEO_CHECK_PLAY); err != nil {
+		t.Fatalf("no rules should allow %v", err)
+	}
+	if _, err := g.Add(ctx, "s1", ReqRoomGeoRule{Action: GEO_ACTION_ALLOW, Type: GEO_TYPE_CIDR, Value: "bad"}); err == nil {
+		t.Errorf("invalid cidr should fail")
+	}
+	if _, err := g.Add(ctx, "s1", ReqRoomGeoRule{Action: GEO_ACTION_ALLOW, Type: GEO_TYPE_PROVINCE, Value: "beijing"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Add(ctx, "s1", ReqRoomGeoRule{Action: GEO_ACTION_ALLOW, Type: GEO_TYPE_CIDR, Value: "10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	deny, err := g.Add(ctx, "s1", ReqRoomGeoRule{Action: GEO_ACTION_DENY, Type: GEO_TYPE_ISP, Value: "cnc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"1.1.1.1":  false, // 省份允许 但运营商被拒绝
+		"2.2.2.2":  false, // 不在允许的省份
+		"10.1.2.3": true,  // ip 库查不到 命中 cidr
+		"3.3.3.3":  false,
+	}
+	for ip, allow := range cases {
+		if err := g.Check("s1", ip, GEO_CHECK_PLAY); (err == nil) != allow {
+			t.Errorf("ip %v expect allow %v got %v", ip, allow, err)
+		}
+	}
+	if err := g.Check("s2", "2.2.2.2", GEO_CHECK_DISPATCH); err != nil {
+		t.Errorf("rules of other stream should not apply %v", err)
+	}
+
+	if err := g.Remove(ctx, "s1", deny.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Check("s1", "1.1.1.1", GEO_CHECK_DISPATCH); err != nil {
+		t.Errorf("deny rule removed %v", err)
+	}
+	reload := NewGeoRules(db, lookup)
+	if err := reload.Load(ctx); err != nil || len(reload.Get("s1")) != 2 {
+		t.Errorf("reload rules %v %v", reload.Get("s1"), err)
+	}
+}
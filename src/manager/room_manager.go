@@ -1,9 +1,12 @@
 package manager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 	"utils"
 
@@ -17,6 +20,14 @@ const (
 	HTTP_DELETE = "DELETE"
 
 	HTTP_HEADER_CDN_IP = "X-REAL-IP"
+
+	URL_SUB_PATH_VIEWERS = "viewers"
+	URL_SUB_PATH_BANS    = "bans"
+)
+
+var (
+	ErrClientNotFound  = errors.New("client not found")
+	ErrClientAmbiguous = errors.New("client id matches more than one edge, host required")
 )
 
 func (r *RoomManager) HttpHandler(w http.ResponseWriter, req *http.Request) {
@@ -25,6 +36,19 @@ func (r *RoomManager) HttpHandler(w http.ResponseWriter, req *http.Request) {
 
 	args := GetUrlParams(req.URL.Path, URL_PATH_ROOM)
 	argsLen := len(args)
+	if argsLen >= 2 {
+		switch args[1] {
+		case URL_SUB_PATH_VIEWERS:
+			r.viewersHandler(w, req, args)
+		case URL_SUB_PATH_BANS:
+			r.bansHandler(w, req, args)
+		case URL_SUB_PATH_GEO_RULES:
+			r.geoRulesHandler(w, req, args)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
 
 	remoteAddr := req.Header.Get(HTTP_HEADER_CDN_IP)
 	switch req.Method {
@@ -34,10 +58,16 @@ func (r *RoomManager) HttpHandler(w http.ResponseWriter, req *http.Request) {
 			room    *Room
 			result  []byte
 		)
+		entry := NewAuditEntry(req, AUDIT_ROOM_CREATE, "")
 		err = utils.ReadAndUnmarshalObject(req.Body, &request)
 		if err == nil {
 			request.RealAddr = remoteAddr
-			room, err = r.CreateRoom(request)
+			room, err = r.CreateRoom(req.Context(), request)
+			entry.Payload = fmt.Sprintf("name=%v bu=%v desc=%v", request.Name, request.BusinessUnit, request.Desc)
+			if room != nil {
+				entry.Target = room.StreamName
+			}
+			r.audit.Record(entry, err)
 		}
 		if err == nil {
 			err = utils.WriteObjectResponse(w, room)
@@ -53,18 +83,57 @@ func (r *RoomManager) HttpHandler(w http.ResponseWriter, req *http.Request) {
 			glog.Warningln("KickoffRoom invalid args count", args)
 			return
 		}
-		if err = r.KickoffRoom(args[0]); err != nil {
+		var job *KickJob
+		job, err = r.KickoffRoom(req.Context(), args[0])
+		entry := NewAuditEntry(req, AUDIT_ROOM_KICK, args[0])
+		if job != nil {
+			entry.Payload = fmt.Sprintf("job=%v host=%v client=%v", job.ID, job.Host, job.ClientID)
+		}
+		r.audit.Record(entry, err)
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			glog.Warningln("KickoffRoom", err)
 			return
 		}
+		if job != nil {
+			w.WriteHeader(http.StatusAccepted)
+			if err = utils.WriteObjectResponse(w, job); err != nil {
+				glog.Warningln("DELETE err", req.URL.Path, job, err)
+			}
+		}
+	case HTTP_PUT:
+		if argsLen != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			glog.Warningln("RenewRoom invalid args count", args)
+			return
+		}
+		var room *Room
+		room, err = r.RenewRoom(req.Context(), args[0])
+		entry := NewAuditEntry(req, AUDIT_ROOM_RENEW, args[0])
+		if room != nil {
+			entry.Payload = fmt.Sprintf("expiration=%v", room.Expiration)
+		}
+		r.audit.Record(entry, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			glog.Warningln("RenewRoom", err)
+			return
+		}
+		if err = utils.WriteObjectResponse(w, room); err != nil {
+			glog.Warningln("PUT err", req.URL.Path, room, err)
+		}
 	case HTTP_GET:
 		if argsLen != 1 {
 			w.WriteHeader(http.StatusBadRequest)
 			glog.Warningln("KickoffRoom invalid args count", args)
 			return
 		}
-		rsp := r.GetRoom(args[0], remoteAddr)
+		var rsp ReqRoomResponse
+		if rsp, err = r.GetRoom(args[0], remoteAddr); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			glog.Warningln("GetRoom denied", err)
+			return
+		}
 		if err = utils.WriteObjectResponse(w, rsp); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			glog.Warningln("GET err", req.URL.Path, rsp, err)
@@ -74,30 +143,54 @@ func (r *RoomManager) HttpHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 type RoomManager struct {
-	db            *DBSync
+	db            Store
 	serverManager *ServerManager
+	bans          *BanList
+	rules         *GeoRules
+	kicks         *KickManager
+	live          *LiveHub
+	audit         *AuditLog
+
+	configLock sync.RWMutex
+	salt       string        // token 的盐
+	ttl        time.Duration // 创建和续期时的有效期
 }
 
-const (
-	SALT = "JD_STD_2016"
-)
+func (r *RoomManager) ApplyConfig(config *Config) {
+	r.configLock.Lock()
+	r.salt = config.Room.Salt
+	r.ttl = config.Room.TTL.Duration
+	r.configLock.Unlock()
+}
+
+// 按当前配置生成过期时间和 token
+func (r *RoomManager) sign(room *Room) {
+	r.configLock.RLock()
+	salt, ttl := r.salt, r.ttl
+	r.configLock.RUnlock()
+	room.Expiration = time.Now().Add(ttl).Unix()
+	room.Token = GetToken(room.StreamName, room.Expiration, salt)
+}
 
 type RoomCreateReq struct {
-	Name     string
-	Desc     string
-	RealAddr string
+	Name         string
+	Desc         string
+	BusinessUnit string // 计费归属的业务部门
+	RealAddr     string
 }
 
 const (
 	ROOM_CREATE  = iota // 刚刚创建流 未推送
 	ROOM_PUBLISH        // 正在推送中
 	ROOM_CLOSED         // 推送结束
+	ROOM_CLOSING        // 正在踢推流端 等待确认
 )
 
 type Room struct {
-	Id       int64  //
-	UserName string //
-	Desc     string //
+	Id           int64  //
+	UserName     string //
+	Desc         string //
+	BusinessUnit string // 计费归属的业务部门
 
 	//UUID            string // 推送端唯一ID
 	StreamName string // 随机生成的ID 作为唯一标识
@@ -118,77 +211,326 @@ type ReqRoomResponse struct {
 	Servers    []string
 }
 
-func GetToken(stream string, expiration int64) string {
-	str := fmt.Sprintf("%s_%d_%s", stream, expiration, SALT)
+func GetToken(stream string, expiration int64, salt string) string {
+	str := fmt.Sprintf("%s_%d_%s", stream, expiration, salt)
 	str = utils.GetMD5String(str)
 	return str
 }
 
 // 1. 创建一条记录
-func (r *RoomManager) CreateRoom(req RoomCreateReq) (*Room, error) {
+func (r *RoomManager) CreateRoom(ctx context.Context, req RoomCreateReq) (*Room, error) {
 	room := &Room{
-		UserName: req.Name,
-		Desc:     req.Desc,
+		UserName:     req.Name,
+		Desc:         req.Desc,
+		BusinessUnit: req.BusinessUnit,
 	}
 
 	room.StreamName = utils.GenerateUuid()
-	room.Expiration = time.Now().Add(time.Hour * 24).Unix()
-	room.Token = GetToken(room.StreamName, room.Expiration)
+	r.sign(room)
 	room.Status = ROOM_CREATE
 
 	room.Addrs = r.serverManager.GetServers(req.RealAddr, SERVER_TYPE_EDGE_UP)
 
 	// insert to db
-	if err := r.db.InsertRoom(room); err != nil {
+	if err := r.db.InsertRoom(ctx, room); err != nil {
 		return nil, err
 	}
 	glog.Infoln("CreateRoom", room)
+	r.live.PublishRoom(LIVE_EVENT_ROOM, room)
 	return room, nil
 }
 
-func (r *RoomManager) GetRoom(streamName, remoteAddr string) ReqRoomResponse {
-	var rsp ReqRoomResponse
-	rsp.StreamName = streamName
-	rsp.Servers = r.serverManager.GetServers(remoteAddr, SERVER_TYPE_EDGE_DOWN)
-	return rsp
+// 延长过期时间 返回新的 token
+// 已经关闭的 room 不能续期
+func (r *RoomManager) RenewRoom(ctx context.Context, streamName string) (*Room, error) {
+	params := map[string]interface{}{"streamname": streamName}
+	room, err := r.db.SelectRoom(ctx, params)
+	if err != nil {
+		return nil, err
+	} else if room == nil {
+		return nil, errors.New("stream name not exists " + streamName)
+	} else if room.Status == ROOM_CLOSED || room.Status == ROOM_CLOSING {
+		return nil, errors.New("stream already closed " + streamName)
+	}
+
+	r.sign(room)
+	if err = r.db.UpdateRoom(ctx, room); err != nil {
+		return nil, err
+	}
+	glog.Infoln("RenewRoom", streamName, room.Expiration)
+	r.live.PublishRoom(LIVE_EVENT_ROOM, room)
+	return room, nil
 }
 
-func (r *RoomManager) tryKickOffClient(host string, clientID int) (err error) {
-	var rsp utils.RspBase
-	for i := 0; i < 3; i++ {
-		if rsp, err = utils.KickOffClient(host, clientID); err != nil || rsp.Code != 0 {
-			glog.Warningln("KickOffClient ", host, clientID, err, rsp.Code)
-			continue
-		}
-		break
+// 调度前检查room的地域限制
+func (r *RoomManager) GetRoom(streamName, remoteAddr string) (ReqRoomResponse, error) {
+	var rsp ReqRoomResponse
+	if err := r.rules.Check(streamName, remoteAddr, GEO_CHECK_DISPATCH); err != nil {
+		return rsp, err
 	}
-	return err
+	rsp.StreamName = streamName
+	rsp.Servers = r.serverManager.GetServers(remoteAddr, SERVER_TYPE_EDGE_DOWN)
+	return rsp, nil
 }
 
-func (r *RoomManager) KickoffRoom(streamName string) error {
-	// 1. update from db
-	// 2. delete from srs
+// 关闭room 有推流端时提交踢人任务 确认踢掉或者放弃后才标记为关闭
+// 推流端还在时返回踢人任务
+func (r *RoomManager) KickoffRoom(ctx context.Context, streamName string) (*KickJob, error) {
 	var room *Room
 	var err error
 	params := map[string]interface{}{"streamname": streamName}
-	if room, err = r.db.SelectRoom(params); err != nil {
-		return err
+	if room, err = r.db.SelectRoom(ctx, params); err != nil {
+		return nil, err
 	} else if room == nil {
-		return errors.New("stream name not exists " + streamName)
+		return nil, errors.New("stream name not exists " + streamName)
+	}
+
+	switch {
+	case room.Status == ROOM_CLOSING:
+		// 正在踢 返回进行中的任务 确认或者放弃之前不能关闭
+		if job, ok := r.kicks.Active(streamName, KICK_TARGET_PUBLISHER); ok {
+			return &job, nil
+		}
+		// 任务丢失 重新提交
+	case room.Status != ROOM_PUBLISH || room.PublishHost == "":
+		room.Status = ROOM_CLOSED
+		if err = r.db.UpdateRoom(ctx, room); err != nil {
+			glog.Warningln("UpdateRoom", err)
+			return nil, err
+		}
+		r.live.PublishRoom(LIVE_EVENT_ROOM, room)
+		return nil, nil
+	default:
+		// 关闭中 拒绝新的推流
+		room.Status = ROOM_CLOSING
+		if err = r.db.UpdateRoom(ctx, room); err != nil {
+			glog.Warningln("UpdateRoom", err)
+			return nil, err
+		}
+		r.live.PublishRoom(LIVE_EVENT_ROOM, room)
 	}
 
+	job := r.kicks.Submit(streamName, room.PublishHost, room.PublishClientId,
+		KICK_TARGET_PUBLISHER, r.onPublisherKicked)
+	return &job, nil
+}
+
+// 重启后继续没有完成的踢人任务 CLOSING 状态但是没有任务的 room 重新提交
+func (r *RoomManager) Recover(ctx context.Context, unfinished []KickJob) error {
+	rooms, err := r.db.SelectRooms(ctx, map[string]interface{}{"status": ROOM_CLOSING})
+	if err != nil {
+		return fmt.Errorf("Select closing rooms error:%v", err)
+	}
+	closing := make(map[string]*Room, len(rooms))
+	for _, room := range rooms {
+		closing[room.StreamName] = room
+	}
+	for _, job := range unfinished {
+		var onDone func(job KickJob)
+		if _, ok := closing[job.StreamName]; ok && job.Target == KICK_TARGET_PUBLISHER {
+			onDone = r.onPublisherKicked
+			delete(closing, job.StreamName)
+		}
+		r.kicks.Resume(job.ID, onDone)
+	}
+	for _, room := range closing {
+		glog.Infoln("Recover closing room without kick job", room.StreamName)
+		r.kicks.Submit(room.StreamName, room.PublishHost, room.PublishClientId,
+			KICK_TARGET_PUBLISHER, r.onPublisherKicked)
+	}
+	return nil
+}
+
+func (r *RoomManager) onPublisherKicked(job KickJob) {
+	params := map[string]interface{}{"streamname": job.StreamName}
+	room, err := r.db.SelectRoom(context.Background(), params)
+	if err != nil || room == nil {
+		glog.Warningln("onPublisherKicked SelectRoom", job.StreamName, err)
+		return
+	} else if room.Status != ROOM_CLOSING {
+		return
+	}
 	room.Status = ROOM_CLOSED
+	if err = r.db.UpdateRoom(context.Background(), room); err != nil {
+		glog.Warningln("onPublisherKicked UpdateRoom", job.StreamName, err)
+		return
+	}
+	r.live.PublishRoom(LIVE_EVENT_ROOM, room)
+	glog.Infoln("room closed", job.StreamName, "kick job", job.ID, job.Status)
+}
 
-	// update
-	if err = r.db.UpdateRoom(room); err != nil {
-		glog.Warningln("UpdateRoom", err)
-		return err
+// /room/{stream}/viewers/{clientId}?host=ip:port  DELETE
+func (r *RoomManager) viewersHandler(w http.ResponseWriter, req *http.Request, args []string) {
+	if req.Method != HTTP_DELETE || len(args) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		glog.Warningln("viewersHandler invalid request", req.Method, args)
+		return
+	}
+	clientID, err := strconv.Atoi(args[2])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		glog.Warningln("viewersHandler invalid client id", args)
+		return
 	}
 
-	if err = r.tryKickOffClient(room.PublishHost, room.PublishClientId); err != nil {
-		glog.Warningln("tryKickOffClient", err)
-		return err
+	var job KickJob
+	job, err = r.KickoffViewer(args[0], clientID, req.URL.Query().Get("host"))
+	entry := NewAuditEntry(req, AUDIT_VIEWER_KICK, args[0])
+	entry.Payload = fmt.Sprintf("client=%v host=%v", clientID, req.URL.Query().Get("host"))
+	r.audit.Record(entry, err)
+	if err != nil {
+		switch err {
+		case ErrClientNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		case ErrClientAmbiguous:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		glog.Warningln("KickoffViewer", args, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if err = utils.WriteObjectResponse(w, job); err != nil {
+		glog.Warningln("KickoffViewer writeRespons err", job, err)
 	}
+}
 
-	return nil
+// /room/{stream}/bans                 GET | POST
+// /room/{stream}/bans/{type}/{value}  DELETE
+func (r *RoomManager) bansHandler(w http.ResponseWriter, req *http.Request, args []string) {
+	var err error
+	streamName := args[0]
+	switch req.Method {
+	case HTTP_GET:
+		err = utils.WriteObjectResponse(w, r.bans.Get(streamName))
+	case HTTP_POST:
+		var (
+			request ReqRoomBan
+			ban     *RoomBan
+		)
+		if err = utils.ReadAndUnmarshalObject(req.Body, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		ban, err = r.bans.Add(req.Context(), streamName, request)
+		entry := NewAuditEntry(req, AUDIT_BAN_ADD, streamName)
+		entry.Payload = fmt.Sprintf("%+v", request)
+		r.audit.Record(entry, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			break
+		}
+		go r.kickBanned(streamName)
+		err = utils.WriteObjectResponse(w, ban)
+	case HTTP_DELETE:
+		if len(args) != 4 || GetBanType(args[2]) < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			err = fmt.Errorf("invalid args %v", args)
+			break
+		}
+		err = r.bans.Remove(req.Context(), streamName, GetBanType(args[2]), args[3])
+		entry := NewAuditEntry(req, AUDIT_BAN_REMOVE, streamName)
+		entry.Payload = fmt.Sprintf("type=%v value=%v", args[2], args[3])
+		r.audit.Record(entry, err)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	if err != nil {
+		glog.Warningln("bansHandler", req.Method, args, err)
+	}
+}
+
+// /room/{stream}/geo       GET | POST
+// /room/{stream}/geo/{id}  DELETE
+func (r *RoomManager) geoRulesHandler(w http.ResponseWriter, req *http.Request, args []string) {
+	var err error
+	streamName := args[0]
+	switch req.Method {
+	case HTTP_GET:
+		err = utils.WriteObjectResponse(w, r.rules.Get(streamName))
+	case HTTP_POST:
+		var (
+			request ReqRoomGeoRule
+			rule    *RoomGeoRule
+		)
+		if err = utils.ReadAndUnmarshalObject(req.Body, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		rule, err = r.rules.Add(req.Context(), streamName, request)
+		entry := NewAuditEntry(req, AUDIT_GEO_ADD, streamName)
+		entry.Payload = fmt.Sprintf("%+v", request)
+		r.audit.Record(entry, err)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		err = utils.WriteObjectResponse(w, rule)
+	case HTTP_DELETE:
+		var id int64
+		if len(args) == 3 {
+			id, err = strconv.ParseInt(args[2], 10, 64)
+		}
+		if len(args) != 3 || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			err = fmt.Errorf("invalid args %v", args)
+			break
+		}
+		err = r.rules.Remove(req.Context(), streamName, id)
+		entry := NewAuditEntry(req, AUDIT_GEO_REMOVE, streamName)
+		entry.Payload = fmt.Sprintf("id=%v", id)
+		r.audit.Record(entry, err)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	if err != nil {
+		glog.Warningln("geoRulesHandler", req.Method, args, err)
+	}
+}
+
+// 在所有节点上查找播放该流的client 并踢掉
+func (r *RoomManager) KickoffViewer(streamName string, clientID int, host string) (KickJob, error) {
+	var targets []*ClusterClient
+	for _, c := range r.getStreamViewers(streamName) {
+		if c.ID == clientID && (host == "" || c.Host == host) {
+			targets = append(targets, c)
+		}
+	}
+	if len(targets) == 0 {
+		return KickJob{}, ErrClientNotFound
+	} else if len(targets) > 1 {
+		return KickJob{}, ErrClientAmbiguous
+	}
+
+	glog.Infoln("KickoffViewer", streamName, clientID, targets[0].Host)
+	return r.kicks.Submit(streamName, targets[0].Host, clientID, KICK_TARGET_VIEWER, nil), nil
+}
+
+// 踢掉当前在线并且命中黑名单的播放端
+func (r *RoomManager) kickBanned(streamName string) {
+	for _, c := range r.getStreamViewers(streamName) {
+		if ban := r.bans.Match(streamName, c.Ip, GetUrlQuery(c.TcUrl, URL_PARAM_USER)); ban != nil {
+			glog.Infoln("kickBanned", streamName, c.Host, c.ID, c.Ip, ban.Value)
+			r.kicks.Submit(streamName, c.Host, c.ID, KICK_TARGET_VIEWER, nil)
+		}
+	}
+}
+
+func (r *RoomManager) getStreamViewers(streamName string) []*ClusterClient {
+	var viewers []*ClusterClient
+	for _, t := range []string{STR_TYPE_EDGE_DOWN, STR_TYPE_EDGE_UP, STR_TYPE_ORIGIN} {
+		for _, c := range r.serverManager.GetClusterClients(t) {
+			if c.StreamName == streamName && c.Type == CLIENT_TYPE_PLAY {
+				viewers = append(viewers, c)
+			}
+		}
+	}
+	return viewers
 }
@@ -1,12 +1,14 @@
 package manager
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -43,9 +45,11 @@ type ConnectInfo struct {
 	StreamName string `json:"stream"`  // connect | close 不需要
 	TcUrl      string `json:"tcUrl"`   // connect 专属
 	PageUrl    string `json:"pageUrl"` // connect 专属
+	Param      string `json:"param"`   // play | publish 的url参数 ?user=xxx
 	//teApiHost string
 
-	Args []string
+	Args   []string // 回调地址中的路径参数 不可信
+	Caller string   `json:"-"` // 回调方的ip
 }
 
 func (s *EventManager) HttpHandler(w http.ResponseWriter, req *http.Request) {
@@ -55,25 +59,60 @@ func (s *EventManager) HttpHandler(w http.ResponseWriter, req *http.Request) {
 	var result []byte
 	var err error
 
+	start := time.Now()
+	status := CALLBACK_RESULT_ALLOW
+	defer func() {
+		metrics.Inc(METRIC_CALLBACKS_TOTAL, "action", info.Action, "result", status)
+		metrics.ObserveSince(METRIC_CALLBACK_DURATION, start, "action", info.Action)
+		entry := NewAuditEntry(req, AUDIT_CALLBACK+info.Action, info.StreamName)
+		entry.Actor = AUDIT_ACTOR_SRS
+		entry.Outcome = status
+		if status == CALLBACK_RESULT_BAD_REQUEST {
+			entry.Payload = string(result)
+		} else {
+			entry.Payload = info.AuditPayload()
+		}
+		s.audit.Record(entry, err)
+	}()
+
 	info.Args = GetUrlParams(req.URL.Path, URL_PATH_EVENT)
+	info.Caller = GetCallerIp(req)
 
 	if result, err = ioutil.ReadAll(req.Body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		glog.Warningln("read request err", err)
 		ret = -1
+		status = CALLBACK_RESULT_BAD_REQUEST
 	} else if err = json.Unmarshal(result, &info); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		ret = -1
+		status = CALLBACK_RESULT_BAD_REQUEST
 		glog.Warningln("json unmarshal", err)
+	} else if err = s.guard.Verify(req); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		ret = -1
+		status = CALLBACK_RESULT_UNTRUSTED
+		glog.Warningln("untrusted callback", info.Caller, req.URL.Path, err)
 	} else {
 		glog.Infoln(string(result))
 		glog.Infof("%+v\n", info)
 		switch info.Action {
+		case SRS_CB_ACTION_ON_CONNECT:
+			err = s.OnConnect(info)
+		case SRS_CB_ACTION_ON_CLOSE:
+			err = s.OnClose(info)
 		case SRS_CB_ACTION_ON_PUBLISH:
-			err = s.OnPublish(info)
+			err = s.OnPublish(req.Context(), info)
+		case SRS_CB_ACTION_ON_UNPUBLISH:
+			err = s.OnUnpublish(info)
+		case SRS_CB_ACTION_ON_PLAY:
+			err = s.OnPlay(info)
+		case SRS_CB_ACTION_ON_STOP:
+			err = s.OnStop(info)
 		}
 		if err != nil {
 			ret = -1
+			status = CALLBACK_RESULT_DENY
 			glog.Warningln("handler", info.Action, err)
 		}
 	}
@@ -81,56 +120,132 @@ func (s *EventManager) HttpHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 type EventManager struct {
-	db *DBSync
+	db       Store
+	servers  *ServerManager
+	guard    *EventGuard
+	bans     *BanList
+	rules    *GeoRules
+	referers *RefererRules
+	geo      *ViewerGeo
+	live     *LiveHub
+	audit    *AuditLog
+}
+
+// 播放端的用户ID 优先取url参数 其次取tcUrl的参数
+func (info *ConnectInfo) GetUser() string {
+	if user := GetUrlQuery("?"+strings.TrimPrefix(info.Param, "?"), URL_PARAM_USER); user != "" {
+		return user
+	}
+	return GetUrlQuery(info.TcUrl, URL_PARAM_USER)
+}
+
+func (s *EventManager) checkBan(streamName string, info ConnectInfo) error {
+	if ban := s.bans.Match(streamName, info.Ip, info.GetUser()); ban != nil {
+		return fmt.Errorf("client %v ip:%v user:%v banned by stream:%v rule:%v",
+			info.ClientID, info.Ip, info.GetUser(), streamName, ban.Value)
+	}
+	return nil
 }
 
-// 建立链接时
+// 建立链接时 检查来源域名
+// connect时还没有stream 只有tcUrl带了stream参数时才能检查黑名单和room的来源域名
 func (s *EventManager) OnConnect(info ConnectInfo) error {
+	streamName := GetUrlQuery(info.TcUrl, URL_PARAM_STREAM)
+	if err := s.referers.Check(info.AppName, streamName, info.PageUrl, info.Action); err != nil {
+		return err
+	}
+	if streamName != "" {
+		return s.checkBan(streamName, info)
+	}
 	return nil
 }
 
 // 关闭连接时
-func (s *EventManager) OnClose(info ConnectInfo) error { return nil }
+func (s *EventManager) OnClose(info ConnectInfo) error {
+	s.geo.OnStop(info)
+	return nil
+}
 
 // 用来判断用户是否有权限播放
-func (s *EventManager) OnPlay(info ConnectInfo) error { return nil }
+func (s *EventManager) OnPlay(info ConnectInfo) error {
+	if err := s.checkBan(info.StreamName, info); err != nil {
+		return err
+	}
+	if err := s.rules.Check(info.StreamName, info.Ip, GEO_CHECK_PLAY); err != nil {
+		return err
+	}
+	if err := s.referers.Check(info.AppName, info.StreamName, info.PageUrl, info.Action); err != nil {
+		return err
+	}
+	s.geo.OnPlay(info)
+	return nil
+}
 
 // 当客户端停止播放时。
 // 备注：停止播放可能不会关闭连接，还能再继续播放
-func (s *EventManager) OnStop(info ConnectInfo) error { return nil }
+func (s *EventManager) OnStop(info ConnectInfo) error {
+	s.geo.OnStop(info)
+	return nil
+}
 
-func (s *EventManager) OnUnpublish(info ConnectInfo) error { return nil }
+// 主播停止推流时
+func (s *EventManager) OnUnpublish(info ConnectInfo) error {
+	s.live.Publish(&LiveEvent{Kind: LIVE_EVENT_UNPUBLISH, Room: info.StreamName, Data: info})
+	return nil
+}
+
+// 优先取已注册的回调方 event.checkSource 开启时必须是已注册的回调方
+// 没有开启 或者回调方在 allowCidrs 内但是没有注册时 (NAT 多网卡) 取参数中的 host:port
+// 参数中的节点也必须已注册并且 ACTIVE
+func (s *EventManager) publishServer(info ConnectInfo) (*SrsServer, error) {
+	caller, err := s.servers.FindCaller(info.Caller, info.Args)
+	if err == nil {
+		return caller, nil
+	} else if s.guard != nil && s.guard.RequireCaller(info.Caller) {
+		return nil, err
+	}
+	if len(info.Args) != 2 {
+		return nil, errors.New(fmt.Sprintln("param not match", info.Args))
+	}
+	addr := fmt.Sprintf("%s:%s", info.Args[0], info.Args[1])
+	if svr := s.servers.GetServer(addr); svr != nil && svr.GetStatus() == SERVER_STATUS_ACTIVE {
+		return svr, nil
+	}
+	return nil, fmt.Errorf("server %v is not a registered active server", addr)
+}
 
 // 主播推送时
-func (s *EventManager) OnPublish(info ConnectInfo) error {
+func (s *EventManager) OnPublish(ctx context.Context, info ConnectInfo) error {
 	glog.Infoln("OnPublish", info)
 	var room *Room
 	var err error
 
-	if len(info.Args) != 2 {
-		return errors.New(fmt.Sprintln("param not match", info.Args))
-	}
-
 	params := map[string]interface{}{"streamname": info.StreamName}
 	now := time.Now().Unix()
-	if room, err = s.db.SelectRoom(params); err != nil {
+	if room, err = s.db.SelectRoom(ctx, params); err != nil {
 		return err
 	} else if room == nil {
 		return errors.New("stream name not exists " + info.StreamName)
 	} else if room.Expiration < now {
 		return errors.New(fmt.Sprintf("stream timeout %d < %d(now) ",
 			room.Expiration, now))
-	} else if room.Status == ROOM_CLOSED {
+	} else if room.Status == ROOM_CLOSED || room.Status == ROOM_CLOSING {
 		return errors.New("stream already closed " + info.StreamName)
 	}
 
+	// 踢人时调用推流节点的 api 只能用真实的回调方
+	var caller *SrsServer
+	if caller, err = s.publishServer(info); err != nil {
+		return fmt.Errorf("publish from %v args %v: %v", info.Caller, info.Args, err)
+	}
+
 	room.PublishClientId = info.ClientID
 	room.Status = ROOM_PUBLISH
-
-	room.PublishHost = fmt.Sprintf("%s:%s", info.Args[0], info.Args[1])
+	room.PublishHost = caller.Addr
 	// update
-	if err = s.db.UpdateRoom(room); err != nil {
+	if err = s.db.UpdateRoom(ctx, room); err != nil {
 		return err
 	}
+	s.live.PublishRoom(LIVE_EVENT_PUBLISH, room)
 	return nil
 }
@@ -1,7 +1,7 @@
 package manager
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"strings"
 	"sync"
@@ -11,53 +11,170 @@ import (
 	"github.com/golang/glog"
 )
 
-const (
-	UPDATE_STATUS_INTERVAL = 10 * time.Second
-)
-
 type StreamInfo struct {
 	Host       string
 	Streams    []utils.Stream
 	UpdateTime int64
 }
 
+type ClientInfo struct {
+	Host       string
+	Clients    []utils.Client
+	UpdateTime int64
+}
+
+type VhostInfo struct {
+	Host       string
+	Vhosts     []utils.Vhost
+	UpdateTime int64
+}
+
 type SummaryInfo struct {
 	Host       string
 	Data       utils.SummaryData
 	UpdateTime int64
 }
 
+const (
+	SERVER_STATUS_ACTIVE  = iota // 正常参与调度
+	SERVER_STATUS_PENDING        // 自动注册 等待审核
+	SERVER_STATUS_OFFLINE        // 心跳超时
+	SERVER_STATUS_REMOVED        // 已删除 调度列表中残留的引用不再参与调度
+)
+
 type SrsServer struct {
-	ID     int64
-	Addr   string
-	Type   int
-	Idc    int
-	Status int // 暂时没用
-	Desc   string
-	Net    *SubNet
+	ID       int64
+	Addr     string
+	Type     int
+	Idc      int
+	Status   int
+	Desc     string
+	Capacity int    // 最大连接数 0表示不限制
+	Version  string // srs版本 由心跳上报
+	LastSeen int64  // 最近一次心跳时间 0表示从未上报
+	Net      *SubNet
 
+	statusLock  sync.RWMutex
 	streamsLock sync.RWMutex
 	summaryLock sync.RWMutex
+	clientsLock sync.RWMutex
+	vhostsLock  sync.RWMutex
 	streams     *StreamInfo
 	summary     *SummaryInfo
+	clients     *ClientInfo
+	vhosts      *VhostInfo
+	stop        chan struct{}
+	stopOnce    sync.Once
 }
 
 func (s *SrsServer) GetPublicAddr() (string, error) {
 	strs := strings.Split(s.Addr, ":")
 	if len(strs) != 2 {
-		return "", errors.New(fmt.Sprintf("invalid PublicHost", s.Addr))
+		return "", fmt.Errorf("invalid PublicHost %v", s.Addr)
 	}
 	return strs[0], nil
 }
 
+func (s *SrsServer) GetStatus() int {
+	s.statusLock.RLock()
+	defer s.statusLock.RUnlock()
+	return s.Status
+}
+
+func (s *SrsServer) SetStatus(status int) {
+	s.statusLock.Lock()
+	s.Status = status
+	s.statusLock.Unlock()
+}
+
+// 刷新心跳信息 离线的节点重新上线
+func (s *SrsServer) Heartbeat(req ReqHeartbeat, now int64) {
+	s.statusLock.Lock()
+	s.Capacity = req.Capacity
+	s.Version = req.Version
+	s.LastSeen = now
+	if s.Status == SERVER_STATUS_OFFLINE {
+		s.Status = SERVER_STATUS_ACTIVE
+	}
+	s.statusLock.Unlock()
+}
+
+// 心跳超时的正常节点标记为离线 返回是否发生了变化
+func (s *SrsServer) checkHeartbeat(now, timeout int64) bool {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	if s.Status != SERVER_STATUS_ACTIVE || s.LastSeen == 0 ||
+		now-s.LastSeen <= timeout {
+		return false
+	}
+	s.Status = SERVER_STATUS_OFFLINE
+	return true
+}
+
+type ServerView struct {
+	Addr       string
+	ServerType string
+	Idc        int
+	Status     int
+	Desc       string
+	Capacity   int
+	Version    string
+	LastSeen   int64
+	Province   string
+	Isp        string
+	Load1m     float64
+	CPUPercent float64
+	ConnSrs    int
+	UpdateTime int64
+}
+
+// 给节点列表用的快照
+func (s *SrsServer) View(typeName string) *ServerView {
+	s.statusLock.RLock()
+	view := &ServerView{
+		Addr:       s.Addr,
+		ServerType: typeName,
+		Idc:        s.Idc,
+		Status:     s.Status,
+		Desc:       s.Desc,
+		Capacity:   s.Capacity,
+		Version:    s.Version,
+		LastSeen:   s.LastSeen,
+	}
+	s.statusLock.RUnlock()
+	if s.Net != nil {
+		view.Province = s.Net.Province
+		view.Isp = s.Net.SupperIsp
+	}
+	if summary := s.GetSummary(); summary != nil {
+		view.Load1m = summary.Data.Sys.Load1m
+		view.CPUPercent = summary.Data.Sys.CPUPercent
+		view.ConnSrs = summary.Data.Sys.ConnSrs
+		view.UpdateTime = summary.UpdateTime
+	}
+	return view
+}
+
 func (s *SrsServer) GetStreams() *StreamInfo {
 	s.streamsLock.RLock()
 	defer s.streamsLock.RUnlock()
 	return s.streams
 }
 
+func (s *SrsServer) GetClients() *ClientInfo {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+	return s.clients
+}
+
+func (s *SrsServer) GetVhosts() *VhostInfo {
+	s.vhostsLock.RLock()
+	defer s.vhostsLock.RUnlock()
+	return s.vhosts
+}
+
 func (s *SrsServer) GetSummary() *SummaryInfo {
-	s.summaryLock.Lock()
+	s.summaryLock.RLock()
 	defer s.summaryLock.RUnlock()
 	return s.summary
 }
@@ -83,29 +200,111 @@ func (sp SortSrsServers) Less(i, j int) bool {
 func NewSrsServer(addr, desc string, serverType int) *SrsServer {
 	return &SrsServer{
 		Addr:    addr,
+		Desc:    desc,
 		Type:    serverType,
 		streams: &StreamInfo{},
 		summary: &SummaryInfo{},
+		clients: &ClientInfo{},
+		vhosts:  &VhostInfo{},
+		stop:    make(chan struct{}),
 	}
 }
 
-func (s *SrsServer) UpdateStatusLoop() {
+// interval 每轮重新取 热加载后下一轮生效
+// 节点被删除或者 ctx 取消时退出
+func (s *SrsServer) UpdateStatusLoop(ctx context.Context, interval func() time.Duration) {
+	// 节点被删除时也取消进行中的请求
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	s.UpdateServerVersion(ctx)
 	for {
-		s.UpdateServerStreams()
-		s.UpdateServerSummaries()
-		time.Sleep(UPDATE_STATUS_INTERVAL)
+		s.UpdateServerStreams(ctx)
+		s.UpdateServerSummaries(ctx)
+		s.UpdateServerClients(ctx)
+		s.UpdateServerVhosts(ctx)
+		select {
+		case <-s.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(interval()):
+		}
 	}
 }
 
-func (s *SrsServer) UpdateServerStreams() {
-	if rsp, err := utils.GetStreams(s.Addr); err != nil {
-		glog.Warningln("UpdateServer GetStreams", s.Addr, err)
+// 节点被删除时停止拉取状态
+func (s *SrsServer) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *SrsServer) UpdateServerVersion(ctx context.Context) {
+	if rsp, err := utils.GetVersion(ctx, s.Addr); err != nil {
+		glog.Warningln("UpdateServer GetVersion", s.Addr, err)
+		metrics.Inc(METRIC_POLL_ERRORS_TOTAL, "addr", s.Addr, "api", "versions")
 	} else if rsp.Code != 0 {
-		msg := fmt.Sprintln("GetStream server return err", s.Addr, rsp.Code)
-		glog.Warningln(msg)
+		glog.Warningln("GetVersion server return err", s.Addr, rsp.Code)
+		metrics.Inc(METRIC_POLL_ERRORS_TOTAL, "addr", s.Addr, "api", "versions")
+	} else {
+		s.statusLock.Lock()
+		s.Version = rsp.Data.Version
+		s.statusLock.Unlock()
+	}
+}
+
+func (s *SrsServer) UpdateServerClients(ctx context.Context) {
+	if clients, err := utils.GetAllClients(ctx, s.Addr); err != nil {
+		glog.Warningln("UpdateServer GetAllClients", s.Addr, err)
+		metrics.Inc(METRIC_POLL_ERRORS_TOTAL, "addr", s.Addr, "api", "clients")
+	} else {
+		ci := &ClientInfo{Host: s.Addr, UpdateTime: time.Now().Unix()}
+		ci.Clients = clients
+		s.clientsLock.Lock()
+		s.clients = ci
+		s.clientsLock.Unlock()
+	}
+}
+
+func (s *SrsServer) UpdateServerVhosts(ctx context.Context) {
+	if rsp, err := utils.GetVhosts(ctx, s.Addr); err != nil {
+		glog.Warningln("UpdateServer GetVhosts", s.Addr, err)
+		metrics.Inc(METRIC_POLL_ERRORS_TOTAL, "addr", s.Addr, "api", "vhosts")
+	} else if rsp.Code != 0 {
+		glog.Warningln("GetVhosts server return err", s.Addr, rsp.Code)
+		metrics.Inc(METRIC_POLL_ERRORS_TOTAL, "addr", s.Addr, "api", "vhosts")
+	} else {
+		vi := &VhostInfo{Host: s.Addr, UpdateTime: time.Now().Unix()}
+		vi.Vhosts = rsp.Vhosts
+		s.vhostsLock.Lock()
+		s.vhosts = vi
+		s.vhostsLock.Unlock()
+	}
+}
+
+// 根据stream id 查找当前拉取到的stream
+func (s *SrsServer) findStream(id int) *utils.Stream {
+	streams := s.GetStreams()
+	for i := range streams.Streams {
+		if streams.Streams[i].ID == id {
+			return &streams.Streams[i]
+		}
+	}
+	return nil
+}
+
+func (s *SrsServer) UpdateServerStreams(ctx context.Context) {
+	if streams, err := utils.GetAllStreams(ctx, s.Addr); err != nil {
+		glog.Warningln("UpdateServer GetAllStreams", s.Addr, err)
+		metrics.Inc(METRIC_POLL_ERRORS_TOTAL, "addr", s.Addr, "api", "streams")
 	} else {
 		si := &StreamInfo{Host: s.Addr, UpdateTime: time.Now().Unix()}
-		si.Streams = rsp.Streams
+		si.Streams = streams
 		s.streamsLock.Lock()
 		s.streams = si
 		s.streamsLock.Unlock()
@@ -113,12 +312,14 @@ func (s *SrsServer) UpdateServerStreams() {
 	}
 }
 
-func (s *SrsServer) UpdateServerSummaries() {
-	if rsp, err := utils.GetSummaries(s.Addr); err != nil {
+func (s *SrsServer) UpdateServerSummaries(ctx context.Context) {
+	if rsp, err := utils.GetSummaries(ctx, s.Addr); err != nil {
 		glog.Warningln("UpdateServer GetSummaries", s.Addr, err)
+		metrics.Inc(METRIC_POLL_ERRORS_TOTAL, "addr", s.Addr, "api", "summaries")
 	} else if rsp.Code != 0 {
 		msg := fmt.Sprintln("GetSummaries server return err", s.Addr, rsp.Code)
 		glog.Warningln(msg)
+		metrics.Inc(METRIC_POLL_ERRORS_TOTAL, "addr", s.Addr, "api", "summaries")
 	} else {
 		summary := &SummaryInfo{Host: s.Addr, UpdateTime: time.Now().Unix()}
 		summary.Data = rsp.Data
@@ -129,13 +330,24 @@ func (s *SrsServer) UpdateServerSummaries() {
 	}
 }
 
-func (s *SrsServer) IsAvaliable() bool {
+// 负载或者出口流量超过 dispatch 配置的阈值时不参与调度
+func (s *SrsServer) IsAvaliable(c DispatchConfig) bool {
+	s.statusLock.RLock()
+	status, capacity := s.Status, s.Capacity
+	s.statusLock.RUnlock()
+	if status != SERVER_STATUS_ACTIVE {
+		return false
+	}
 	s.summaryLock.RLock()
 	sendBytes := s.summary.Data.Sys.NetSendi
 	load5m := s.summary.Data.Sys.Load5m
 	load1m := s.summary.Data.Sys.Load1m
+	connSrs := s.summary.Data.Sys.ConnSrs
 	s.summaryLock.RUnlock()
-	if load1m > 64 || load5m > 64 || sendBytes > 100*1024*1024 {
+	if load1m > c.MaxLoad || load5m > c.MaxLoad || sendBytes > c.MaxNetSendBytes {
+		return false
+	}
+	if capacity > 0 && connSrs >= capacity {
 		return false
 	}
 
@@ -1,11 +1,15 @@
 package manager
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/golang/glog"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 	"utils"
 )
 
@@ -20,31 +24,87 @@ const (
 	STR_TYPE_ORIGIN    = "origin"
 
 	DefaultDisPatchCount = 2
+
+	DefaultHeartbeatTimeout  = 60 * time.Second
+	HEARTBEAT_CHECK_INTERVAL = 10 * time.Second
 )
 
 type ServerManager struct {
-	db         *DBSync
+	db         Store
 	ipDatabase *IpDatabase
 	servers    []map[string]*SrsServer
 	locks      []sync.Mutex
+	// 注册节点时 检查是否存在到写入列表之间不能有别的注册
+	addLock sync.Mutex
+
+	audit *AuditLog
+	guard *EventGuard // 校验心跳的调用方 和 /event 共用
+
+	// Start 之后才开始拉取节点状态 每个节点只有一个拉取循环
+	loopLock  sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	polling   map[*SrsServer]bool
+	polls     sync.WaitGroup
+	heartbeat Loop
+
+	// 可以热加载
+	configLock    sync.RWMutex
+	server        ServerConfig
+	dispatchCount int
 }
 
-func NewSrsServermanager(db *DBSync) (sm *ServerManager, err error) {
+var ErrServerNotFound = errors.New("server not found")
+
+// 不加载 ip 库 测试中直接使用
+func newServerManager(db Store, audit *AuditLog) *ServerManager {
 	servers := make([]map[string]*SrsServer, SERVER_TYPE_COUNT)
 	for i := 0; i < SERVER_TYPE_COUNT; i++ {
 		servers[i] = make(map[string]*SrsServer)
 	}
-	sm = &ServerManager{
-		db:      db,
-		servers: servers,
-		locks:   make([]sync.Mutex, SERVER_TYPE_COUNT),
+	return &ServerManager{
+		db:            db,
+		servers:       servers,
+		locks:         make([]sync.Mutex, SERVER_TYPE_COUNT),
+		polling:       make(map[*SrsServer]bool),
+		server:        DefaultConfig().Server,
+		dispatchCount: DefaultDisPatchCount,
+		audit:         audit,
 	}
-	sm.ipDatabase, err = NewIpDatabase()
+}
+
+func NewSrsServermanager(config *Config, db Store, audit *AuditLog) (sm *ServerManager, err error) {
+	sm = newServerManager(db, audit)
+	if sm.ipDatabase, err = NewIpDatabase(config.Dispatch); err != nil {
+		return
+	}
+	sm.ApplyConfig(config)
 	err = sm.initServers()
 
 	return
 }
 
+// 心跳 拉取间隔和调度参数 ip 库路径不能热加载
+func (s *ServerManager) ApplyConfig(config *Config) {
+	s.configLock.Lock()
+	s.server = config.Server
+	s.dispatchCount = config.Dispatch.Count
+	s.configLock.Unlock()
+	if s.ipDatabase != nil {
+		s.ipDatabase.SetConfig(config.Dispatch)
+	}
+}
+
+func (s *ServerManager) serverConfig() ServerConfig {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.server
+}
+
+func (s *ServerManager) PollInterval() time.Duration {
+	return s.serverConfig().PollInterval.Duration
+}
+
 func (s *ServerManager) initServers() (err error) {
 	for i := 0; i < SERVER_TYPE_COUNT; i++ {
 		for _, svr := range s.servers[i] {
@@ -61,7 +121,10 @@ func (s *ServerManager) initServers() (err error) {
 }
 
 func (s *ServerManager) GetServers(addr string, disType int) (result []string) {
-	servers := s.ipDatabase.DisPatch(addr, disType, DefaultDisPatchCount)
+	s.configLock.RLock()
+	count := s.dispatchCount
+	s.configLock.RUnlock()
+	servers := s.ipDatabase.DisPatch(addr, disType, count)
 	result = make([]string, 0)
 	for _, svr := range servers {
 		result = append(result, svr.Addr)
@@ -71,7 +134,7 @@ func (s *ServerManager) GetServers(addr string, disType int) (result []string) {
 }
 
 func (s *ServerManager) LoadServers() error {
-	servers, err := s.db.LoadSrsServers()
+	servers, err := s.db.LoadSrsServers(context.Background())
 	if err != nil {
 		return fmt.Errorf("Load Srsservers error:%v", err)
 	}
@@ -81,19 +144,97 @@ func (s *ServerManager) LoadServers() error {
 			mutex.Lock()
 			ss[svr.Addr] = svr
 			mutex.Unlock()
-			go svr.UpdateStatusLoop()
+			s.startPolling(svr)
 		}
 	}
 
 	return nil
 }
 
+// 开始拉取已加载节点的状态 检查心跳 按负载排序 ip 库中的节点
+func (s *ServerManager) Start(ctx context.Context) {
+	s.loopLock.Lock()
+	if s.cancel != nil {
+		s.loopLock.Unlock()
+		return
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.loopLock.Unlock()
+
+	if s.ipDatabase != nil {
+		s.ipDatabase.Start(s.ctx)
+	}
+	s.heartbeat.Start(s.ctx, s.checkHeartbeatLoop)
+	for _, typeName := range []string{STR_TYPE_EDGE_UP, STR_TYPE_EDGE_DOWN, STR_TYPE_ORIGIN} {
+		for _, svr := range s.getServerList(typeName) {
+			s.startPolling(svr)
+		}
+	}
+}
+
+// 取消所有拉取循环 等待正在进行的拉取结束
+func (s *ServerManager) Stop(ctx context.Context) error {
+	s.loopLock.Lock()
+	cancel := s.cancel
+	s.cancel = nil
+	s.loopLock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		s.polls.Wait()
+		close(done)
+	}()
+
+	err := s.heartbeat.Stop(ctx)
+	if s.ipDatabase != nil {
+		if e := s.ipDatabase.Stop(ctx); err == nil {
+			err = e
+		}
+	}
+	if e := waitDone(ctx, done); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Start 之前加入的节点在 Start 时开始拉取
+func (s *ServerManager) startPolling(svr *SrsServer) {
+	s.loopLock.Lock()
+	defer s.loopLock.Unlock()
+	if s.cancel == nil || s.polling[svr] {
+		return
+	}
+	s.polling[svr] = true
+	s.polls.Add(1)
+	ctx := s.ctx
+	go func() {
+		defer s.polls.Done()
+		svr.UpdateStatusLoop(ctx, s.PollInterval)
+		s.loopLock.Lock()
+		delete(s.polling, svr)
+		s.loopLock.Unlock()
+	}()
+}
+
 func (s *ServerManager) HttpHandler(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Path
-	if strings.HasPrefix(url, URL_PATH_SUMMARIES) {
+	if strings.HasPrefix(url, URL_PATH_STREAMS_AGGREGATE) {
+		s.aggregateHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_SUMMARIES) {
 		s.summaryHandler(w, r)
 	} else if strings.HasPrefix(url, URL_PATH_STREAMS) {
 		s.streamHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_CLIENTS) {
+		s.clientsHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_VHOSTS) {
+		s.vhostsHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_SERVER_HEARTBEAT) {
+		s.heartbeatHandler(w, r)
+	} else if strings.HasPrefix(url, URL_PATH_SERVER_APPROVE) {
+		s.approveHandler(w, r)
 	} else if strings.HasPrefix(url, URL_PATH_SERVER) {
 		s.serverHandler(w, r)
 	}
@@ -176,6 +317,110 @@ func (s *ServerManager) summaryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+const (
+	CLIENT_TYPE_PUBLISH = "publish"
+	CLIENT_TYPE_PLAY    = "play"
+)
+
+type ClusterClient struct {
+	ID         int
+	Ip         string
+	Type       string // publish | play
+	Duration   float64
+	Host       string // 所在的srs节点
+	ServerType string
+	VHost      string
+	AppName    string
+	StreamName string
+	PageUrl    string
+	TcUrl      string
+}
+
+// /clients?stream=xxx&app=live&type=down
+func (s *ServerManager) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	types := []string{STR_TYPE_EDGE_UP, STR_TYPE_EDGE_DOWN, STR_TYPE_ORIGIN}
+	if t := query.Get("type"); t != "" {
+		types = []string{t}
+	}
+
+	result := make([]*ClusterClient, 0)
+	for _, t := range types {
+		if s.getTypeByName(t) < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		clients := s.GetClusterClients(t)
+		for _, c := range clients {
+			if stream := query.Get("stream"); stream != "" && c.StreamName != stream {
+				continue
+			}
+			if app := query.Get("app"); app != "" && c.AppName != app {
+				continue
+			}
+			result = append(result, c)
+		}
+	}
+
+	if err := utils.WriteObjectResponse(w, result); err != nil {
+		glog.Warningln("clientsHandler writeRespons err", err)
+	}
+}
+
+// 合并某一类节点上拉取到的所有client
+func (s *ServerManager) GetClusterClients(typeName string) []*ClusterClient {
+	result := make([]*ClusterClient, 0)
+	for _, svr := range s.getServerList(typeName) {
+		vhosts := make(map[int]string)
+		for _, v := range svr.GetVhosts().Vhosts {
+			vhosts[v.ID] = v.Name
+		}
+		for _, c := range svr.GetClients().Clients {
+			cc := &ClusterClient{
+				ID:         c.ID,
+				Ip:         c.Ip,
+				Type:       CLIENT_TYPE_PLAY,
+				Duration:   c.Alive,
+				Host:       svr.Addr,
+				ServerType: typeName,
+				VHost:      vhosts[c.VHost],
+				PageUrl:    c.PageUrl,
+				TcUrl:      c.TcUrl,
+			}
+			if c.Publish {
+				cc.Type = CLIENT_TYPE_PUBLISH
+			}
+			if stream := svr.findStream(c.Stream); stream != nil {
+				cc.AppName = stream.AppName
+				cc.StreamName = stream.Name
+			}
+			result = append(result, cc)
+		}
+	}
+	return result
+}
+
+// /vhosts/edge
+func (s *ServerManager) vhostsHandler(w http.ResponseWriter, r *http.Request) {
+	args := GetUrlParams(r.URL.Path, URL_PATH_VHOSTS)
+	servers, mutex := s.getServersByName(args[0])
+	if servers == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	infos := make(map[string]*VhostInfo)
+	mutex.Lock()
+	for h, svr := range servers {
+		infos[h] = svr.GetVhosts()
+	}
+	mutex.Unlock()
+
+	if err := utils.WriteObjectResponse(w, infos); err != nil {
+		glog.Warningf("vhostsHandler-writeRespons infos[%v] err[%v]\n", infos, err)
+	}
+}
+
 type ReqCreateServer struct {
 	Addr       string `json:"addr"`
 	Desc       string `json:"desc"`
@@ -184,18 +429,30 @@ type ReqCreateServer struct {
 
 // server/dege  PUT
 func (s *ServerManager) serverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == HTTP_GET {
+		s.listServersHandler(w, r)
+		return
+	} else if r.Method == HTTP_DELETE {
+		s.removeServerHandler(w, r)
+		return
+	}
 	var (
 		req    ReqCreateServer
 		err    error
 		server *SrsServer
 	)
 	code := http.StatusBadRequest
+	entry := NewAuditEntry(r, AUDIT_SERVER_ADD, "")
 	if err = utils.ReadAndUnmarshalObject(r.Body, &req); err != nil {
 		goto errDeal
 	}
 
 	server = NewSrsServer(req.Addr, req.Desc, req.ServerType)
-	if err = s.AddServer(server); err != nil {
+	err = s.AddServer(r.Context(), server)
+	entry.Target = req.Addr
+	entry.Payload = fmt.Sprintf("type=%v desc=%v", req.ServerType, req.Desc)
+	s.audit.Record(entry, err)
+	if err != nil {
 		code = http.StatusInternalServerError
 		goto errDeal
 	}
@@ -211,32 +468,383 @@ errDeal:
 
 }
 
-func (s *ServerManager) AddServer(svr *SrsServer) (err error) {
+// GET /server?type=down  节点列表 带省份 运营商和负载
+func (s *ServerManager) listServersHandler(w http.ResponseWriter, r *http.Request) {
+	types := []string{STR_TYPE_EDGE_UP, STR_TYPE_EDGE_DOWN, STR_TYPE_ORIGIN}
+	if t := r.URL.Query().Get("type"); t != "" {
+		if GetServerType(t) < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		types = []string{t}
+	}
+
+	result := make([]*ServerView, 0)
+	for _, t := range types {
+		for _, svr := range s.getServerList(t) {
+			result = append(result, svr.View(t))
+		}
+	}
+
+	if err := utils.WriteObjectResponse(w, result); err != nil {
+		glog.Warningln("listServersHandler writeRespons err", err)
+	}
+}
+
+// DELETE /server/{addr}
+func (s *ServerManager) removeServerHandler(w http.ResponseWriter, r *http.Request) {
+	args := GetUrlParams(r.URL.Path, URL_PATH_SERVER)
+	if len(args) != 1 || args[0] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		glog.Warningln("removeServerHandler invalid args", args)
+		return
+	}
+	entry := NewAuditEntry(r, AUDIT_SERVER_REMOVE, args[0])
+	err := s.RemoveServer(r.Context(), args[0])
+	s.audit.Record(entry, err)
+	if err == ErrServerNotFound {
+		w.WriteHeader(http.StatusNotFound)
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err != nil {
+		glog.Warningln("RemoveServer", args[0], err)
+	}
+}
+
+// 从调度中摘掉节点 并停止拉取状态
+func (s *ServerManager) RemoveServer(ctx context.Context, addr string) error {
+	svr := s.GetServer(addr)
+	if svr == nil {
+		return ErrServerNotFound
+	}
+	if err := s.db.DeleteServer(ctx, svr.ID); err != nil {
+		return err
+	}
+	if servers, mutex := s.getServersByType(svr.Type); servers != nil {
+		mutex.Lock()
+		delete(servers, addr)
+		mutex.Unlock()
+	}
+	svr.SetStatus(SERVER_STATUS_REMOVED)
+	svr.Stop()
+	glog.Infoln("RemoveServer", addr)
+	return nil
+}
+
+func (s *ServerManager) AddServer(ctx context.Context, svr *SrsServer) error {
+	s.addLock.Lock()
+	defer s.addLock.Unlock()
+	return s.addServer(ctx, svr)
+}
+
+// 持有 addLock 调用 写库成功后才加入调度 加入调度失败时删掉写入的记录
+func (s *ServerManager) addServer(ctx context.Context, svr *SrsServer) (err error) {
 	servers, mutex := s.getServersByType(svr.Type)
 	if servers == nil {
 		return fmt.Errorf("AddServer-err server type[%v]", svr.Type)
 	}
 
-	if _, ok := servers[svr.Addr]; ok {
+	if s.GetServer(svr.Addr) != nil {
 		return fmt.Errorf("AddServer-error server[%v] host already exists", svr.Addr)
 	}
 
-	if err = s.ipDatabase.AddServer(svr); err != nil {
-		return fmt.Errorf("AddServer-IpDataBase Add server:%v err:%v", svr.Addr, err)
+	if err = s.db.InsertServer(ctx, svr); err != nil {
+		return fmt.Errorf("AddServer-dbInsert server:%v err:%v", svr.Addr, err)
 	}
 
-	if err = s.db.InsertServer(svr); err != nil {
-		return fmt.Errorf("AddServer-dbInsert server:%v err:%v", svr.Addr, err)
+	if err = s.ipDatabase.AddServer(svr); err != nil {
+		if e := s.db.DeleteServer(ctx, svr.ID); e != nil {
+			glog.Warningln("AddServer-DeleteServer", svr.Addr, e)
+		}
+		return fmt.Errorf("AddServer-IpDataBase Add server:%v err:%v", svr.Addr, err)
 	}
 
 	mutex.Lock()
 	servers[svr.Addr] = svr
 	mutex.Unlock()
-	go svr.UpdateStatusLoop()
+	s.startPolling(svr)
 
 	return
 }
 
+type ReqHeartbeat struct {
+	Addr     string `json:"addr"`
+	Role     string `json:"role"` // up | down | origin
+	Idc      int    `json:"idc"`
+	Capacity int    `json:"capacity"`
+	Version  string `json:"version"`
+	Desc     string `json:"desc"`
+}
+
+// server/heartbeat POST
+// 节点定时上报 未注册的节点自动注册
+func (s *ServerManager) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		req        ReqHeartbeat
+		err        error
+		server     *SrsServer
+		registered bool
+	)
+	code := http.StatusBadRequest
+	if r.Method != HTTP_POST {
+		err = fmt.Errorf("method %v not allowed", r.Method)
+		goto errDeal
+	}
+	if err = utils.ReadAndUnmarshalObject(r.Body, &req); err != nil {
+		goto errDeal
+	}
+	if s.guard != nil {
+		if err = s.guard.VerifyHeartbeat(r, req.Addr); err != nil {
+			code = http.StatusForbidden
+			goto errDeal
+		}
+	}
+	server, registered, err = s.Heartbeat(r.Context(), req)
+	if registered {
+		// 自动注册 操作人为节点自己
+		entry := NewAuditEntry(r, AUDIT_SERVER_ADD, req.Addr)
+		entry.Actor = AUDIT_ACTOR_SRS
+		entry.Payload = fmt.Sprintf("role=%v idc=%v version=%v", req.Role, req.Idc, req.Version)
+		s.audit.Record(entry, err)
+	}
+	if err != nil {
+		code = http.StatusInternalServerError
+		goto errDeal
+	}
+	if err = utils.WriteObjectResponse(w, server); err != nil {
+		goto errDeal
+	}
+
+	return
+errDeal:
+	w.WriteHeader(code)
+	glog.Warningf("Heartbeat error-req[%v] err[%v]\n", req, err)
+}
+
+// 返回的 bool 表示这次心跳尝试了自动注册
+func (s *ServerManager) Heartbeat(ctx context.Context, req ReqHeartbeat) (*SrsServer, bool, error) {
+	serverType := s.getTypeByName(req.Role)
+	if serverType < 0 {
+		return nil, false, fmt.Errorf("Heartbeat-invalid role[%v]", req.Role)
+	}
+	if req.Addr == "" {
+		return nil, false, fmt.Errorf("Heartbeat-empty addr")
+	}
+
+	now := time.Now().Unix()
+	svr, registered, err := s.register(ctx, req, serverType, now)
+	if registered || err != nil {
+		return svr, registered, err
+	}
+	if svr.Type != serverType {
+		return nil, false, fmt.Errorf("Heartbeat-server[%v] role mismatch %v", req.Addr, req.Role)
+	}
+	svr.Heartbeat(req, now)
+	if err := s.db.UpdateServerStatus(ctx, svr); err != nil {
+		glog.Warningln("Heartbeat-UpdateServerStatus", req.Addr, err)
+	}
+	return svr, false, nil
+}
+
+// 已注册时返回已有的节点 否则自动注册
+// 同一个节点并发的心跳只有一个注册
+func (s *ServerManager) register(ctx context.Context, req ReqHeartbeat, serverType int, now int64) (*SrsServer, bool, error) {
+	s.addLock.Lock()
+	defer s.addLock.Unlock()
+	if svr := s.GetServer(req.Addr); svr != nil {
+		return svr, false, nil
+	}
+
+	svr := NewSrsServer(req.Addr, req.Desc, serverType)
+	svr.Idc = req.Idc
+	svr.Status = SERVER_STATUS_PENDING
+	if s.serverConfig().HeartbeatAutoActive {
+		svr.Status = SERVER_STATUS_ACTIVE
+	}
+	svr.Heartbeat(req, now)
+	if err := s.addServer(ctx, svr); err != nil {
+		return nil, true, err
+	}
+	glog.Infoln("Heartbeat-register server", svr.Addr, req.Role, svr.Status)
+	return svr, true, nil
+}
+
+type ReqApproveServer struct {
+	Addr string `json:"addr"`
+}
+
+// server/approve POST
+// 审核通过自动注册的节点
+func (s *ServerManager) approveHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		req ReqApproveServer
+		err error
+		svr *SrsServer
+	)
+	code := http.StatusBadRequest
+	if err = utils.ReadAndUnmarshalObject(r.Body, &req); err != nil {
+		goto errDeal
+	}
+	if svr = s.GetServer(req.Addr); svr == nil {
+		code = http.StatusNotFound
+		err = fmt.Errorf("server %v not exists", req.Addr)
+		goto errDeal
+	}
+	if svr.GetStatus() == SERVER_STATUS_PENDING {
+		svr.SetStatus(SERVER_STATUS_ACTIVE)
+		err = s.db.UpdateServerStatus(r.Context(), svr)
+		s.audit.Record(NewAuditEntry(r, AUDIT_SERVER_APPROVE, req.Addr), err)
+		if err != nil {
+			code = http.StatusInternalServerError
+			goto errDeal
+		}
+	}
+	if err = utils.WriteObjectResponse(w, svr); err != nil {
+		goto errDeal
+	}
+
+	return
+errDeal:
+	w.WriteHeader(code)
+	glog.Warningf("Approve server error-req[%v] err[%v]\n", req, err)
+}
+
+// ip 上注册的所有节点 同一台机器可能部署多个 srs
+// 只返回 ACTIVE 的节点 自动注册待审核 心跳超时和已删除的节点不可信
+func (s *ServerManager) GetActiveServersByIp(ip string) []*SrsServer {
+	var result []*SrsServer
+	for i := 0; i < SERVER_TYPE_COUNT; i++ {
+		s.locks[i].Lock()
+		for _, svr := range s.servers[i] {
+			if svr.GetStatus() != SERVER_STATUS_ACTIVE {
+				continue
+			}
+			if host, err := svr.GetPublicAddr(); err == nil && host == ip {
+				result = append(result, svr)
+			}
+		}
+		s.locks[i].Unlock()
+	}
+	return result
+}
+
+// 回调方对应的节点 同一ip有多个节点时用回调地址中的端口区分
+func (s *ServerManager) FindCaller(ip string, args []string) (*SrsServer, error) {
+	servers := s.GetActiveServersByIp(ip)
+	if len(args) == 2 {
+		for _, svr := range servers {
+			if svr.Addr == ip+":"+args[1] {
+				return svr, nil
+			}
+		}
+	}
+	switch len(servers) {
+	case 0:
+		return nil, ErrEventUnknownCaller
+	case 1:
+		return servers[0], nil
+	default:
+		return nil, ErrCallerAmbiguous
+	}
+}
+
+func (s *ServerManager) GetServer(addr string) *SrsServer {
+	for i := 0; i < SERVER_TYPE_COUNT; i++ {
+		s.locks[i].Lock()
+		svr, ok := s.servers[i][addr]
+		s.locks[i].Unlock()
+		if ok {
+			return svr
+		}
+	}
+	return nil
+}
+
+func (s *ServerManager) checkHeartbeatLoop(ctx context.Context) {
+	for sleepContext(ctx, HEARTBEAT_CHECK_INTERVAL) {
+		s.checkHeartbeat(time.Now().Unix())
+	}
+}
+
+func (s *ServerManager) checkHeartbeat(now int64) {
+	timeout := int64(s.serverConfig().HeartbeatTimeout.Seconds())
+	var lapsed []*SrsServer
+	for i := 0; i < SERVER_TYPE_COUNT; i++ {
+		s.locks[i].Lock()
+		for _, svr := range s.servers[i] {
+			if svr.checkHeartbeat(now, timeout) {
+				lapsed = append(lapsed, svr)
+			}
+		}
+		s.locks[i].Unlock()
+	}
+	for _, svr := range lapsed {
+		glog.Warningln("checkHeartbeat server offline", svr.Addr)
+		if err := s.db.UpdateServerStatus(context.Background(), svr); err != nil {
+			glog.Warningln("checkHeartbeat-UpdateServerStatus", svr.Addr, err)
+		}
+	}
+}
+
+func (s *ServerManager) WriteMetrics(w io.Writer) {
+	up := NewGaugeVec(METRIC_SERVER_UP)
+	cpu := NewGaugeVec(METRIC_SERVER_CPU_PERCENT)
+	load := NewGaugeVec(METRIC_SERVER_LOAD_1M)
+	send := NewGaugeVec(METRIC_SERVER_NET_SEND)
+	recv := NewGaugeVec(METRIC_SERVER_NET_RECV)
+	conn := NewGaugeVec(METRIC_SERVER_CONN_SRS)
+	clients := NewGaugeVec(METRIC_STREAM_CLIENTS)
+	kbpsRecv := NewGaugeVec(METRIC_STREAM_KBPS_RECV)
+	kbpsSend := NewGaugeVec(METRIC_STREAM_KBPS_SEND)
+
+	for _, typeName := range []string{STR_TYPE_EDGE_UP, STR_TYPE_EDGE_DOWN, STR_TYPE_ORIGIN} {
+		servers, mutex := s.getServersByName(typeName)
+		mutex.Lock()
+		for addr, svr := range servers {
+			var active float64
+			if svr.GetStatus() == SERVER_STATUS_ACTIVE {
+				active = 1
+			}
+			up.Set(active, "addr", addr, "type", typeName)
+
+			sys := svr.GetSummary().Data.Sys
+			cpu.Set(sys.CPUPercent, "addr", addr, "type", typeName)
+			load.Set(sys.Load1m, "addr", addr, "type", typeName)
+			send.Set(float64(sys.NetSend), "addr", addr, "type", typeName)
+			recv.Set(float64(sys.NetRecv), "addr", addr, "type", typeName)
+			conn.Set(float64(sys.ConnSrs), "addr", addr, "type", typeName)
+
+			for _, st := range svr.GetStreams().Streams {
+				labels := []string{"addr", addr, "type", typeName, "app", st.AppName, "stream", st.Name}
+				clients.Set(float64(st.ClientNum), labels...)
+				kbpsRecv.Set(float64(st.Kbps.Recv30s), labels...)
+				kbpsSend.Set(float64(st.Kbps.Send30s), labels...)
+			}
+		}
+		mutex.Unlock()
+	}
+
+	for _, g := range []*GaugeVec{up, cpu, load, send, recv, conn, clients, kbpsRecv, kbpsSend} {
+		g.Write(w)
+	}
+}
+
+// 某一类节点的快照 遍历时不需要持有锁
+func (s *ServerManager) getServerList(typeName string) []*SrsServer {
+	servers, mutex := s.getServersByName(typeName)
+	if servers == nil {
+		return nil
+	}
+	mutex.Lock()
+	result := make([]*SrsServer, 0, len(servers))
+	for _, svr := range servers {
+		result = append(result, svr)
+	}
+	mutex.Unlock()
+	return result
+}
+
 func (s *ServerManager) getServersByType(serverType int) (map[string]*SrsServer,
 	*sync.Mutex) {
 	if serverType > -1 && serverType < SERVER_TYPE_COUNT {
@@ -247,6 +855,10 @@ func (s *ServerManager) getServersByType(serverType int) (map[string]*SrsServer,
 }
 
 func (s *ServerManager) getTypeByName(name string) int {
+	return GetServerType(name)
+}
+
+func GetServerType(name string) int {
 	switch name {
 	case STR_TYPE_EDGE_UP:
 		return SERVER_TYPE_EDGE_UP
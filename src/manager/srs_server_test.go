@@ -0,0 +1,86 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"utils"
+)
+
+// 超过一页的 stream 分页拉取 不支持分页的 srs 只取一次
+func TestUpdateServerStreamsPaging(t *testing.T) {
+	for _, paging := range []bool{true, false} {
+		total := 250
+		if !paging {
+			total = utils.STREAMS_PAGE_SIZE
+		}
+		srs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+			count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+			if !paging {
+				start = 0
+			}
+			rsp := utils.RspStream{}
+			for i := start; i < start+count && i < total; i++ {
+				rsp.Streams = append(rsp.Streams, utils.Stream{ID: i, Name: "s" + strconv.Itoa(i)})
+			}
+			json.NewEncoder(w).Encode(rsp)
+		}))
+
+		svr := NewSrsServer(strings.TrimPrefix(srs.URL, "http://"), "", SERVER_TYPE_ORIGIN)
+		svr.UpdateServerStreams(context.Background())
+		if got := len(svr.GetStreams().Streams); got != total {
+			t.Errorf("paging:%v streams got %v want %v", paging, got, total)
+		}
+		srs.Close()
+	}
+}
+
+// 并发的心跳只注册一次 加入调度失败时不留下数据库记录
+func TestHeartbeatRegisterOnce(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	servers := newServerManager(db, nil)
+	config := DefaultConfig().Dispatch
+	config.IpDatabase = "../utils/isp.txt"
+	var err error
+	if servers.ipDatabase, err = NewIpDatabase(config); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	registered := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := servers.Heartbeat(ctx, ReqHeartbeat{Addr: "202.97.25.10:1985", Role: STR_TYPE_EDGE_UP})
+			if err != nil {
+				t.Errorf("heartbeat %v", err)
+			}
+			lock.Lock()
+			if ok {
+				registered++
+			}
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	if list, _ := db.LoadSrsServers(ctx); registered != 1 || len(list) != 1 {
+		t.Errorf("registered %v servers in db %v", registered, len(list))
+	}
+
+	// ip 库中没有的网段
+	if _, _, err = servers.Heartbeat(ctx, ReqHeartbeat{Addr: "1.2.3.4:1985", Role: STR_TYPE_EDGE_UP}); err == nil {
+		t.Errorf("heartbeat from unknown subnet should fail")
+	}
+	if list, _ := db.LoadSrsServers(ctx); len(list) != 1 || servers.GetServer("1.2.3.4:1985") != nil {
+		t.Errorf("failed register left %v servers in db", len(list))
+	}
+}
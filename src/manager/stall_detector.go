@@ -0,0 +1,314 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	STREAM_HEALTHY  = "healthy"
+	STREAM_DEGRADED = "degraded" // 码率低于 degradedKbps
+	STREAM_STALLED  = "stalled"  // 源站上没有流 推流端不活跃 或者码率低于 stallKbps
+
+	STALL_CHECK_INTERVAL = 10 * time.Second
+	DefaultStallKbps     = 10
+	DefaultDegradedKbps  = 100
+	DefaultStallFor      = 30 * time.Second
+	DefaultIncidentLimit = 100
+
+	URL_SUB_PATH_INCIDENTS = "incidents"
+)
+
+type StreamIncident struct {
+	Id         int64
+	StreamName string
+	UserName   string
+	State      string
+	Detail     string
+	StartTime  int64
+	EndTime    int64 // 0 表示未结束
+	Kicked     bool
+}
+
+type StreamHealth struct {
+	StreamName string
+	UserName   string
+	State      string
+	RecvKbps   int
+	Active     bool
+	Detail     string
+	Since      int64 // 进入当前状态的时间
+	UpdateTime int64
+
+	raw      string // 本次检查的结果 stalled需要持续 stallFor 秒才生效
+	rawSince int64
+	// 源站的新数据确认推流端不活跃或者码率过低的开始时间 0 表示未确认
+	confirmedSince int64
+	incident       *StreamIncident
+}
+
+// 源站上的流和拉取的时间
+type originStream struct {
+	utils.Stream
+	updateTime int64
+}
+
+// 检查每个推流中的room在源站上的码率和推流端状态
+type StallDetector struct {
+	db    Store
+	sm    *ServerManager
+	kicks *KickManager
+	loop  Loop
+
+	stallKbps    int
+	degradedKbps int
+	stallFor     int64
+	autoKick     bool
+	webhook      *WebhookNotifier
+
+	lock   sync.RWMutex
+	health map[string]*StreamHealth
+}
+
+func NewStallDetector(config *Config, db Store, sm *ServerManager, kicks *KickManager) *StallDetector {
+	d := &StallDetector{
+		db:     db,
+		sm:     sm,
+		kicks:  kicks,
+		health: make(map[string]*StreamHealth),
+	}
+	d.ApplyConfig(config)
+	return d
+}
+
+func (d *StallDetector) ApplyConfig(config *Config) {
+	var webhook *WebhookNotifier
+	if config.Stall.Webhook != "" {
+		webhook = NewWebhookNotifier(config.Stall.Webhook)
+	}
+	d.lock.Lock()
+	d.stallKbps = config.Stall.Kbps
+	d.degradedKbps = config.Stall.DegradedKbps
+	d.stallFor = int64(config.Stall.For.Seconds())
+	d.autoKick = config.Stall.AutoKick
+	d.webhook = webhook
+	d.lock.Unlock()
+}
+
+func (d *StallDetector) Start(ctx context.Context) {
+	d.loop.Start(ctx, d.Run)
+}
+
+func (d *StallDetector) Stop(ctx context.Context) error {
+	return d.loop.Stop(ctx)
+}
+
+func (d *StallDetector) Run(ctx context.Context) {
+	for sleepContext(ctx, STALL_CHECK_INTERVAL) {
+		if err := d.check(time.Now().Unix()); err != nil {
+			glog.Warningln("StallDetector check", err)
+		}
+	}
+}
+
+// 当前源站上的流 同名的流在多个源站上时取码率最高的
+func (d *StallDetector) originStreams() map[string]originStream {
+	streams := make(map[string]originStream)
+	for _, svr := range d.sm.getServerList(STR_TYPE_ORIGIN) {
+		info := svr.GetStreams()
+		for _, st := range info.Streams {
+			if old, ok := streams[st.Name]; !ok || st.Kbps.Recv30s > old.Kbps.Recv30s {
+				streams[st.Name] = originStream{Stream: st, updateTime: info.UpdateTime}
+			}
+		}
+	}
+	return streams
+}
+
+// 返回的 confirmed 表示 stalled 由不超过 stallFor 的源站数据确认
+// 源站上没有找到流可能只是拉取失败或者不完整 不算确认
+func (d *StallDetector) classify(st originStream, ok bool, now int64) (string, string, bool) {
+	d.lock.RLock()
+	stallKbps, degradedKbps, stallFor := d.stallKbps, d.degradedKbps, d.stallFor
+	d.lock.RUnlock()
+	fresh := ok && now-st.updateTime <= stallFor
+	switch {
+	case !ok:
+		return STREAM_STALLED, "stream not found on origin", false
+	case !st.Publish.Active:
+		return STREAM_STALLED, "publisher not active", fresh
+	case st.Kbps.Recv30s <= stallKbps:
+		return STREAM_STALLED, fmt.Sprintf("recv %v kbps <= %v", st.Kbps.Recv30s, stallKbps), fresh
+	case st.Kbps.Recv30s < degradedKbps:
+		return STREAM_DEGRADED, fmt.Sprintf("recv %v kbps < %v", st.Kbps.Recv30s, degradedKbps), false
+	}
+	return STREAM_HEALTHY, "", false
+}
+
+func (d *StallDetector) check(now int64) error {
+	rooms, err := d.db.SelectRooms(context.Background(), map[string]interface{}{"status": ROOM_PUBLISH})
+	if err != nil {
+		return err
+	}
+	streams := d.originStreams()
+
+	live := make(map[string]bool)
+	for _, room := range rooms {
+		live[room.StreamName] = true
+		st, ok := streams[room.StreamName]
+		raw, detail, confirmed := d.classify(st, ok, now)
+		d.observe(room, st.Stream, raw, detail, confirmed, now)
+	}
+
+	// 已经不在推流的room 结束未完成的事件
+	d.lock.Lock()
+	var ended []*StreamIncident
+	for name, h := range d.health {
+		if !live[name] {
+			if h.incident != nil {
+				h.incident.EndTime = now
+				ended = append(ended, h.incident)
+			}
+			delete(d.health, name)
+		}
+	}
+	d.lock.Unlock()
+	for _, incident := range ended {
+		d.updateIncident(incident)
+	}
+	return nil
+}
+
+func (d *StallDetector) observe(room *Room, st utils.Stream, raw, detail string, confirmed bool, now int64) {
+	d.lock.Lock()
+	h, ok := d.health[room.StreamName]
+	if !ok {
+		h = &StreamHealth{StreamName: room.StreamName, UserName: room.UserName,
+			State: STREAM_HEALTHY, Since: now, raw: raw, rawSince: now}
+		d.health[room.StreamName] = h
+	}
+	if h.raw != raw {
+		h.raw = raw
+		h.rawSince = now
+	}
+	if !confirmed {
+		h.confirmedSince = 0
+	} else if h.confirmedSince == 0 {
+		h.confirmedSince = now
+	}
+	h.RecvKbps = st.Kbps.Recv30s
+	h.Active = st.Publish.Active
+	h.Detail = detail
+	h.UpdateTime = now
+
+	state := raw
+	if raw == STREAM_STALLED && now-h.rawSince < d.stallFor {
+		// stalled 还没有持续足够长的时间
+		state = h.State
+		if state == STREAM_HEALTHY {
+			state = STREAM_DEGRADED
+		}
+	}
+	changed := state != h.State
+	var old *StreamIncident
+	if changed {
+		glog.Infoln("StallDetector", room.StreamName, h.State, "->", state, detail)
+		h.State = state
+		h.Since = now
+		old = h.incident
+		h.incident = nil
+		if state != STREAM_HEALTHY {
+			h.incident = &StreamIncident{StreamName: room.StreamName, UserName: room.UserName,
+				State: state, Detail: detail, StartTime: now}
+		}
+	}
+	incident := h.incident
+	// 确认持续 stallFor 秒才踢 每个事件只踢一次
+	kick := state == STREAM_STALLED && incident != nil && !incident.Kicked && d.autoKick &&
+		room.PublishHost != "" && h.confirmedSince > 0 && now-h.confirmedSince >= d.stallFor
+	if kick {
+		incident.Kicked = true
+	}
+	snapshot := *h
+	webhook := d.webhook
+	d.lock.Unlock()
+
+	if kick {
+		// 只踢掉推流端让编码器重连 不关闭room
+		d.kicks.Submit(room.StreamName, room.PublishHost, room.PublishClientId, KICK_TARGET_PUBLISHER, nil)
+	}
+	if !changed {
+		if kick {
+			d.updateIncident(incident)
+		}
+		return
+	}
+	if old != nil {
+		old.EndTime = now
+		d.updateIncident(old)
+	}
+	if incident == nil {
+		return
+	}
+	if err := d.db.InsertIncident(context.Background(), incident); err != nil {
+		glog.Warningln("StallDetector InsertIncident", room.StreamName, err)
+	}
+	if webhook != nil {
+		if err := webhook.Send(snapshot); err != nil {
+			glog.Warningln("StallDetector webhook", room.StreamName, err)
+		}
+	}
+}
+
+func (d *StallDetector) updateIncident(incident *StreamIncident) {
+	if incident.Id == 0 {
+		return
+	}
+	if err := d.db.UpdateIncident(context.Background(), incident); err != nil {
+		glog.Warningln("StallDetector UpdateIncident", incident.StreamName, err)
+	}
+}
+
+func (d *StallDetector) List() []StreamHealth {
+	d.lock.RLock()
+	result := make([]StreamHealth, 0, len(d.health))
+	for _, h := range d.health {
+		result = append(result, *h)
+	}
+	d.lock.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].StreamName < result[j].StreamName })
+	return result
+}
+
+// /stall                          GET 当前推流中的room状态
+// /stall/incidents?stream=xxx     GET 历史事件
+func (d *StallDetector) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	args := GetUrlParams(r.URL.Path, URL_PATH_STALL)
+	var result interface{}
+	switch args[0] {
+	case "":
+		result = d.List()
+	case URL_SUB_PATH_INCIDENTS:
+		incidents, err := d.db.SelectIncidents(r.Context(), r.URL.Query().Get("stream"), DefaultIncidentLimit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			glog.Warningln("SelectIncidents", err)
+			return
+		}
+		result = incidents
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := utils.WriteObjectResponse(w, result); err != nil {
+		glog.Warningln("StallDetector writeRespons err", err)
+	}
+}
@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+	"utils"
+)
+
+// 只有源站的新数据确认推流端不活跃 持续 stallFor 后才自动踢
+func TestStallAutoKick(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	config := DefaultConfig()
+	config.Stall.AutoKick = true
+	config.Stall.For.Duration = 30 * time.Second
+	servers := newServerManager(db, nil)
+	origin := NewSrsServer("1.2.3.4:1985", "", SERVER_TYPE_ORIGIN)
+	servers.servers[SERVER_TYPE_ORIGIN][origin.Addr] = origin
+	kicks := NewKickManager(config, db)
+	d := NewStallDetector(config, db, servers, kicks)
+	db.InsertRoom(ctx, &Room{StreamName: "s1", Status: ROOM_PUBLISH, PublishHost: "127.0.0.1:1", PublishClientId: 1})
+
+	setStreams := func(updateTime int64, streams ...utils.Stream) {
+		origin.streamsLock.Lock()
+		origin.streams = &StreamInfo{Host: origin.Addr, UpdateTime: updateTime, Streams: streams}
+		origin.streamsLock.Unlock()
+	}
+	kicked := func() bool {
+		_, ok := kicks.Active("s1", KICK_TARGET_PUBLISHER)
+		return ok
+	}
+
+	// 源站上没有找到流
+	now := int64(1000)
+	setStreams(now)
+	d.check(now)
+	d.check(now + 40)
+	if h := d.List(); len(h) != 1 || h[0].State != STREAM_STALLED || kicked() {
+		t.Fatalf("absent stream got %+v kicked:%v", h, kicked())
+	}
+
+	// 数据过期
+	inactive := utils.Stream{Name: "s1", Kbps: utils.KbpsInfo{Recv30s: 500}}
+	setStreams(now, inactive)
+	d.check(now + 80)
+	d.check(now + 120)
+	if kicked() {
+		t.Fatalf("stale scrape should not kick")
+	}
+
+	// 新数据确认不活跃 持续 stallFor 后踢一次
+	setStreams(now+150, inactive)
+	d.check(now + 150)
+	if kicked() {
+		t.Fatalf("kick before stallFor")
+	}
+	setStreams(now+180, inactive)
+	d.check(now + 180)
+	if !kicked() {
+		t.Fatalf("confirmed stall should kick")
+	}
+	incidents, _ := db.SelectIncidents(ctx, "s1", 10)
+	for _, incident := range incidents {
+		if incident.Kicked != (incident.State == STREAM_STALLED) {
+			t.Errorf("incident %+v", *incident)
+		}
+	}
+}
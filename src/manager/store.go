@@ -0,0 +1,119 @@
+package manager
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const (
+	STORE_DRIVER_MYSQL  = "mysql"
+	STORE_DRIVER_SQLITE = "sqlite3"
+	STORE_DRIVER_MEMORY = "memory"
+)
+
+// room 黑名单 地域限制和来源域名白名单
+// SelectRoom 找不到时返回 nil, nil
+type RoomStore interface {
+	InsertRoom(ctx context.Context, room *Room) error
+	UpdateRoom(ctx context.Context, room *Room) error
+	SelectRoom(ctx context.Context, params map[string]interface{}) (*Room, error)
+	SelectRooms(ctx context.Context, params map[string]interface{}) ([]*Room, error)
+	CountRoomsByStatus(ctx context.Context) (map[int]int, error)
+
+	InsertRoomBan(ctx context.Context, ban *RoomBan) error
+	DeleteRoomBan(ctx context.Context, id int64) error
+	LoadRoomBans(ctx context.Context) ([]*RoomBan, error)
+
+	InsertRoomGeoRule(ctx context.Context, rule *RoomGeoRule) error
+	DeleteRoomGeoRule(ctx context.Context, id int64) error
+	LoadRoomGeoRules(ctx context.Context) ([]*RoomGeoRule, error)
+
+	InsertRefererRule(ctx context.Context, rule *RefererRule) error
+	DeleteRefererRule(ctx context.Context, id int64) error
+	LoadRefererRules(ctx context.Context) ([]*RefererRule, error)
+}
+
+// srs 节点
+type ServerStore interface {
+	LoadSrsServers(ctx context.Context) ([]*SrsServer, error)
+	InsertServer(ctx context.Context, svr *SrsServer) error
+	UpdateServerStatus(ctx context.Context, svr *SrsServer) error
+	DeleteServer(ctx context.Context, id int64) error
+}
+
+// 按会话累计的数据 观众地域和流量
+type SessionStore interface {
+	AddGeoPlays(ctx context.Context, plays []*GeoPlays) error
+	SelectGeoPlays(ctx context.Context, streamName string, from, to int64) ([]*GeoPlays, error)
+
+	AddUsage(ctx context.Context, buckets []*UsageBucket) error
+	SumUsage(ctx context.Context, column string, from, to int64) ([]*UsageReportRow, error)
+	SelectHourlyUsage(ctx context.Context, column string, from, to int64) ([]*UsageHourly, error)
+}
+
+// 推流事件和历史采样
+type EventStore interface {
+	InsertIncident(ctx context.Context, incident *StreamIncident) error
+	UpdateIncident(ctx context.Context, incident *StreamIncident) error
+	SelectIncidents(ctx context.Context, streamName string, limit int) ([]*StreamIncident, error)
+
+	InsertHistoryRollups(ctx context.Context, rollups []*HistoryRollup) error
+	DeleteHistoryRollups(ctx context.Context, resolution int, before int64) error
+	SelectHistoryRollups(ctx context.Context, series string, resolution int, from, to int64) ([]*HistoryRollup, error)
+}
+
+// 操作审计
+type AuditStore interface {
+	InsertAudits(ctx context.Context, entries []*AuditEntry) error
+	SelectAudits(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error)
+	DeleteAudits(ctx context.Context, before int64) error
+}
+
+// 踢人任务 重启后继续未完成的任务
+type KickStore interface {
+	InsertKickJob(ctx context.Context, job *KickJob) error
+	UpdateKickJob(ctx context.Context, job *KickJob) error
+	// 最近创建的 limit 个任务 按创建时间倒序
+	LoadKickJobs(ctx context.Context, limit int) ([]*KickJob, error)
+	// 所有未完成的任务 不受 limit 限制
+	LoadUnfinishedKickJobs(ctx context.Context) ([]*KickJob, error)
+	// 删除 before 之前结束的任务 未完成的任务保留
+	DeleteKickJobs(ctx context.Context, before int64) error
+}
+
+// 管理接口的 api key
+type KeyStore interface {
+	InsertApiKey(ctx context.Context, key *ApiKey) error
+	DeleteApiKey(ctx context.Context, id int64) error
+	LoadApiKeys(ctx context.Context) ([]*ApiKey, error)
+}
+
+type Store interface {
+	RoomStore
+	ServerStore
+	SessionStore
+	EventStore
+	AuditStore
+	KeyStore
+	KickStore
+}
+
+// 有连接池的 Store 实现 用来输出连接池状态
+type PoolStatser interface {
+	Stats() sql.DBStats
+}
+
+// driver: mysql | sqlite3 | memory
+func NewStore(driver, source string, opts DBPoolOptions) (Store, error) {
+	switch driver {
+	case STORE_DRIVER_MYSQL, "":
+		return NewDBSync(STORE_DRIVER_MYSQL, source, opts)
+	case STORE_DRIVER_SQLITE:
+		return NewSQLiteStore(source, opts)
+	case STORE_DRIVER_MEMORY:
+		return NewMemStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store driver %v", driver)
+	}
+}
@@ -0,0 +1,624 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 内存存储 测试和不需要持久化的场景使用 进程退出后数据丢失
+type MemStore struct {
+	lock sync.RWMutex
+
+	nextId    int64
+	rooms     map[int64]*Room
+	servers   map[int64]*SrsServer
+	bans      map[int64]*RoomBan
+	geoRules  map[int64]*RoomGeoRule
+	referers  map[int64]*RefererRule
+	incidents []*StreamIncident
+	history   []*HistoryRollup
+	geo       map[string]*GeoPlays
+	usage     map[string]*UsageBucket
+	audits    []*AuditEntry
+	keys      map[int64]*ApiKey
+	kickJobs  map[string]*KickJob
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		rooms:    make(map[int64]*Room),
+		servers:  make(map[int64]*SrsServer),
+		bans:     make(map[int64]*RoomBan),
+		geoRules: make(map[int64]*RoomGeoRule),
+		referers: make(map[int64]*RefererRule),
+		geo:      make(map[string]*GeoPlays),
+		usage:    make(map[string]*UsageBucket),
+		keys:     make(map[int64]*ApiKey),
+		kickJobs: make(map[string]*KickJob),
+	}
+}
+
+func (m *MemStore) newId() int64 {
+	m.nextId++
+	return m.nextId
+}
+
+func (m *MemStore) InsertRoom(ctx context.Context, room *Room) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, r := range m.rooms {
+		if r.StreamName == room.StreamName {
+			return fmt.Errorf("duplicate streamname %v", room.StreamName)
+		}
+	}
+	room.CreateTime = time.Now().Unix()
+	room.LastUpdateTime = room.CreateTime
+	room.Id = m.newId()
+	copied := *room
+	m.rooms[room.Id] = &copied
+	return nil
+}
+
+func (m *MemStore) UpdateRoom(ctx context.Context, room *Room) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old, ok := m.rooms[room.Id]
+	if !ok {
+		return fmt.Errorf("room %v not exists", room.Id)
+	}
+	room.LastUpdateTime = time.Now().Unix()
+	// 和 DBSync.UpdateRoom 一样只更新这些列
+	old.Desc = room.Desc
+	old.StreamName = room.StreamName
+	old.Expiration = room.Expiration
+	old.Status = room.Status
+	old.PublishClientId = room.PublishClientId
+	old.PublishHost = room.PublishHost
+	old.LastUpdateTime = room.LastUpdateTime
+	return nil
+}
+
+// 支持的查询条件和 room 表的列名一致
+func roomColumn(room *Room, column string) (interface{}, bool) {
+	switch column {
+	case "id":
+		return room.Id, true
+	case "user":
+		return room.UserName, true
+	case "bu":
+		return room.BusinessUnit, true
+	case "streamname":
+		return room.StreamName, true
+	case "status":
+		return room.Status, true
+	case "publishhost":
+		return room.PublishHost, true
+	default:
+		return nil, false
+	}
+}
+
+func (m *MemStore) matchRooms(params map[string]interface{}) ([]*Room, error) {
+	rooms := make([]*Room, 0)
+	for _, room := range m.rooms {
+		matched := true
+		for k, v := range params {
+			value, ok := roomColumn(room, k)
+			if !ok {
+				return nil, fmt.Errorf("unknown room column %v", k)
+			}
+			if fmt.Sprint(value) != fmt.Sprint(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			copied := *room
+			rooms = append(rooms, &copied)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Id < rooms[j].Id })
+	return rooms, nil
+}
+
+func (m *MemStore) SelectRoom(ctx context.Context, params map[string]interface{}) (*Room, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	rooms, err := m.matchRooms(params)
+	if err != nil || len(rooms) == 0 {
+		return nil, err
+	}
+	return rooms[0], nil
+}
+
+func (m *MemStore) SelectRooms(ctx context.Context, params map[string]interface{}) ([]*Room, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.matchRooms(params)
+}
+
+func (m *MemStore) CountRoomsByStatus(ctx context.Context) (map[int]int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	counts := make(map[int]int)
+	for _, room := range m.rooms {
+		counts[room.Status]++
+	}
+	return counts, nil
+}
+
+func (m *MemStore) InsertRoomBan(ctx context.Context, ban *RoomBan) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ban.Id = m.newId()
+	copied := *ban
+	m.bans[ban.Id] = &copied
+	return nil
+}
+
+func (m *MemStore) DeleteRoomBan(ctx context.Context, id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.bans, id)
+	return nil
+}
+
+func (m *MemStore) LoadRoomBans(ctx context.Context) ([]*RoomBan, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	bans := make([]*RoomBan, 0, len(m.bans))
+	for _, ban := range m.bans {
+		copied := *ban
+		bans = append(bans, &copied)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Id < bans[j].Id })
+	return bans, nil
+}
+
+func (m *MemStore) InsertRoomGeoRule(ctx context.Context, rule *RoomGeoRule) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rule.Id = m.newId()
+	copied := *rule
+	m.geoRules[rule.Id] = &copied
+	return nil
+}
+
+func (m *MemStore) DeleteRoomGeoRule(ctx context.Context, id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.geoRules, id)
+	return nil
+}
+
+func (m *MemStore) LoadRoomGeoRules(ctx context.Context) ([]*RoomGeoRule, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	rules := make([]*RoomGeoRule, 0, len(m.geoRules))
+	for _, rule := range m.geoRules {
+		copied := *rule
+		rules = append(rules, &copied)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Id < rules[j].Id })
+	return rules, nil
+}
+
+func (m *MemStore) InsertRefererRule(ctx context.Context, rule *RefererRule) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rule.Id = m.newId()
+	copied := *rule
+	m.referers[rule.Id] = &copied
+	return nil
+}
+
+func (m *MemStore) DeleteRefererRule(ctx context.Context, id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.referers, id)
+	return nil
+}
+
+func (m *MemStore) LoadRefererRules(ctx context.Context) ([]*RefererRule, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	rules := make([]*RefererRule, 0, len(m.referers))
+	for _, rule := range m.referers {
+		copied := *rule
+		rules = append(rules, &copied)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Id < rules[j].Id })
+	return rules, nil
+}
+
+func (m *MemStore) LoadSrsServers(ctx context.Context) ([]*SrsServer, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	servers := make([]*SrsServer, 0, len(m.servers))
+	for _, svr := range m.servers {
+		srs := NewSrsServer(svr.Addr, svr.Desc, svr.Type)
+		srs.ID = svr.ID
+		srs.Status = svr.Status
+		srs.Idc = svr.Idc
+		srs.Capacity = svr.Capacity
+		srs.Version = svr.Version
+		srs.LastSeen = svr.LastSeen
+		servers = append(servers, srs)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	return servers, nil
+}
+
+func (m *MemStore) InsertServer(ctx context.Context, svr *SrsServer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	svr.ID = m.newId()
+	svr.statusLock.RLock()
+	m.servers[svr.ID] = &SrsServer{
+		ID:       svr.ID,
+		Addr:     svr.Addr,
+		Desc:     svr.Desc,
+		Type:     svr.Type,
+		Status:   svr.Status,
+		Idc:      svr.Idc,
+		Capacity: svr.Capacity,
+		Version:  svr.Version,
+		LastSeen: svr.LastSeen,
+	}
+	svr.statusLock.RUnlock()
+	return nil
+}
+
+func (m *MemStore) UpdateServerStatus(ctx context.Context, svr *SrsServer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old, ok := m.servers[svr.ID]
+	if !ok {
+		return fmt.Errorf("server %v not exists", svr.ID)
+	}
+	svr.statusLock.RLock()
+	old.Status = svr.Status
+	old.Capacity = svr.Capacity
+	old.Version = svr.Version
+	old.LastSeen = svr.LastSeen
+	svr.statusLock.RUnlock()
+	return nil
+}
+
+func (m *MemStore) DeleteServer(ctx context.Context, id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.servers, id)
+	return nil
+}
+
+func (m *MemStore) AddGeoPlays(ctx context.Context, plays []*GeoPlays) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, p := range plays {
+		key := fmt.Sprintf("%s/%d/%s/%s", p.StreamName, p.Hour, p.Province, p.Isp)
+		if old, ok := m.geo[key]; ok {
+			old.Plays += p.Plays
+			continue
+		}
+		copied := *p
+		m.geo[key] = &copied
+	}
+	return nil
+}
+
+func (m *MemStore) SelectGeoPlays(ctx context.Context, streamName string, from, to int64) ([]*GeoPlays, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	from = from / GEO_BUCKET * GEO_BUCKET
+	plays := make([]*GeoPlays, 0)
+	for _, p := range m.geo {
+		if p.StreamName == streamName && p.Hour >= from && p.Hour <= to {
+			copied := *p
+			plays = append(plays, &copied)
+		}
+	}
+	sort.Slice(plays, func(i, j int) bool { return plays[i].Hour < plays[j].Hour })
+	return plays, nil
+}
+
+func (m *MemStore) AddUsage(ctx context.Context, buckets []*UsageBucket) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, b := range buckets {
+		key := fmt.Sprintf("%d/%s", b.Hour, b.StreamName)
+		if old, ok := m.usage[key]; ok {
+			old.SendBytes += b.SendBytes
+			old.RecvBytes += b.RecvBytes
+			continue
+		}
+		copied := *b
+		m.usage[key] = &copied
+	}
+	return nil
+}
+
+func usageColumn(b *UsageBucket, column string) (string, error) {
+	switch column {
+	case "user":
+		return b.UserName, nil
+	case "streamname":
+		return b.StreamName, nil
+	case "bu":
+		return b.BusinessUnit, nil
+	default:
+		return "", fmt.Errorf("unknown usage column %v", column)
+	}
+}
+
+func (m *MemStore) SumUsage(ctx context.Context, column string, from, to int64) ([]*UsageReportRow, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	rows := make(map[string]*UsageReportRow)
+	for _, b := range m.usage {
+		if b.Hour < from || b.Hour >= to {
+			continue
+		}
+		key, err := usageColumn(b, column)
+		if err != nil {
+			return nil, err
+		}
+		row, ok := rows[key]
+		if !ok {
+			row = &UsageReportRow{Key: key}
+			rows[key] = row
+		}
+		row.SendBytes += b.SendBytes
+		row.RecvBytes += b.RecvBytes
+	}
+	result := make([]*UsageReportRow, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, row)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+func (m *MemStore) SelectHourlyUsage(ctx context.Context, column string, from, to int64) ([]*UsageHourly, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	rows := make(map[string]*UsageHourly)
+	for _, b := range m.usage {
+		if b.Hour < from || b.Hour >= to {
+			continue
+		}
+		key, err := usageColumn(b, column)
+		if err != nil {
+			return nil, err
+		}
+		k := fmt.Sprintf("%s/%d", key, b.Hour)
+		row, ok := rows[k]
+		if !ok {
+			row = &UsageHourly{Key: key, Hour: b.Hour}
+			rows[k] = row
+		}
+		row.SendBytes += b.SendBytes
+		row.RecvBytes += b.RecvBytes
+	}
+	result := make([]*UsageHourly, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+func (m *MemStore) InsertIncident(ctx context.Context, incident *StreamIncident) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	incident.Id = m.newId()
+	copied := *incident
+	m.incidents = append(m.incidents, &copied)
+	return nil
+}
+
+func (m *MemStore) UpdateIncident(ctx context.Context, incident *StreamIncident) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, old := range m.incidents {
+		if old.Id == incident.Id {
+			old.EndTime = incident.EndTime
+			old.Kicked = incident.Kicked
+			return nil
+		}
+	}
+	return fmt.Errorf("incident %v not exists", incident.Id)
+}
+
+func (m *MemStore) SelectIncidents(ctx context.Context, streamName string, limit int) ([]*StreamIncident, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	incidents := make([]*StreamIncident, 0)
+	for i := len(m.incidents) - 1; i >= 0 && len(incidents) < limit; i-- {
+		if streamName == "" || m.incidents[i].StreamName == streamName {
+			copied := *m.incidents[i]
+			incidents = append(incidents, &copied)
+		}
+	}
+	return incidents, nil
+}
+
+func (m *MemStore) InsertHistoryRollups(ctx context.Context, rollups []*HistoryRollup) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+next:
+	for _, ru := range rollups {
+		copied := *ru
+		for i, old := range m.history {
+			if old.Series == ru.Series && old.Resolution == ru.Resolution && old.Time == ru.Time {
+				m.history[i] = &copied
+				continue next
+			}
+		}
+		m.history = append(m.history, &copied)
+	}
+	return nil
+}
+
+func (m *MemStore) DeleteHistoryRollups(ctx context.Context, resolution int, before int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	kept := m.history[:0]
+	for _, ru := range m.history {
+		if ru.Resolution != resolution || ru.Time >= before {
+			kept = append(kept, ru)
+		}
+	}
+	m.history = kept
+	return nil
+}
+
+func (m *MemStore) SelectHistoryRollups(ctx context.Context, series string, resolution int, from, to int64) ([]*HistoryRollup, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var rollups []*HistoryRollup
+	for _, ru := range m.history {
+		if ru.Series == series && ru.Resolution == resolution && ru.Time >= from && ru.Time <= to {
+			copied := *ru
+			rollups = append(rollups, &copied)
+		}
+	}
+	sort.Slice(rollups, func(i, j int) bool { return rollups[i].Time < rollups[j].Time })
+	return rollups, nil
+}
+
+func (m *MemStore) InsertAudits(ctx context.Context, entries []*AuditEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, e := range entries {
+		e.Id = m.newId()
+		copied := *e
+		m.audits = append(m.audits, &copied)
+	}
+	return nil
+}
+
+func (m *MemStore) SelectAudits(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	entries := make([]*AuditEntry, 0)
+	for i := len(m.audits) - 1; i >= 0 && len(entries) < filter.Limit; i-- {
+		if filter.Match(m.audits[i]) {
+			copied := *m.audits[i]
+			entries = append(entries, &copied)
+		}
+	}
+	return entries, nil
+}
+
+func (m *MemStore) DeleteAudits(ctx context.Context, before int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	kept := m.audits[:0]
+	for _, e := range m.audits {
+		if e.Time >= before {
+			kept = append(kept, e)
+		}
+	}
+	m.audits = kept
+	return nil
+}
+
+func (m *MemStore) InsertApiKey(ctx context.Context, key *ApiKey) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, old := range m.keys {
+		if old.KeyHash == key.KeyHash {
+			return fmt.Errorf("api key hash already exists")
+		}
+	}
+	key.Id = m.newId()
+	copied := *key
+	m.keys[key.Id] = &copied
+	return nil
+}
+
+func (m *MemStore) DeleteApiKey(ctx context.Context, id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.keys, id)
+	return nil
+}
+
+func (m *MemStore) LoadApiKeys(ctx context.Context) ([]*ApiKey, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keys := make([]*ApiKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		copied := *key
+		keys = append(keys, &copied)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Id < keys[j].Id })
+	return keys, nil
+}
+
+func (m *MemStore) InsertKickJob(ctx context.Context, job *KickJob) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.kickJobs[job.ID]; ok {
+		return fmt.Errorf("duplicate kick job %v", job.ID)
+	}
+	copied := *job
+	copied.onDone = nil
+	m.kickJobs[job.ID] = &copied
+	return nil
+}
+
+func (m *MemStore) UpdateKickJob(ctx context.Context, job *KickJob) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.kickJobs[job.ID]; !ok {
+		return fmt.Errorf("kick job %v not exists", job.ID)
+	}
+	copied := *job
+	copied.onDone = nil
+	m.kickJobs[job.ID] = &copied
+	return nil
+}
+
+func (m *MemStore) LoadKickJobs(ctx context.Context, limit int) ([]*KickJob, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	jobs := make([]*KickJob, 0, len(m.kickJobs))
+	for _, job := range m.kickJobs {
+		copied := *job
+		jobs = append(jobs, &copied)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreateTime > jobs[j].CreateTime })
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+func (m *MemStore) LoadUnfinishedKickJobs(ctx context.Context) ([]*KickJob, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	jobs := make([]*KickJob, 0)
+	for _, job := range m.kickJobs {
+		if !job.Finished() {
+			copied := *job
+			jobs = append(jobs, &copied)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreateTime > jobs[j].CreateTime })
+	return jobs, nil
+}
+
+func (m *MemStore) DeleteKickJobs(ctx context.Context, before int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, job := range m.kickJobs {
+		if job.Finished() && job.UpdateTime < before {
+			delete(m.kickJobs, id)
+		}
+	}
+	return nil
+}
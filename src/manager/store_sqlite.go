@@ -0,0 +1,23 @@
+//go:build sqlite
+// +build sqlite
+
+package manager
+
+import (
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// go-sqlite3 需要 cgo 用 -tags sqlite 编译时才支持
+// 单机部署用的 sqlite 存储 path 为数据库文件路径 表结构由 -migrate up 创建
+// sqlite 同时只能有一个写入 连接池只保留一个连接
+// 连接被回收后内存数据库会丢失 所以不能用 :memory:
+func NewSQLiteStore(path string, opts DBPoolOptions) (*DBSync, error) {
+	if path == "" || path == ":memory:" {
+		return nil, fmt.Errorf("invalid sqlite path %q", path)
+	}
+	opts.MaxOpen = 1
+	opts.MaxIdle = 1
+	return NewDBSync(STORE_DRIVER_SQLITE, path, opts)
+}
@@ -0,0 +1,11 @@
+//go:build !sqlite
+// +build !sqlite
+
+package manager
+
+import "errors"
+
+// 默认只编译 mysql 用 -tags sqlite 编译才支持 sqlite
+func NewSQLiteStore(path string, opts DBPoolOptions) (*DBSync, error) {
+	return nil, errors.New("sqlite3 not supported, rebuild with -tags sqlite")
+}
@@ -0,0 +1,111 @@
+//go:build sqlite
+// +build sqlite
+
+package manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// go test -tags sqlite
+func TestSQLiteStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "srs_manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSQLiteStore(filepath.Join(dir, "manager.db"), DefaultDBPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMigrator(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	if stats := s.Stats(); stats.MaxOpenConnections != 1 {
+		t.Errorf("sqlite pool max open got %v", stats.MaxOpenConnections)
+	}
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	dir, err := os.MkdirTemp("", "srs_manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := NewSQLiteStore(filepath.Join(dir, "manager.db"), DefaultDBPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	m, err := NewMigrator(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err = m.Verify(ctx); err == nil {
+		t.Errorf("empty database should not pass verify")
+	}
+	if err = m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Verify(ctx); err != nil {
+		t.Errorf("verify after up %v", err)
+	}
+	if err = m.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Version(ctx); v != 1 {
+		t.Errorf("version after down got %v", v)
+	}
+	// 表还在 但是列和代码对不上
+	if err = m.Verify(ctx); err == nil {
+		t.Errorf("version 1 should not pass verify")
+	}
+	if err = m.Down(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Version(ctx); v != m.Latest() {
+		t.Errorf("version after up got %v", v)
+	}
+}
+
+// 已经在用的库由旧代码建表 srs_server 是 addr 列 0002 不需要改名
+func TestMigrateExistingAddr(t *testing.T) {
+	dir, err := os.MkdirTemp("", "srs_manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := NewSQLiteStore(filepath.Join(dir, "manager.db"), DefaultDBPoolOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ctx := context.Background()
+	if _, err = d.exec(ctx, "CREATE TABLE `srs_server` (`id` INTEGER PRIMARY KEY AUTOINCREMENT, "+
+		"`addr` TEXT NOT NULL, `desc` TEXT DEFAULT '', `type` INTEGER NOT NULL, `status` INTEGER NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMigrator(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Verify(ctx); err != nil {
+		t.Errorf("verify after up %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 各个 Store 实现需要一致的行为
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	room := &Room{UserName: "u1", StreamName: "s1", Status: ROOM_CREATE, BusinessUnit: "bu1"}
+	if err := s.InsertRoom(ctx, room); err != nil || room.Id <= 0 {
+		t.Fatalf("InsertRoom id:%v err:%v", room.Id, err)
+	}
+	room.Status = ROOM_PUBLISH
+	room.PublishHost = "1.2.3.4:1935"
+	if err := s.UpdateRoom(ctx, room); err != nil {
+		t.Fatalf("UpdateRoom %v", err)
+	}
+	got, err := s.SelectRoom(ctx, map[string]interface{}{"streamname": "s1"})
+	if err != nil || got == nil || got.Status != ROOM_PUBLISH || got.PublishHost != "1.2.3.4:1935" {
+		t.Fatalf("SelectRoom got %+v err:%v", got, err)
+	}
+	if got, err = s.SelectRoom(ctx, map[string]interface{}{"streamname": "none"}); got != nil || err != nil {
+		t.Errorf("SelectRoom not exists got %+v err:%v", got, err)
+	}
+	rooms, err := s.SelectRooms(ctx, map[string]interface{}{"status": ROOM_PUBLISH})
+	if err != nil || len(rooms) != 1 {
+		t.Errorf("SelectRooms got %v err:%v", len(rooms), err)
+	}
+	if counts, _ := s.CountRoomsByStatus(ctx); counts[ROOM_PUBLISH] != 1 {
+		t.Errorf("CountRoomsByStatus got %v", counts)
+	}
+
+	svr := NewSrsServer("1.2.3.4:1985", "", SERVER_TYPE_EDGE_DOWN)
+	if err = s.InsertServer(ctx, svr); err != nil {
+		t.Fatalf("InsertServer %v", err)
+	}
+	svr.SetStatus(SERVER_STATUS_OFFLINE)
+	if err = s.UpdateServerStatus(ctx, svr); err != nil {
+		t.Fatalf("UpdateServerStatus %v", err)
+	}
+	servers, err := s.LoadSrsServers(ctx)
+	if err != nil || len(servers) != 1 || servers[0].Status != SERVER_STATUS_OFFLINE {
+		t.Errorf("LoadSrsServers got %v err:%v", servers, err)
+	}
+
+	ban := &RoomBan{StreamName: "s1", Type: BAN_TYPE_IP, Value: "1.1.1.1"}
+	if err = s.InsertRoomBan(ctx, ban); err != nil {
+		t.Fatalf("InsertRoomBan %v", err)
+	}
+	if err = s.DeleteRoomBan(ctx, ban.Id); err != nil {
+		t.Fatalf("DeleteRoomBan %v", err)
+	}
+	if bans, _ := s.LoadRoomBans(ctx); len(bans) != 0 {
+		t.Errorf("LoadRoomBans got %v", len(bans))
+	}
+
+	plays := []*GeoPlays{{StreamName: "s1", Hour: 3600, Province: "beijing", Isp: "ct", Plays: 2}}
+	s.AddGeoPlays(ctx, plays)
+	s.AddGeoPlays(ctx, plays)
+	if got, _ := s.SelectGeoPlays(ctx, "s1", 3600, 7200); len(got) != 1 || got[0].Plays != 4 {
+		t.Errorf("SelectGeoPlays got %v", got)
+	}
+
+	usage := []*UsageBucket{{Hour: 3600, StreamName: "s1", UserName: "u1", SendBytes: 100, RecvBytes: 10}}
+	s.AddUsage(ctx, usage)
+	s.AddUsage(ctx, usage)
+	if rows, _ := s.SumUsage(ctx, "user", 0, 7200); len(rows) != 1 || rows[0].Key != "u1" || rows[0].SendBytes != 200 {
+		t.Errorf("SumUsage got %v", rows)
+	}
+	if rows, _ := s.SelectHourlyUsage(ctx, "streamname", 0, 7200); len(rows) != 1 || rows[0].RecvBytes != 20 {
+		t.Errorf("SelectHourlyUsage got %v", rows)
+	}
+
+	incident := &StreamIncident{StreamName: "s1", UserName: "u1", State: STREAM_STALLED, StartTime: 100}
+	if err = s.InsertIncident(ctx, incident); err != nil {
+		t.Fatalf("InsertIncident %v", err)
+	}
+	incident.EndTime = 200
+	s.UpdateIncident(ctx, incident)
+	if got, _ := s.SelectIncidents(ctx, "s1", 10); len(got) != 1 || got[0].EndTime != 200 {
+		t.Errorf("SelectIncidents got %v", got)
+	}
+
+	s.InsertHistoryRollups(ctx, []*HistoryRollup{
+		{Series: "a", Resolution: 60, Time: 120, Avg: 2},
+		{Series: "a", Resolution: 60, Time: 60, Avg: 1},
+	})
+	if err = s.InsertHistoryRollups(ctx, []*HistoryRollup{{Series: "a", Resolution: 60, Time: 120, Avg: 3}}); err != nil {
+		t.Fatalf("InsertHistoryRollups upsert %v", err)
+	}
+	s.DeleteHistoryRollups(ctx, 60, 100)
+	if got, _ := s.SelectHistoryRollups(ctx, "a", 60, 0, 200); len(got) != 1 || got[0].Time != 120 || got[0].Avg != 3 {
+		t.Errorf("SelectHistoryRollups got %v", got)
+	}
+
+	job := &KickJob{ID: "k1", StreamName: "s1", Host: "1.2.3.4:1985", Status: KICK_JOB_PENDING, CreateTime: 100}
+	if err = s.InsertKickJob(ctx, job); err != nil {
+		t.Fatalf("InsertKickJob %v", err)
+	}
+	s.InsertKickJob(ctx, &KickJob{ID: "k2", StreamName: "s2", Status: KICK_JOB_DONE, CreateTime: 200})
+	job.Status, job.Attempts, job.LastError = KICK_JOB_RUNNING, 2, "timeout"
+	if err = s.UpdateKickJob(ctx, job); err != nil {
+		t.Fatalf("UpdateKickJob %v", err)
+	}
+	jobs, err := s.LoadKickJobs(ctx, 10)
+	if err != nil || len(jobs) != 2 || jobs[0].ID != "k2" || jobs[1].Status != KICK_JOB_RUNNING || jobs[1].Attempts != 2 {
+		t.Errorf("LoadKickJobs got %v err:%v", jobs, err)
+	}
+	s.DeleteKickJobs(ctx, 300)
+	if jobs, err = s.LoadUnfinishedKickJobs(ctx); err != nil || len(jobs) != 1 || jobs[0].ID != "k1" {
+		t.Errorf("LoadUnfinishedKickJobs got %v err:%v", jobs, err)
+	}
+	if jobs, _ = s.LoadKickJobs(ctx, 10); len(jobs) != 1 {
+		t.Errorf("DeleteKickJobs left %v", jobs)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
+
+func TestOnPublishWithMemStore(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	live := NewLiveHub(nil)
+	servers := newServerManager(db, nil)
+	servers.servers[SERVER_TYPE_EDGE_UP]["1.2.3.4:1985"] = NewSrsServer("1.2.3.4:1985", "", SERVER_TYPE_EDGE_UP)
+	event := &EventManager{db: db, servers: servers, bans: NewBanList(db), live: live}
+
+	info := ConnectInfo{StreamName: "s1", ClientID: 10, Args: []string{"6.6.6.6", "1985"}, Caller: "1.2.3.4"}
+	if err := event.OnPublish(context.Background(), info); err == nil {
+		t.Errorf("publish to unknown room should fail")
+	}
+
+	room := &Room{StreamName: "s1", Status: ROOM_CREATE, Expiration: time.Now().Unix() + 60}
+	db.InsertRoom(ctx, room)
+	forged := info
+	forged.Caller = "6.6.6.6"
+	if err := event.OnPublish(context.Background(), forged); err == nil {
+		t.Errorf("publish from unregistered caller should fail")
+	}
+	if err := event.OnPublish(context.Background(), info); err != nil {
+		t.Fatalf("OnPublish %v", err)
+	}
+	got, _ := db.SelectRoom(ctx, map[string]interface{}{"streamname": "s1"})
+	if got.Status != ROOM_PUBLISH || got.PublishClientId != 10 || got.PublishHost != "1.2.3.4:1985" {
+		t.Errorf("room after publish %+v", got)
+	}
+}
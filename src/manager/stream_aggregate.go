@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	AGGREGATE_SORT_VIEWERS = "viewers"
+	AGGREGATE_SORT_EGRESS  = "egress"
+	AGGREGATE_SORT_NAME    = "name"
+)
+
+// 一个流在整个集群上的汇总
+type StreamAggregate struct {
+	VHost       string
+	AppName     string
+	Name        string
+	PublishEdge string   // 推流端所在的上行边缘
+	Origin      []string // 有该流的源站
+	Edges       []string // 提供播放的下行边缘
+	Viewers     int
+	EgressKbps  int
+	RecvKbps    int // 源站上的接收码率
+	RoomId      int64
+	RoomUser    string
+	RoomStatus  int
+}
+
+func aggregateKey(vhost, app, name string) string {
+	return vhost + "/" + app + "/" + name
+}
+
+func (s *ServerManager) AggregateStreams(ctx context.Context) []*StreamAggregate {
+	result := make(map[string]*StreamAggregate)
+	get := func(vhost string, st utils.Stream) *StreamAggregate {
+		key := aggregateKey(vhost, st.AppName, st.Name)
+		agg, ok := result[key]
+		if !ok {
+			agg = &StreamAggregate{VHost: vhost, AppName: st.AppName, Name: st.Name,
+				Origin: []string{}, Edges: []string{}, RoomStatus: -1}
+			result[key] = agg
+		}
+		return agg
+	}
+
+	for _, typeName := range []string{STR_TYPE_ORIGIN, STR_TYPE_EDGE_UP, STR_TYPE_EDGE_DOWN} {
+		for _, svr := range s.getServerList(typeName) {
+			vhosts := make(map[int]string)
+			for _, v := range svr.GetVhosts().Vhosts {
+				vhosts[v.ID] = v.Name
+			}
+			for _, st := range svr.GetStreams().Streams {
+				agg := get(vhosts[st.VHost], st)
+				switch typeName {
+				case STR_TYPE_ORIGIN:
+					agg.Origin = append(agg.Origin, svr.Addr)
+					agg.RecvKbps += st.Kbps.Recv30s
+				case STR_TYPE_EDGE_UP:
+					if st.Publish.Active {
+						agg.PublishEdge = svr.Addr
+					}
+				case STR_TYPE_EDGE_DOWN:
+					agg.Edges = append(agg.Edges, svr.Addr)
+					agg.Viewers += st.ClientNum
+					agg.EgressKbps += st.Kbps.Send30s
+				}
+			}
+		}
+	}
+
+	rooms, err := s.db.SelectRooms(ctx, map[string]interface{}{"status": ROOM_PUBLISH})
+	if err != nil {
+		glog.Warningln("AggregateStreams SelectRooms", err)
+	}
+	byName := make(map[string]*Room)
+	for _, room := range rooms {
+		byName[room.StreamName] = room
+	}
+
+	list := make([]*StreamAggregate, 0, len(result))
+	for _, agg := range result {
+		if room, ok := byName[agg.Name]; ok {
+			agg.RoomId = room.Id
+			agg.RoomUser = room.UserName
+			agg.RoomStatus = room.Status
+			if agg.PublishEdge == "" {
+				agg.PublishEdge = room.PublishHost
+			}
+		}
+		sort.Strings(agg.Origin)
+		sort.Strings(agg.Edges)
+		list = append(list, agg)
+	}
+	return list
+}
+
+func sortAggregates(list []*StreamAggregate, by string, asc bool) {
+	less := func(i, j int) bool {
+		switch by {
+		case AGGREGATE_SORT_EGRESS:
+			return list[i].EgressKbps < list[j].EgressKbps
+		case AGGREGATE_SORT_NAME:
+			return aggregateKey(list[i].VHost, list[i].AppName, list[i].Name) <
+				aggregateKey(list[j].VHost, list[j].AppName, list[j].Name)
+		default:
+			return list[i].Viewers < list[j].Viewers
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if asc {
+			return less(i, j)
+		}
+		return less(j, i)
+	})
+}
+
+// /streams/aggregate?sort=viewers|egress|name&order=asc|desc&top=10
+func (s *ServerManager) aggregateHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	by := query.Get("sort")
+	if by == "" {
+		by = AGGREGATE_SORT_VIEWERS
+	}
+	if by != AGGREGATE_SORT_VIEWERS && by != AGGREGATE_SORT_EGRESS && by != AGGREGATE_SORT_NAME {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	asc := query.Get("order") == "asc"
+	if query.Get("order") == "" && by == AGGREGATE_SORT_NAME {
+		asc = true
+	}
+
+	list := s.AggregateStreams(r.Context())
+	sortAggregates(list, by, asc)
+	if top, err := strconv.Atoi(query.Get("top")); err == nil && top >= 0 && top < len(list) {
+		list = list[:top]
+	}
+
+	if err := utils.WriteObjectResponse(w, list); err != nil {
+		glog.Warningln("aggregateHandler writeRespons err", err)
+	}
+}
@@ -0,0 +1,363 @@
+package manager
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	USAGE_FLUSH_INTERVAL = time.Minute
+	USAGE_BUCKET         = 3600 // 按小时统计
+	USAGE_PERCENTILE     = 95
+
+	USAGE_GROUP_USER = "user"
+	USAGE_GROUP_ROOM = "room"
+	USAGE_GROUP_BU   = "bu"
+
+	USAGE_REPORT_TOTAL = "total"
+	USAGE_REPORT_P95   = "p95"
+
+	USAGE_FORMAT_CSV   = "csv"
+	USAGE_MONTH_LAYOUT = "2006-01"
+)
+
+var usageGroupColumns = map[string]string{
+	USAGE_GROUP_USER: "user",
+	USAGE_GROUP_ROOM: "streamname",
+	USAGE_GROUP_BU:   "bu",
+}
+
+// 一个流一小时的流量 发送取下行边缘 接收取上行边缘
+type UsageBucket struct {
+	Hour         int64
+	StreamName   string
+	UserName     string
+	BusinessUnit string
+	SendBytes    int64
+	RecvBytes    int64
+}
+
+type UsageReportRow struct {
+	Key         string
+	SendBytes   int64
+	RecvBytes   int64
+	P95SendKbps float64
+}
+
+// 按分组汇总后每小时的流量
+type UsageHourly struct {
+	Key       string
+	Hour      int64
+	SendBytes int64
+	RecvBytes int64
+}
+
+type usageCounter struct {
+	bytes      int64
+	updateTime int64
+}
+
+type usageKey struct {
+	hour       int64
+	streamName string
+}
+
+// 把srs上每个流的累计字节数积分成每小时的流量 srs重启计数器变小时按重置处理
+type UsageAccounting struct {
+	db   Store
+	sm   *ServerManager
+	loop Loop
+
+	lock    sync.Mutex
+	warm    bool // 第一轮采样只记录基线 不计费
+	last    map[string]usageCounter
+	pending map[usageKey]*UsageBucket
+}
+
+func NewUsageAccounting(db Store, sm *ServerManager) *UsageAccounting {
+	return &UsageAccounting{
+		db:      db,
+		sm:      sm,
+		last:    make(map[string]usageCounter),
+		pending: make(map[usageKey]*UsageBucket),
+	}
+}
+
+func (u *UsageAccounting) Start(ctx context.Context) {
+	u.loop.Start(ctx, u.Run)
+}
+
+func (u *UsageAccounting) Stop(ctx context.Context) error {
+	return u.loop.Stop(ctx)
+}
+
+// ctx 取消时写完已经累计的流量
+func (u *UsageAccounting) Run(ctx context.Context) {
+	lastFlush := time.Now()
+	for sleepContext(ctx, u.sm.PollInterval()) {
+		u.sample(time.Now().Unix())
+		if time.Since(lastFlush) >= USAGE_FLUSH_INTERVAL {
+			u.flush()
+			lastFlush = time.Now()
+		}
+	}
+	u.flush()
+}
+
+// 计数器增量 变小说明srs重启或者流重新推送 当前值就是增量
+func counterDelta(last, cur int64) int64 {
+	if cur >= last {
+		return cur - last
+	}
+	return cur
+}
+
+func (u *UsageAccounting) sample(now int64) {
+	hour := now / USAGE_BUCKET * USAGE_BUCKET
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	seen := make(map[string]bool)
+	for _, typeName := range []string{STR_TYPE_EDGE_DOWN, STR_TYPE_EDGE_UP} {
+		for _, svr := range u.sm.getServerList(typeName) {
+			info := svr.GetStreams()
+			for _, st := range info.Streams {
+				key := fmt.Sprintf("%s|%s|%d|%s/%s", typeName, svr.Addr, st.VHost, st.AppName, st.Name)
+				seen[key] = true
+				bytes := st.SendBytes
+				if typeName == STR_TYPE_EDGE_UP {
+					bytes = st.RecvBytes
+				}
+
+				last, ok := u.last[key]
+				if ok && last.updateTime == info.UpdateTime {
+					// 还是上一次拉取的数据
+					continue
+				}
+				u.last[key] = usageCounter{bytes: bytes, updateTime: info.UpdateTime}
+
+				var delta int64
+				if ok {
+					delta = counterDelta(last.bytes, bytes)
+				} else if u.warm {
+					// 启动之后新出现的流 全部计入
+					delta = bytes
+				}
+				if delta == 0 {
+					continue
+				}
+
+				bk := usageKey{hour: hour, streamName: st.Name}
+				b, ok := u.pending[bk]
+				if !ok {
+					b = &UsageBucket{Hour: hour, StreamName: st.Name}
+					u.pending[bk] = b
+				}
+				if typeName == STR_TYPE_EDGE_UP {
+					b.RecvBytes += delta
+				} else {
+					b.SendBytes += delta
+				}
+			}
+		}
+	}
+	for key := range u.last {
+		if !seen[key] {
+			delete(u.last, key)
+		}
+	}
+	u.warm = true
+}
+
+func (u *UsageAccounting) flush() {
+	u.lock.Lock()
+	pending := u.pending
+	u.pending = make(map[usageKey]*UsageBucket)
+	u.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	rooms := make(map[string]*Room)
+	buckets := make([]*UsageBucket, 0, len(pending))
+	for _, b := range pending {
+		room, ok := rooms[b.StreamName]
+		if !ok {
+			params := map[string]interface{}{"streamname": b.StreamName}
+			if r, err := u.db.SelectRoom(context.Background(), params); err == nil {
+				room = r
+			}
+			rooms[b.StreamName] = room
+		}
+		if room != nil {
+			b.UserName = room.UserName
+			b.BusinessUnit = room.BusinessUnit
+		}
+		buckets = append(buckets, b)
+	}
+
+	if err := u.db.AddUsage(context.Background(), buckets); err != nil {
+		glog.Warningln("UsageAccounting flush", len(buckets), err)
+		u.lock.Lock()
+		for k, b := range pending {
+			if cur, ok := u.pending[k]; ok {
+				cur.SendBytes += b.SendBytes
+				cur.RecvBytes += b.RecvBytes
+			} else {
+				u.pending[k] = b
+			}
+		}
+		u.lock.Unlock()
+	}
+}
+
+// 第p百分位 样本不足totalSamples时按0补齐
+func percentile(values []float64, totalSamples int, p float64) float64 {
+	if totalSamples < len(values) {
+		totalSamples = len(values)
+	}
+	if totalSamples == 0 {
+		return 0
+	}
+	sorted := make([]float64, totalSamples)
+	copy(sorted[totalSamples-len(values):], values)
+	sort.Float64s(sorted)
+	index := int(math.Ceil(p/100*float64(totalSamples))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
+
+func (u *UsageAccounting) Report(ctx context.Context, report, group string, from, to int64) ([]*UsageReportRow, error) {
+	column, ok := usageGroupColumns[group]
+	if !ok {
+		return nil, fmt.Errorf("invalid group %v", group)
+	}
+	switch report {
+	case USAGE_REPORT_TOTAL:
+		return u.db.SumUsage(ctx, column, from, to)
+	case USAGE_REPORT_P95:
+		hourly, err := u.db.SelectHourlyUsage(ctx, column, from, to)
+		if err != nil {
+			return nil, err
+		}
+		// 还没到的小时不补0 例如查询当月时只算到当前小时
+		end := to
+		if now := time.Now().Unix(); end > now {
+			end = now
+		}
+		hours := 0
+		if end > from {
+			hours = int((end - from + USAGE_BUCKET - 1) / USAGE_BUCKET)
+		}
+		kbps := make(map[string][]float64)
+		rows := make(map[string]*UsageReportRow)
+		for _, b := range hourly {
+			row, ok := rows[b.Key]
+			if !ok {
+				row = &UsageReportRow{Key: b.Key}
+				rows[b.Key] = row
+			}
+			row.SendBytes += b.SendBytes
+			row.RecvBytes += b.RecvBytes
+			kbps[b.Key] = append(kbps[b.Key], float64(b.SendBytes)*8/1000/USAGE_BUCKET)
+		}
+		result := make([]*UsageReportRow, 0, len(rows))
+		for key, row := range rows {
+			row.P95SendKbps = percentile(kbps[key], hours, USAGE_PERCENTILE)
+			result = append(result, row)
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+		return result, nil
+	}
+	return nil, fmt.Errorf("invalid report %v", report)
+}
+
+// 时间范围 month=2016-10 优先 其次 from to 默认当月
+func usageRange(r *http.Request) (int64, int64, error) {
+	query := r.URL.Query()
+	month := query.Get("month")
+	if month == "" && query.Get("from") == "" {
+		month = time.Now().Format(USAGE_MONTH_LAYOUT)
+	}
+	if month != "" {
+		t, err := time.ParseInLocation(USAGE_MONTH_LAYOUT, month, time.Local)
+		if err != nil {
+			return 0, 0, err
+		}
+		return t.Unix(), t.AddDate(0, 1, 0).Unix(), nil
+	}
+	now := time.Now().Unix()
+	from := parseInt64(query.Get("from"), now-24*3600)
+	to := parseInt64(query.Get("to"), now)
+	if to <= from {
+		return 0, 0, fmt.Errorf("invalid range from:%v to:%v", from, to)
+	}
+	return from, to, nil
+}
+
+// /usage?report=total|p95&group=user|room|bu&month=2016-10&format=csv
+// /usage?report=total&group=room&from=&to=
+func (u *UsageAccounting) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	report := query.Get("report")
+	if report == "" {
+		report = USAGE_REPORT_TOTAL
+	}
+	group := query.Get("group")
+	if group == "" {
+		group = USAGE_GROUP_USER
+	}
+	from, to, err := usageRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		glog.Warningln("usage range", err)
+		return
+	}
+
+	rows, err := u.Report(r.Context(), report, group, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		glog.Warningln("usage report", report, group, err)
+		return
+	}
+
+	if query.Get("format") != USAGE_FORMAT_CSV {
+		if err = utils.WriteObjectResponse(w, rows); err != nil {
+			glog.Warningln("usage writeRespons err", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=usage_%s_%s_%d_%d.csv", report, group, from, to))
+	cw := csv.NewWriter(w)
+	header := []string{group, "send_bytes", "recv_bytes"}
+	if report == USAGE_REPORT_P95 {
+		header = append(header, "p95_send_kbps")
+	}
+	cw.Write(header)
+	for _, row := range rows {
+		record := []string{row.Key, strconv.FormatInt(row.SendBytes, 10), strconv.FormatInt(row.RecvBytes, 10)}
+		if report == USAGE_REPORT_P95 {
+			record = append(record, strconv.FormatFloat(row.P95SendKbps, 'f', 2, 64))
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		glog.Warningln("usage csv err", err)
+	}
+}
@@ -0,0 +1,53 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCounterDelta(t *testing.T) {
+	if d := counterDelta(100, 150); d != 50 {
+		t.Errorf("counterDelta increase got %v", d)
+	}
+	// srs 重启后计数器从0开始
+	if d := counterDelta(1000, 30); d != 30 {
+		t.Errorf("counterDelta reset got %v", d)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := make([]float64, 0, 100)
+	for i := 1; i <= 100; i++ {
+		values = append(values, float64(i))
+	}
+	if p := percentile(values, 100, 95); p != 95 {
+		t.Errorf("percentile got %v", p)
+	}
+	// 缺少的小时按0补齐
+	if p := percentile([]float64{10, 20}, 20, 95); p != 10 {
+		t.Errorf("percentile padded got %v", p)
+	}
+	if p := percentile(nil, 0, 95); p != 0 {
+		t.Errorf("percentile empty got %v", p)
+	}
+}
+
+// 查询范围包含未来时 只按已经过去的小时数补0
+func TestUsageReportFutureHours(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStore()
+	usage := NewUsageAccounting(db, nil)
+	hour := time.Now().Unix() / USAGE_BUCKET * USAGE_BUCKET
+	var buckets []*UsageBucket
+	for i := int64(0); i < 10; i++ {
+		buckets = append(buckets, &UsageBucket{Hour: hour - i*USAGE_BUCKET, StreamName: "s1", SendBytes: 3600 * 1000})
+	}
+	db.AddUsage(ctx, buckets)
+
+	from := hour - 9*USAGE_BUCKET
+	rows, err := usage.Report(ctx, USAGE_REPORT_P95, USAGE_GROUP_ROOM, from, from+30*24*3600)
+	if err != nil || len(rows) != 1 || rows[0].P95SendKbps != 8 {
+		t.Fatalf("p95 report got %+v err:%v", rows, err)
+	}
+}
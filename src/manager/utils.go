@@ -1,9 +1,20 @@
 package manager
 
-import "strings"
+import (
+	"net/url"
+	"strings"
+)
 
 func GetUrlParams(mainpath, subpath string) []string {
 	url := mainpath[len(subpath):]
 	url = strings.Trim(url, URL_PATH_SEPARATOR)
 	return strings.Split(url, URL_PATH_SEPARATOR)
 }
+
+// 从播放地址的参数中取出指定的值 例如 rtmp://x/live?user=xxx
+func GetUrlQuery(rawurl, key string) string {
+	if u, err := url.Parse(rawurl); err == nil {
+		return u.Query().Get(key)
+	}
+	return ""
+}
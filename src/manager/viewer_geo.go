@@ -0,0 +1,219 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utils"
+
+	"github.com/golang/glog"
+)
+
+const (
+	GEO_UNKNOWN          = "unknown"
+	GEO_FLUSH_INTERVAL   = time.Minute
+	GEO_BUCKET           = 3600 // 历史数据按小时统计播放次数
+	URL_SUB_PATH_HISTORY = "history"
+)
+
+type viewerGeo struct {
+	Province string
+	Isp      string
+}
+
+type GeoCount struct {
+	Province string
+	Isp      string
+	Viewers  int
+}
+
+type GeoBreakdown struct {
+	StreamName string
+	Total      int
+	Provinces  map[string]int
+	Isps       map[string]int
+	Breakdown  []GeoCount
+}
+
+// 按小时统计的播放次数
+type GeoPlays struct {
+	StreamName string
+	Hour       int64
+	Province   string
+	Isp        string
+	Plays      int
+}
+
+// 根据 on_play 的客户端IP统计每个流的观众地域和运营商分布
+type ViewerGeo struct {
+	db         Store
+	ipDatabase *IpDatabase
+	loop       Loop
+
+	lock    sync.Mutex
+	viewers map[string]map[string]viewerGeo // stream -> client key -> geo
+	clients map[string]string               // client key -> stream
+	pending map[GeoPlays]int                // 尚未写db的播放次数 Plays 字段为0
+}
+
+func NewViewerGeo(db Store, ipDatabase *IpDatabase) *ViewerGeo {
+	return &ViewerGeo{
+		db:         db,
+		ipDatabase: ipDatabase,
+		viewers:    make(map[string]map[string]viewerGeo),
+		clients:    make(map[string]string),
+		pending:    make(map[GeoPlays]int),
+	}
+}
+
+// 同一个client id在不同的边缘上可能重复 用回调地址区分
+func geoClientKey(info ConnectInfo) string {
+	return strings.Join(info.Args, ":") + "/" + strconv.Itoa(info.ClientID)
+}
+
+func (g *ViewerGeo) lookup(ip string) viewerGeo {
+	geo := viewerGeo{Province: GEO_UNKNOWN, Isp: GEO_UNKNOWN}
+	if subnet, err := g.ipDatabase.GetSubNet(ip); err == nil {
+		if subnet.Province != "" {
+			geo.Province = subnet.Province
+		}
+		if subnet.SupperIsp != "" {
+			geo.Isp = subnet.SupperIsp
+		}
+	}
+	return geo
+}
+
+func (g *ViewerGeo) OnPlay(info ConnectInfo) {
+	geo := g.lookup(info.Ip)
+	key := geoClientKey(info)
+	hour := time.Now().Unix() / GEO_BUCKET * GEO_BUCKET
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.remove(key)
+	if _, ok := g.viewers[info.StreamName]; !ok {
+		g.viewers[info.StreamName] = make(map[string]viewerGeo)
+	}
+	g.viewers[info.StreamName][key] = geo
+	g.clients[key] = info.StreamName
+	g.pending[GeoPlays{StreamName: info.StreamName, Hour: hour, Province: geo.Province, Isp: geo.Isp}]++
+}
+
+// on_stop 和 on_close 时调用
+func (g *ViewerGeo) OnStop(info ConnectInfo) {
+	g.lock.Lock()
+	g.remove(geoClientKey(info))
+	g.lock.Unlock()
+}
+
+func (g *ViewerGeo) remove(key string) {
+	stream, ok := g.clients[key]
+	if !ok {
+		return
+	}
+	delete(g.clients, key)
+	delete(g.viewers[stream], key)
+	if len(g.viewers[stream]) == 0 {
+		delete(g.viewers, stream)
+	}
+}
+
+func (g *ViewerGeo) Live(streamName string) GeoBreakdown {
+	b := GeoBreakdown{StreamName: streamName, Provinces: make(map[string]int),
+		Isps: make(map[string]int), Breakdown: []GeoCount{}}
+	counts := make(map[viewerGeo]int)
+	g.lock.Lock()
+	for _, geo := range g.viewers[streamName] {
+		counts[geo]++
+	}
+	g.lock.Unlock()
+
+	for geo, n := range counts {
+		b.Total += n
+		b.Provinces[geo.Province] += n
+		b.Isps[geo.Isp] += n
+		b.Breakdown = append(b.Breakdown, GeoCount{Province: geo.Province, Isp: geo.Isp, Viewers: n})
+	}
+	sort.Slice(b.Breakdown, func(i, j int) bool { return b.Breakdown[i].Viewers > b.Breakdown[j].Viewers })
+	return b
+}
+
+func (g *ViewerGeo) Start(ctx context.Context) {
+	g.loop.Start(ctx, g.Run)
+}
+
+func (g *ViewerGeo) Stop(ctx context.Context) error {
+	return g.loop.Stop(ctx)
+}
+
+// ctx 取消时写完还没有写库的播放次数
+func (g *ViewerGeo) Run(ctx context.Context) {
+	for sleepContext(ctx, GEO_FLUSH_INTERVAL) {
+		g.flush()
+	}
+	g.flush()
+}
+
+func (g *ViewerGeo) flush() {
+	g.lock.Lock()
+	pending := g.pending
+	g.pending = make(map[GeoPlays]int)
+	g.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	plays := make([]*GeoPlays, 0, len(pending))
+	for k, n := range pending {
+		p := k
+		p.Plays = n
+		plays = append(plays, &p)
+	}
+	if err := g.db.AddGeoPlays(context.Background(), plays); err != nil {
+		glog.Warningln("ViewerGeo flush", len(plays), err)
+		// 写失败时放回 下次再写
+		g.lock.Lock()
+		for k, n := range pending {
+			g.pending[k] += n
+		}
+		g.lock.Unlock()
+	}
+}
+
+// /geo/{stream}                            GET 当前观众分布
+// /geo/{stream}/history?from=&to=          GET 历史播放次数分布
+func (g *ViewerGeo) HttpHandler(w http.ResponseWriter, r *http.Request) {
+	args := GetUrlParams(r.URL.Path, URL_PATH_GEO)
+	if args[0] == "" || r.Method != HTTP_GET {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	if len(args) == 1 {
+		result = g.Live(args[0])
+	} else if len(args) == 2 && args[1] == URL_SUB_PATH_HISTORY {
+		now := time.Now().Unix()
+		from := parseInt64(r.URL.Query().Get("from"), now-24*3600)
+		to := parseInt64(r.URL.Query().Get("to"), now)
+		plays, err := g.db.SelectGeoPlays(r.Context(), args[0], from, to)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			glog.Warningln("SelectGeoPlays", args[0], err)
+			return
+		}
+		result = plays
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := utils.WriteObjectResponse(w, result); err != nil {
+		glog.Warningln("ViewerGeo writeRespons err", err)
+	}
+}
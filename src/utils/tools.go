@@ -1,28 +1,38 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 const (
 	URL_STREAMS_PATH   = "api/v1/streams"
 	URL_CLIENTS_PATH   = "api/v1/clients"
 	URL_SUMMARIES_PATH = "api/v1/summaries"
+	URL_VHOSTS_PATH    = "api/v1/vhosts"
+	URL_VERSIONS_PATH  = "api/v1/versions"
+
+	CLIENTS_PAGE_SIZE = 100
+	STREAMS_PAGE_SIZE = 100
+	REQUEST_TIMEOUT   = 10 * time.Second
 
 	HTTP_GET    = "GET"
 	HTTP_PUT    = "PUT"
 	HTTP_DELETE = "DELETE"
 )
 
-func sendRequest(method, url string) (respBody []byte, err error) {
+// 节点卡住时不能一直等 ctx 取消或者超时都会返回
+var client = &http.Client{Timeout: REQUEST_TIMEOUT}
+
+func sendRequest(ctx context.Context, method, url string) (respBody []byte, err error) {
 	var (
 		req *http.Request
 	)
-	client := http.DefaultClient
-	if req, err = http.NewRequest(method, url, nil); err != nil {
+	if req, err = http.NewRequestWithContext(ctx, method, url, nil); err != nil {
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
@@ -47,8 +57,8 @@ type KbpsInfo struct {
 }
 
 type Publisher struct {
-	Active bool `json:active` // 是否工作
-	CID    int  `json:cid`    // publisher ID
+	Active bool `json:"active"` // 是否工作
+	CID    int  `json:"cid"`    // publisher ID
 }
 
 type Stream struct {
@@ -70,10 +80,11 @@ type RspStream struct {
 	Streams  []Stream `json:"streams"`
 }
 
-func GetStreams(host string) (stream RspStream, err error) {
+// srs 默认只返回前 10 个 stream
+func GetStreams(ctx context.Context, host string, start, count int) (stream RspStream, err error) {
 	var body []byte
-	url := fmt.Sprintf("http://%s/%s", host, URL_STREAMS_PATH)
-	if body, err = sendRequest(HTTP_GET, url); err != nil {
+	url := fmt.Sprintf("http://%s/%s?start=%d&count=%d", host, URL_STREAMS_PATH, start, count)
+	if body, err = sendRequest(ctx, HTTP_GET, url); err != nil {
 		return
 	}
 	err = json.Unmarshal(body, &stream)
@@ -81,14 +92,35 @@ func GetStreams(host string) (stream RspStream, err error) {
 	return
 }
 
+// 分页拉取全部的stream 不支持分页的版本每页都一样 第一页之后停止
+func GetAllStreams(ctx context.Context, host string) (streams []Stream, err error) {
+	var rsp RspStream
+	for start := 0; ; start += STREAMS_PAGE_SIZE {
+		if rsp, err = GetStreams(ctx, host, start, STREAMS_PAGE_SIZE); err != nil {
+			return nil, err
+		} else if rsp.Code != 0 {
+			return nil, fmt.Errorf("GetStreams host:%v code:%v", host, rsp.Code)
+		}
+		if start > 0 && len(rsp.Streams) > 0 && rsp.Streams[0].ID == streams[0].ID {
+			break
+		}
+		streams = append(streams, rsp.Streams...)
+		if len(rsp.Streams) < STREAMS_PAGE_SIZE {
+			break
+		}
+	}
+
+	return
+}
+
 type RspBase struct {
 	Code int `json:"code"`
 }
 
-func KickOffClient(host string, clientID int) (rsp RspBase, err error) {
+func KickOffClient(ctx context.Context, host string, clientID int) (rsp RspBase, err error) {
 	var body []byte
 	url := fmt.Sprintf("http://%s/%s/%d", host, URL_CLIENTS_PATH, clientID)
-	if body, err = sendRequest(HTTP_DELETE, url); err == nil {
+	if body, err = sendRequest(ctx, HTTP_DELETE, url); err != nil {
 		return
 	}
 	err = json.Unmarshal(body, &rsp)
@@ -149,13 +181,116 @@ type RspSummary struct {
 	Data SummaryData `json:"data"`
 }
 
-func GetSummaries(host string) (info *RspSummary, err error) {
+func GetSummaries(ctx context.Context, host string) (info *RspSummary, err error) {
 	var body []byte
 	url := fmt.Sprintf("http://%s/%s", host, URL_SUMMARIES_PATH)
-	if body, err = sendRequest(HTTP_GET, url); err != nil {
+	if body, err = sendRequest(ctx, HTTP_GET, url); err != nil {
 		return
 	}
 	err = json.Unmarshal(body, &info)
 
 	return
 }
+
+type Vhost struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Enabled   bool     `json:"enabled"`
+	Clients   int      `json:"clients"`
+	Streams   int      `json:"streams"`
+	SendBytes int64    `json:"send_bytes"`
+	RecvBytes int64    `json:"recv_bytes"`
+	Kbps      KbpsInfo `json:"kbps"`
+}
+
+type RspVhosts struct {
+	Code     int     `json:"code"`
+	ServerID int     `json:"server"`
+	Vhosts   []Vhost `json:"vhosts"`
+}
+
+func GetVhosts(ctx context.Context, host string) (vhosts RspVhosts, err error) {
+	var body []byte
+	url := fmt.Sprintf("http://%s/%s", host, URL_VHOSTS_PATH)
+	if body, err = sendRequest(ctx, HTTP_GET, url); err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &vhosts)
+
+	return
+}
+
+type Client struct {
+	ID      int     `json:"id"`
+	VHost   int     `json:"vhost"`
+	Stream  int     `json:"stream"`
+	Ip      string  `json:"ip"`
+	PageUrl string  `json:"pageUrl"`
+	SwfUrl  string  `json:"swfUrl"`
+	TcUrl   string  `json:"tcUrl"`
+	Url     string  `json:"url"`
+	Type    string  `json:"type"`    // Play | fmle-publish | flash-publish ...
+	Publish bool    `json:"publish"` // 是否推流端
+	Alive   float64 `json:"alive"`   // 连接时长 秒
+}
+
+type RspClients struct {
+	Code     int      `json:"code"`
+	ServerID int      `json:"server"`
+	Clients  []Client `json:"clients"`
+}
+
+func GetClients(ctx context.Context, host string, start, count int) (clients RspClients, err error) {
+	var body []byte
+	url := fmt.Sprintf("http://%s/%s?start=%d&count=%d", host, URL_CLIENTS_PATH, start, count)
+	if body, err = sendRequest(ctx, HTTP_GET, url); err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &clients)
+
+	return
+}
+
+// 分页拉取全部的client 不支持分页的版本每页都一样 第一页之后停止
+func GetAllClients(ctx context.Context, host string) (clients []Client, err error) {
+	var rsp RspClients
+	for start := 0; ; start += CLIENTS_PAGE_SIZE {
+		if rsp, err = GetClients(ctx, host, start, CLIENTS_PAGE_SIZE); err != nil {
+			return nil, err
+		} else if rsp.Code != 0 {
+			return nil, fmt.Errorf("GetClients host:%v code:%v", host, rsp.Code)
+		}
+		if start > 0 && len(rsp.Clients) > 0 && rsp.Clients[0].ID == clients[0].ID {
+			break
+		}
+		clients = append(clients, rsp.Clients...)
+		if len(rsp.Clients) < CLIENTS_PAGE_SIZE {
+			break
+		}
+	}
+
+	return
+}
+
+type VersionData struct {
+	Major    int    `json:"major"`
+	Minor    int    `json:"minor"`
+	Revision int    `json:"revision"`
+	Version  string `json:"version"`
+}
+
+type RspVersion struct {
+	RspBase
+	Data VersionData `json:"data"`
+}
+
+func GetVersion(ctx context.Context, host string) (version RspVersion, err error) {
+	var body []byte
+	url := fmt.Sprintf("http://%s/%s", host, URL_VERSIONS_PATH)
+	if body, err = sendRequest(ctx, HTTP_GET, url); err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &version)
+
+	return
+}